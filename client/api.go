@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"Lab2/communication"
+	"Lab2/util"
+
+	"github.com/google/uuid"
+)
+
+// defaultChunkSize is the size above which a value is written in chunks, unless configured otherwise
+const defaultChunkSize = 64 << 10
+
+// ErrNotConnected is returned by the requests of a client that is not connected to a server
+var ErrNotConnected = errors.New("not connected to any server")
+
+var errUnknownResult = errors.New("unknown operation result from server")
+
+// Config configures a Client
+type Config struct {
+	// TLSConfig enables TLS for the connections to the server, see communication.LoadTLSConfig, nil disables it
+	TLSConfig *tls.Config
+	// OneShot sends every request over a connection of its own, instead of a persistent framed connection
+	OneShot bool
+	// ChunkSize is the size in bytes above which a value is written in chunks, 64 KiB if it is 0
+	ChunkSize int
+}
+
+// Client talks to a server of the store. It is safe for concurrent use by many goroutines, which share
+// the causal context of the client: a write causally follows every read and write the client made before it.
+// Failed requests return a *communication.Error, which errors.Is matches with sentinels such as
+// communication.ErrNotFound
+type Client struct {
+	clientId string
+
+	serverHostPort string
+	// sessionToken is issued by the server on connect if it authenticates clients
+	sessionToken string
+	tlsConfig    *tls.Config
+	chunkSize    int
+
+	// persistent tells if requests are sent over a persistent framed connection, instead of a connection each
+	persistent bool
+	// serverConn is the persistent connection to the server, dialed on the first request
+	serverConn *communication.FramedConnection
+	// serverProtocolVersion and serverFeatures are what the handshake with the server agreed on
+	serverProtocolVersion int
+	serverFeatures        map[string]bool
+	// compression counts the messages compressed over the persistent connections of the client
+	compression communication.CompressionMetrics
+
+	lock sync.Mutex
+}
+
+// Value is the value of a key, with the version of the write that produced it
+type Value struct {
+	Key                    string
+	Value                  string
+	OriginalServer         string
+	LamportsClockTimestamp uint64
+}
+
+// New makes a client, which must connect to a server before making requests
+func New(config Config) *Client {
+	chunkSize := config.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	return &Client{
+		clientId:   uuid.NewString(),
+		tlsConfig:  config.TLSConfig,
+		chunkSize:  chunkSize,
+		persistent: !config.OneShot,
+	}
+}
+
+// Connect connects the client to a server at ip:port, with a user and a password if the server authenticates
+// clients, or else empty ones
+func (c *Client) Connect(ctx context.Context, hostPort, user, password string) error {
+	if err := util.ValidateHostPort(hostPort); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	if c.serverHostPort != "" {
+		defer c.lock.Unlock()
+		return fmt.Errorf("already connected to %q", c.serverHostPort)
+	}
+	c.serverHostPort = hostPort
+	c.lock.Unlock()
+
+	if err := c.handshake(ctx); err != nil {
+		c.forgetServer()
+		return err
+	}
+
+	req := communication.ClientConnectRequest{
+		Op: communication.Connect,
+		Args: communication.ClientConnectRequestArgs{
+			ClientId: c.clientId,
+			User:     user,
+			Password: password,
+		},
+	}
+
+	var resp communication.ClientConnectResponse
+	if err := c.call(ctx, req, &resp); err != nil {
+		c.forgetServer()
+		return err
+	}
+	switch resp.Result {
+	case communication.Success:
+		c.lock.Lock()
+		c.sessionToken = resp.SessionToken
+		c.lock.Unlock()
+		return nil
+	case communication.Fail:
+		// the client may try again, such as with another password
+		c.forgetServer()
+		return communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		c.forgetServer()
+		return errUnknownResult
+	}
+}
+
+// Close disconnects the client from its server, after which it may connect again
+func (c *Client) Close() {
+	c.forgetServer()
+}
+
+// ServerHostPort returns the ip:port of the server the client is connected to, empty if it is not connected
+func (c *Client) ServerHostPort() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.serverHostPort
+}
+
+// ProtocolVersion returns the protocol version agreed on with the server
+func (c *Client) ProtocolVersion() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.serverProtocolVersion
+}
+
+// CompressionReport tells how many messages the client compressed and received compressed, and the compression ratio
+func (c *Client) CompressionReport() string {
+	return c.compression.Report()
+}
+
+// Get reads the value of a key, failing with communication.ErrNotFound if it does not exist.
+// Writes made by the client after it causally follow the version read
+func (c *Client) Get(ctx context.Context, key string) (Value, error) {
+	req := communication.ClientReadRequest{
+		Op: communication.Read,
+		Args: communication.ClientReadRequestArgs{
+			ClientId:     c.clientId,
+			SessionToken: c.token(),
+			Key:          key,
+		},
+	}
+
+	var resp communication.ClientReadResponse
+	if err := c.call(ctx, req, &resp); err != nil {
+		return Value{}, err
+	}
+	switch resp.Result {
+	case communication.Success:
+		value, err := communication.DecodeValue(resp.Value, resp.ValueEncoding)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{
+			Key:                    resp.Key,
+			Value:                  value,
+			OriginalServer:         resp.OriginalServer,
+			LamportsClockTimestamp: resp.LamportsClockTimestamp,
+		}, nil
+	case communication.Fail:
+		return Value{}, communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return Value{}, errUnknownResult
+	}
+}
+
+// Put writes the value of a key, which may hold any bytes. Values larger than the chunk size are uploaded
+// in many requests, and committed with the last one
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	_, err := c.put(ctx, communication.ClientWriteRequestArgs{Key: key}, value)
+	return err
+}
+
+// PutWithTimeToLive writes the value of a key, which expires after ttl, rounded down to whole seconds
+func (c *Client) PutWithTimeToLive(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl < time.Second {
+		return communication.Errorf(communication.BadRequest, "time to live %v is shorter than a second", ttl)
+	}
+	_, err := c.put(ctx, communication.ClientWriteRequestArgs{Key: key, TimeToLiveInSeconds: int64(ttl / time.Second)}, value)
+	return err
+}
+
+// Delete deletes a key, failing with communication.ErrNotFound if it does not exist.
+// The delete is replicated like a write, and causally follows the version it deletes
+func (c *Client) Delete(ctx context.Context, key string) error {
+	req := communication.ClientDeleteRequest{
+		Op: communication.Delete,
+		Args: communication.ClientDeleteRequestArgs{
+			ClientId:     c.clientId,
+			SessionToken: c.token(),
+			Key:          key,
+		},
+	}
+
+	var resp communication.ClientDeleteResponse
+	if err := c.call(ctx, req, &resp); err != nil {
+		return err
+	}
+	switch resp.Result {
+	case communication.Success:
+		return nil
+	case communication.Fail:
+		return communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return errUnknownResult
+	}
+}
+
+// put writes value with the other arguments of args, in chunks if it is larger than the chunk size,
+// and returns the number of requests it took
+func (c *Client) put(ctx context.Context, args communication.ClientWriteRequestArgs, value string) (int, error) {
+	args.ClientId = c.clientId
+	args.SessionToken = c.token()
+	if len(value) > c.getChunkSize() {
+		return c.writeInChunks(ctx, args, value)
+	}
+	args.Value, args.ValueEncoding = communication.EncodeValue(value)
+	req := communication.ClientWriteRequest{
+		Op:   communication.Write,
+		Args: args,
+	}
+
+	var resp communication.ClientWriteResponse
+	if err := c.call(ctx, req, &resp); err != nil {
+		return 0, err
+	}
+	switch resp.Result {
+	case communication.Success:
+		return 1, nil
+	case communication.Fail:
+		return 0, communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return 0, errUnknownResult
+	}
+}
+
+// writeInChunks uploads a value larger than the chunk size in many requests, the last of which commits the write.
+// The chunks are pipelined over the persistent connection
+func (c *Client) writeInChunks(ctx context.Context, args communication.ClientWriteRequestArgs, value string) (int, error) {
+	if err := c.requireFeature(communication.FeatureChunking); err != nil {
+		return 0, err
+	}
+	chunkSize := c.getChunkSize()
+	uploadId := uuid.NewString()
+	var reqs []interface{}
+	for offset := 0; offset < len(value); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		chunk, encoding := communication.EncodeValue(value[offset:end])
+		req := communication.ClientWriteChunkRequest{
+			Op: communication.WriteChunk,
+			Args: communication.ClientWriteChunkRequestArgs{
+				ClientId:      args.ClientId,
+				SessionToken:  args.SessionToken,
+				UploadId:      uploadId,
+				Offset:        int64(offset),
+				Chunk:         chunk,
+				ChunkEncoding: encoding,
+				Final:         end == len(value),
+				Write:         args,
+			},
+		}
+		reqs = append(reqs, req)
+	}
+
+	resps := make([]communication.ClientWriteChunkResponse, len(reqs))
+	dests := make([]interface{}, len(reqs))
+	for i := range resps {
+		dests[i] = &resps[i]
+	}
+	if err := c.pipeline(ctx, reqs, dests); err != nil {
+		return 0, err
+	}
+	for i, resp := range resps {
+		switch resp.Result {
+		case communication.Success:
+		case communication.Fail:
+			return 0, communication.ErrorOf(resp.ErrorCode, fmt.Sprintf("failed to upload chunk at offset %d: %s", i*chunkSize, resp.DetailedResult))
+		default:
+			return 0, errUnknownResult
+		}
+	}
+	return len(reqs), nil
+}
+
+// token returns the session token issued by the server, empty if it does not authenticate clients
+func (c *Client) token() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sessionToken
+}
+
+func (c *Client) getChunkSize() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.chunkSize
+}
+
+func (c *Client) setChunkSize(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.chunkSize = n
+}
@@ -2,10 +2,12 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -13,13 +15,16 @@ import (
 
 	"Lab2/communication"
 	"Lab2/util"
-
-	"github.com/google/uuid"
 )
 
+// watchReconnectInterval is how long to wait before reconnecting a disconnected watch
+const watchReconnectInterval = 1 * time.Second
+
 var (
-	serverHostPort string
-	clientID       string
+	// repl is the client the commands are sent with
+	repl *Client
+	// watches maps a watched key or prefix to the channel stopping the watch
+	watches = make(map[string]chan struct{})
 
 	genericLogger = log.New(os.Stdout, "", 0)
 	errorLogger   = log.New(os.Stdout, "ERROR: ", 0)
@@ -27,7 +32,7 @@ var (
 
 func Start() {
 	genericLogger.Println(welcomeMessage)
-	clientID = uuid.NewString()
+	repl = New(Config{})
 
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -36,33 +41,178 @@ func Start() {
 			continue
 		}
 
-		var (
-			result string
-			err    error
-		)
-		args := strings.Fields(line)
+		args, err := util.SplitCommandLine(line)
+		if err != nil {
+			errorLogger.Printf("%v", err)
+			continue
+		}
+		var result string
 		switch args[0] {
 		case connectCmd:
+			if len(args) == 2 {
+				result, err = handleConnect(args[1], "", "")
+			} else if len(args) == 4 {
+				result, err = handleConnect(args[1], args[2], args[3])
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case tlsCmd:
+			if len(args) == 2 {
+				result, err = handleTLS(args[1], "", "")
+			} else if len(args) == 4 {
+				result, err = handleTLS(args[1], args[2], args[3])
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case connectionCmd:
 			if len(args) != 2 {
 				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
 				break
 			}
-			result, err = handleConnect(args[1])
+			result, err = handleConnectionMode(args[1])
 		case readCmd:
+			argc := len(args)
+			if argc == 2 {
+				result, err = handleRead(args[1])
+			} else if argc == 4 && args[2] == atKeyword {
+				result, err = handleReadAt(args[1], args[3])
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case deleteCmd:
 			if len(args) != 2 {
 				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
 				break
 			}
-			result, err = handleRead(args[1])
+			result, err = handleDelete(args[1])
+		case historyCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleHistory(args[1])
 		case writeCmd:
+			ttl := "0"
+			if len(args) >= 5 && args[3] == ttlKeyword {
+				ttl = args[4]
+				args = append(args[:3:3], args[5:]...)
+			}
 			argc := len(args)
 			if argc == 3 {
-				result, err = handleWrite(args[1], args[2])
+				result, err = handleWrite(args[1], args[2], ttl)
 			} else if argc == 5 {
-				result, err = writeWithServerReplicatedWriteDelay(args[1], args[2], args[3], args[4])
+				result, err = writeWithServerReplicatedWriteDelay(args[1], args[2], args[3], args[4], ttl)
 			} else {
 				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
 			}
+		case writeFileCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleWriteFile(args[1], args[2])
+		case statsCmd:
+			result = repl.CompressionReport()
+		case chunkSizeCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleChunkSize(args[1])
+		case scanCmd:
+			argc := len(args)
+			if argc == 3 {
+				result, err = handleScan(communication.ClientScanRequestArgs{Start: args[1], End: args[2]})
+			} else if argc == 4 {
+				result, err = handleScan(communication.ClientScanRequestArgs{Start: args[1], End: args[2], Cursor: args[3]})
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case prefixCmd:
+			argc := len(args)
+			if argc == 2 {
+				result, err = handleScan(communication.ClientScanRequestArgs{Prefix: args[1]})
+			} else if argc == 3 {
+				result, err = handleScan(communication.ClientScanRequestArgs{Prefix: args[1], Cursor: args[2]})
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case queryCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleQuery(args[1], args[2])
+		case watchCmd:
+			argc := len(args)
+			if argc == 2 {
+				result, err = handleWatch(args[1], "")
+			} else if argc == 4 && args[2] == fromKeyword {
+				result, err = handleWatch(args[1], args[3])
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case unwatchCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleUnwatch(args[1])
+		case mgetCmd:
+			if len(args) < 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleMultiRead(args[1:])
+		case msetCmd:
+			if len(args) < 3 || len(args)%2 != 1 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleMultiWrite(args[1:])
+		case casCmd:
+			if len(args) != 5 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleCompareAndSet(args[1], args[2], args[3], args[4])
+		case setnxCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleSetIfAbsent(args[1], args[2])
+		case incrCmd:
+			argc := len(args)
+			if argc == 2 {
+				result, err = handleIncrement(args[1], "1")
+			} else if argc == 3 {
+				result, err = handleIncrement(args[1], args[2])
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case saddCmd, sremCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			op := communication.SetAdd
+			if args[0] == sremCmd {
+				op = communication.SetRemove
+			}
+			result, err = handleSetElement(op, args[1], args[2])
+		case smembersCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleSetMembers(args[1])
+		case mvsetCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = handleRegisterSet(args[1], args[2])
 		case hCmd:
 			fallthrough
 		case helpCmd:
@@ -77,7 +227,7 @@ func Start() {
 		}
 
 		if err != nil {
-			errorLogger.Printf("%v", err)
+			errorLogger.Printf("%s", formatError(err))
 		} else {
 			if result != "" {
 				genericLogger.Printf("%s", result)
@@ -89,94 +239,285 @@ func Start() {
 	}
 }
 
-func handleConnect(hostPort string) (string, error) {
-	if serverHostPort != "" {
-		return "", fmt.Errorf("already connected to %q", serverHostPort)
+func handleConnect(hostPort, user, password string) (string, error) {
+	if err := repl.Connect(context.Background(), hostPort, user, password); err != nil {
+		return "", err
 	}
-	if err := util.ValidateHostPort(hostPort); err != nil {
+	return fmt.Sprintf("connected to %q, speaking protocol version %d", hostPort, repl.ProtocolVersion()), nil
+}
+
+func handleRead(key string) (string, error) {
+	v, err := repl.Get(context.Background(), key)
+	if err != nil {
 		return "", err
 	}
-	serverHostPort = hostPort
+	return fmt.Sprintf("%q -> %s", v.Key, strconv.Quote(v.Value)), nil
+}
 
-	req, _ := json.Marshal(communication.ClientConnectRequest{
-		Op: communication.Connect,
-		Args: communication.ClientConnectRequestArgs{
-			ClientId: clientID,
-		},
-	})
+func handleDelete(key string) (string, error) {
+	if err := repl.Delete(context.Background(), key); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("successfully deleted %q", key), nil
+}
 
-	// establish a tcp connection
-	dialer := net.Dialer{Timeout: 3 * time.Second}
-	conn, err := dialer.Dial("tcp", serverHostPort)
+func handleReadAt(key, timestamp string) (string, error) {
+	ts, err := strconv.ParseUint(timestamp, 10, 64)
 	if err != nil {
+		return "", fmt.Errorf("bad timestamp %q: %w", timestamp, err)
+	}
+
+	req := communication.ClientReadAtRequest{
+		Op: communication.ReadAt,
+		Args: communication.ClientReadAtRequestArgs{
+			ClientId:               repl.clientId,
+			SessionToken:           repl.token(),
+			Key:                    key,
+			LamportsClockTimestamp: ts,
+		},
+	}
+
+	var resp communication.ClientReadAtResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
 		return "", err
 	}
-	defer func() {
-		_ = conn.Close()
-	}()
-	if _, err := conn.Write(req); err != nil {
+	switch resp.Result {
+	case communication.Success:
+		return fmt.Sprintf("%q -> %s (written by %q at %d)",
+			resp.Key, displayValue(resp.Version.Value, resp.Version.ValueEncoding), resp.Version.OriginalServer, resp.Version.LamportsClockTimestamp), nil
+	case communication.Fail:
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return "", fmt.Errorf("unknown operation result from server")
+	}
+}
+
+func handleHistory(key string) (string, error) {
+	req := communication.ClientHistoryRequest{
+		Op: communication.History,
+		Args: communication.ClientHistoryRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Key:          key,
+		},
+	}
+
+	var resp communication.ClientHistoryResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
 		return "", err
 	}
+	switch resp.Result {
+	case communication.Success:
+		lines := make([]string, 0, len(resp.Versions))
+		for _, v := range resp.Versions {
+			value := displayValue(v.Value, v.ValueEncoding)
+			if v.Deleted {
+				value = "deleted"
+			}
+			lines = append(lines, fmt.Sprintf("\t%d\t%q\t%s", v.LamportsClockTimestamp, v.OriginalServer, value))
+		}
+		return fmt.Sprintf("history of %q:\n%s", resp.Key, strings.Join(lines, "\n")), nil
+	case communication.Fail:
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return "", fmt.Errorf("unknown operation result from server")
+	}
+}
 
-	var resp communication.ClientConnectResponse
-	d := json.NewDecoder(conn)
-	if err := d.Decode(&resp); err != nil {
+// handleScan lists a page of keys, by range if args.Prefix is empty, or else by prefix
+func handleScan(args communication.ClientScanRequestArgs) (string, error) {
+	op := communication.Scan
+	if args.Prefix != "" {
+		op = communication.Prefix
+	}
+	args.ClientId = repl.clientId
+	args.SessionToken = repl.token()
+	req := communication.ClientScanRequest{
+		Op:   op,
+		Args: args,
+	}
+
+	var resp communication.ClientScanResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
 		return "", err
 	}
 	switch resp.Result {
 	case communication.Success:
-		return fmt.Sprintf("connected to %q", serverHostPort), nil
+		lines := make([]string, 0, len(resp.Entries)+1)
+		for _, e := range resp.Entries {
+			lines = append(lines, fmt.Sprintf("%q -> %s", e.Key, displayValue(e.Value, e.ValueEncoding)))
+		}
+		if resp.NextCursor != "" {
+			lines = append(lines, fmt.Sprintf("more keys, next cursor is %q", resp.NextCursor))
+		}
+		if len(lines) == 0 {
+			return "no keys", nil
+		}
+		return strings.Join(lines, "\n"), nil
 	case communication.Fail:
-		return "", fmt.Errorf(resp.DetailedResult)
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
 	default:
 		return "", fmt.Errorf("unknown operation result from server")
 	}
 }
 
-func handleRead(key string) (string, error) {
-	req, _ := json.Marshal(communication.ClientReadRequest{
-		Op: communication.Read,
-		Args: communication.ClientReadRequestArgs{
-			ClientId: clientID,
-			Key:      key,
+func handleQuery(path, value string) (string, error) {
+	req := communication.ClientQueryRequest{
+		Op: communication.Query,
+		Args: communication.ClientQueryRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Path:         path,
+			Value:        value,
 		},
+	}
+
+	var resp communication.ClientQueryResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
+		return "", err
+	}
+	switch resp.Result {
+	case communication.Success:
+		if len(resp.Entries) == 0 {
+			return "no keys", nil
+		}
+		lines := make([]string, 0, len(resp.Entries))
+		for _, e := range resp.Entries {
+			lines = append(lines, fmt.Sprintf("%q -> %s", e.Key, displayValue(e.Value, e.ValueEncoding)))
+		}
+		return strings.Join(lines, "\n"), nil
+	case communication.Fail:
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return "", fmt.Errorf("unknown operation result from server")
+	}
+}
+
+// handleWatch starts printing the changes of a key, or of a prefix if pattern ends with prefixWildcard,
+// in the background until unwatched
+func handleWatch(pattern, from string) (string, error) {
+	if repl.ServerHostPort() == "" {
+		return "", ErrNotConnected
+	}
+	if _, ok := watches[pattern]; ok {
+		return "", fmt.Errorf("already watching %q", pattern)
+	}
+
+	args := communication.ClientWatchRequestArgs{
+		ClientId:     repl.clientId,
+		SessionToken: repl.token(),
+		Key:          strings.TrimSuffix(pattern, prefixWildcard),
+		IsPrefix:     strings.HasSuffix(pattern, prefixWildcard),
+	}
+	if from != "" {
+		ts, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("bad timestamp %q: %w", from, err)
+		}
+		args.Resume = true
+		args.FromLamportsClockTimestamp = ts
+	}
+
+	stop := make(chan struct{})
+	watches[pattern] = stop
+	go func() {
+		// seen holds the changes received at the latest timestamp, to skip them when they are replayed
+		seen := make(map[communication.ClientWatchEvent]bool)
+		for {
+			err := streamWatch(args, stop, func(event communication.ClientWatchEvent) {
+				if seen[event] {
+					return
+				}
+				if !args.Resume || event.LamportsClockTimestamp > args.FromLamportsClockTimestamp {
+					args.Resume = true
+					args.FromLamportsClockTimestamp = event.LamportsClockTimestamp
+					seen = make(map[communication.ClientWatchEvent]bool)
+				}
+				if event.LamportsClockTimestamp == args.FromLamportsClockTimestamp {
+					seen[event] = true
+				}
+				if event.Deleted {
+					genericLogger.Printf("[%s %s] %q deleted (by %q at %d)", watchCmd, pattern,
+						event.Key, event.OriginalServer, event.LamportsClockTimestamp)
+					return
+				}
+				genericLogger.Printf("[%s %s] %q -> %s (written by %q at %d)", watchCmd, pattern,
+					event.Key, displayValue(event.Value, event.ValueEncoding), event.OriginalServer, event.LamportsClockTimestamp)
+			})
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(watchReconnectInterval):
+			}
+			errorLogger.Printf("watch of %q is disconnected: %v, reconnecting", pattern, err)
+		}
+	}()
+	return fmt.Sprintf("watching %q", pattern), nil
+}
+
+// streamWatch receives the changes of a watch until disconnected or stopped
+func streamWatch(args communication.ClientWatchRequestArgs, stop chan struct{}, onEvent func(communication.ClientWatchEvent)) error {
+	req, _ := json.Marshal(communication.ClientWatchRequest{
+		Op:   communication.Watch,
+		Args: args,
 	})
 
-	dialer := net.Dialer{Timeout: 3 * time.Second}
-	conn, err := dialer.Dial("tcp", serverHostPort)
+	conn, err := repl.dial(context.Background())
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer func() {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
 		_ = conn.Close()
 	}()
 	if _, err := conn.Write(req); err != nil {
-		return "", err
+		return err
 	}
 
-	// get response from server
-	var resp communication.ClientReadResponse
 	d := json.NewDecoder(conn)
+	var resp communication.ClientWatchResponse
 	if err := d.Decode(&resp); err != nil {
-		return "", err
+		return err
 	}
-	switch resp.Result {
-	case communication.Success:
-		return fmt.Sprintf("%q -> %q", resp.Key, resp.Value), nil
-	case communication.Fail:
-		return "", fmt.Errorf(resp.DetailedResult)
-	default:
-		return "", fmt.Errorf("unknown operation result from server")
+	if resp.Result != communication.Success {
+		return communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	}
+	for {
+		var event communication.ClientWatchEvent
+		if err := d.Decode(&event); err != nil {
+			return err
+		}
+		onEvent(event)
 	}
 }
 
-func handleWrite(key, value string) (string, error) {
-	return write(key, value, "", 0)
+func handleUnwatch(pattern string) (string, error) {
+	stop, ok := watches[pattern]
+	if !ok {
+		return "", fmt.Errorf("not watching %q", pattern)
+	}
+	close(stop)
+	delete(watches, pattern)
+	return fmt.Sprintf("stopped watching %q", pattern), nil
+}
+
+func handleWrite(key, value, ttl string) (string, error) {
+	ttlInSeconds, err := parseTimeToLive(ttl)
+	if err != nil {
+		return "", err
+	}
+	return write(key, value, "", 0, ttlInSeconds)
 }
 
 // writeWithServerReplicatedWriteDelay simulates network delay of ServerReplicatedWrite
 // it is for testing purpose to show causal consistency of the system
-func writeWithServerReplicatedWriteDelay(key, value, delayHostPort, delay string) (string, error) {
+func writeWithServerReplicatedWriteDelay(key, value, delayHostPort, delay, ttl string) (string, error) {
 	if err := util.ValidateHostPort(delayHostPort); err != nil {
 		return "", err
 	}
@@ -184,45 +525,280 @@ func writeWithServerReplicatedWriteDelay(key, value, delayHostPort, delay string
 	if err != nil || delayInSeconds < 0 {
 		return "", err
 	}
-	return write(key, value, delayHostPort, delayInSeconds)
+	ttlInSeconds, err := parseTimeToLive(ttl)
+	if err != nil {
+		return "", err
+	}
+	return write(key, value, delayHostPort, delayInSeconds, ttlInSeconds)
 }
 
-func write(key, value, delayHostPort string, delayInSeconds int64) (string, error) {
-	req, _ := json.Marshal(communication.ClientWriteRequest{
-		Op: communication.Write,
-		Args: communication.ClientWriteRequestArgs{
-			ClientId:                      clientID,
-			Key:                           key,
-			Value:                         value,
-			ReplicatedWriteDelayInSeconds: delayInSeconds,
-			ReplicatedWriteDelayServer:    delayHostPort,
+func parseTimeToLive(ttl string) (int64, error) {
+	ttlInSeconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad time to live %q: %w", ttl, err)
+	}
+	if ttlInSeconds < 0 {
+		return 0, fmt.Errorf("bad time to live %q: must not be negative", ttl)
+	}
+	return ttlInSeconds, nil
+}
+
+func write(key, value, delayHostPort string, delayInSeconds, ttlInSeconds int64) (string, error) {
+	n, err := repl.put(context.Background(), communication.ClientWriteRequestArgs{
+		Key:                           key,
+		TimeToLiveInSeconds:           ttlInSeconds,
+		ReplicatedWriteDelayInSeconds: delayInSeconds,
+		ReplicatedWriteDelayServer:    delayHostPort,
+	}, value)
+	if err != nil {
+		return "", err
+	}
+	if n > 1 {
+		return fmt.Sprintf("successfully written %q -> %d bytes in %d chunks", key, len(value), n), nil
+	}
+	return fmt.Sprintf("successfully written %q -> %s", key, strconv.Quote(value)), nil
+}
+
+// handleWriteFile writes the content of a file as the value of a key
+func handleWriteFile(key, path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return write(key, string(content), "", 0, 0)
+}
+
+func handleChunkSize(size string) (string, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("bad chunk size %q: must be a positive number of bytes", size)
+	}
+	repl.setChunkSize(n)
+	return fmt.Sprintf("values larger than %d bytes are now written in chunks", n), nil
+}
+
+func handleMultiRead(keys []string) (string, error) {
+	if err := repl.requireFeature(communication.FeatureBatching); err != nil {
+		return "", err
+	}
+	req := communication.ClientMultiReadRequest{
+		Op: communication.MultiRead,
+		Args: communication.ClientMultiReadRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Keys:         keys,
 		},
+	}
+	return multi(req, func(r communication.KeyResult) string {
+		return fmt.Sprintf("%q -> %s", r.Key, displayValue(r.Value, r.ValueEncoding))
 	})
+}
 
-	dialer := net.Dialer{Timeout: 3 * time.Second}
-	conn, err := dialer.Dial("tcp", serverHostPort)
+// handleMultiWrite writes keysAndValues, which alternate keys and values
+func handleMultiWrite(keysAndValues []string) (string, error) {
+	if err := repl.requireFeature(communication.FeatureBatching); err != nil {
+		return "", err
+	}
+	entries := make([]communication.KeyValue, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		value, encoding := communication.EncodeValue(keysAndValues[i+1])
+		entries = append(entries, communication.KeyValue{Key: keysAndValues[i], Value: value, ValueEncoding: encoding})
+	}
+
+	req := communication.ClientMultiWriteRequest{
+		Op: communication.MultiWrite,
+		Args: communication.ClientMultiWriteRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Entries:      entries,
+		},
+	}
+	return multi(req, func(r communication.KeyResult) string {
+		return fmt.Sprintf("successfully written %q -> %s", r.Key, displayValue(r.Value, r.ValueEncoding))
+	})
+}
+
+// multi sends a MultiRead or MultiWrite request and formats a line per key
+func multi(req interface{}, formatSuccess func(communication.KeyResult) string) (string, error) {
+	var resp communication.ClientMultiResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
+		return "", err
+	}
+	switch resp.Result {
+	case communication.Success:
+		lines := make([]string, 0, len(resp.Results))
+		for _, r := range resp.Results {
+			if r.Result == communication.Success {
+				lines = append(lines, formatSuccess(r))
+			} else {
+				lines = append(lines, fmt.Sprintf("%q failed: %s", r.Key, formatError(communication.ErrorOf(r.ErrorCode, r.DetailedResult))))
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	case communication.Fail:
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return "", fmt.Errorf("unknown operation result from server")
+	}
+}
+
+func handleCompareAndSet(key, value, expectedHostPort, expectedTimestamp string) (string, error) {
+	ts, err := strconv.ParseUint(expectedTimestamp, 10, 64)
 	if err != nil {
+		return "", fmt.Errorf("bad timestamp %q: %w", expectedTimestamp, err)
+	}
+
+	value, encoding := communication.EncodeValue(value)
+	req := communication.ClientCompareAndSetRequest{
+		Op: communication.CompareAndSet,
+		Args: communication.ClientCompareAndSetRequestArgs{
+			ClientId:                       repl.clientId,
+			SessionToken:                   repl.token(),
+			Key:                            key,
+			Value:                          value,
+			ValueEncoding:                  encoding,
+			ExpectedOriginalServer:         expectedHostPort,
+			ExpectedLamportsClockTimestamp: ts,
+		},
+	}
+	return conditionalWrite(req)
+}
+
+func handleSetIfAbsent(key, value string) (string, error) {
+	value, encoding := communication.EncodeValue(value)
+	req := communication.ClientSetIfAbsentRequest{
+		Op: communication.SetIfAbsent,
+		Args: communication.ClientSetIfAbsentRequestArgs{
+			ClientId:      repl.clientId,
+			SessionToken:  repl.token(),
+			Key:           key,
+			Value:         value,
+			ValueEncoding: encoding,
+		},
+	}
+	return conditionalWrite(req)
+}
+
+func conditionalWrite(req interface{}) (string, error) {
+	var resp communication.ClientConditionalWriteResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
 		return "", err
 	}
-	defer func() {
-		_ = conn.Close()
-	}()
-	if _, err := conn.Write(req); err != nil {
+	switch resp.Result {
+	case communication.Success:
+		return fmt.Sprintf("successfully written %q -> %s", resp.Key, displayValue(resp.Value, resp.ValueEncoding)), nil
+	case communication.Fail:
+		if resp.CurrentVersion != nil {
+			return "", fmt.Errorf("condition not met, current version is %q -> %s (written by %q at %d)",
+				resp.Key, displayValue(resp.CurrentVersion.Value, resp.CurrentVersion.ValueEncoding), resp.CurrentVersion.OriginalServer, resp.CurrentVersion.LamportsClockTimestamp)
+		}
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return "", fmt.Errorf("unknown operation result from server")
+	}
+}
+
+func handleIncrement(key, delta string) (string, error) {
+	d, err := strconv.ParseInt(delta, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad delta %q: %w", delta, err)
+	}
+
+	req := communication.ClientIncrementRequest{
+		Op: communication.Increment,
+		Args: communication.ClientIncrementRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Key:          key,
+			Delta:        d,
+		},
+	}
+	return updateCrdt(req)
+}
+
+func handleSetElement(op, key, element string) (string, error) {
+	req := communication.ClientSetElementRequest{
+		Op: op,
+		Args: communication.ClientSetElementRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Key:          key,
+			Element:      element,
+		},
+	}
+	return updateCrdt(req)
+}
+
+func handleRegisterSet(key, value string) (string, error) {
+	req := communication.ClientRegisterSetRequest{
+		Op: communication.RegisterSet,
+		Args: communication.ClientRegisterSetRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Key:          key,
+			Value:        value,
+		},
+	}
+	return updateCrdt(req)
+}
+
+func updateCrdt(req interface{}) (string, error) {
+	var resp communication.ClientCrdtResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
 		return "", err
 	}
+	switch resp.Result {
+	case communication.Success:
+		return fmt.Sprintf("%q is now %s", resp.Key, resp.Value), nil
+	case communication.Fail:
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
+	default:
+		return "", fmt.Errorf("unknown operation result from server")
+	}
+}
 
-	// get response from server
-	var resp communication.ClientWriteResponse
-	d := json.NewDecoder(conn)
-	if err := d.Decode(&resp); err != nil {
+func handleSetMembers(key string) (string, error) {
+	req := communication.ClientSetMembersRequest{
+		Op: communication.SetMembers,
+		Args: communication.ClientSetMembersRequestArgs{
+			ClientId:     repl.clientId,
+			SessionToken: repl.token(),
+			Key:          key,
+		},
+	}
+
+	var resp communication.ClientSetMembersResponse
+	if err := repl.call(context.Background(), req, &resp); err != nil {
 		return "", err
 	}
 	switch resp.Result {
 	case communication.Success:
-		return fmt.Sprintf("successfully written %q -> %q", resp.Key, resp.Value), nil
+		members := make([]string, 0, len(resp.Members))
+		for _, m := range resp.Members {
+			members = append(members, strconv.Quote(m))
+		}
+		return fmt.Sprintf("%q -> {%s}", resp.Key, strings.Join(members, ", ")), nil
 	case communication.Fail:
-		return "", fmt.Errorf(resp.DetailedResult)
+		return "", communication.ErrorOf(resp.ErrorCode, resp.DetailedResult)
 	default:
 		return "", fmt.Errorf("unknown operation result from server")
 	}
 }
+
+// displayValue decodes a value received from the server and quotes it for display
+func displayValue(value, encoding string) string {
+	decoded, err := communication.DecodeValue(value, encoding)
+	if err != nil {
+		return fmt.Sprintf("%q (%v)", value, err)
+	}
+	return strconv.Quote(decoded)
+}
+
+// formatError shows an error, with its code if it is the failure of a request
+func formatError(err error) string {
+	var e *communication.Error
+	if errors.As(err, &e) {
+		return fmt.Sprintf("%v (%s)", err, e.Code)
+	}
+	return err.Error()
+}
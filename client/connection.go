@@ -0,0 +1,274 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"Lab2/communication"
+)
+
+// features are the optional parts of the protocol this client supports
+var features = []string{
+	communication.FeatureFraming,
+	communication.FeatureBatching,
+	communication.FeatureChunking,
+	communication.FeatureVersionVectors,
+	communication.FeatureGob,
+	communication.FeatureFlate,
+}
+
+// dialTimeout bounds the time taken to open a connection to the server, unless the context of the request
+// has an earlier deadline
+const dialTimeout = 3 * time.Second
+
+// dial opens a connection to the server, over TLS if it is enabled
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	c.lock.Lock()
+	hostPort, config := c.serverHostPort, c.tlsConfig
+	c.lock.Unlock()
+	if hostPort == "" {
+		return nil, ErrNotConnected
+	}
+	return communication.Dial(hostPort, timeoutOf(ctx), config)
+}
+
+// dialFramed opens the persistent connection to the server, agreeing on the protocol version and the features.
+// The caller must hold the lock of c
+func (c *Client) dialFramed(ctx context.Context) (*communication.FramedConnection, error) {
+	conn, err := communication.DialFramed(c.serverHostPort, makeHelloRequest(), timeoutOf(ctx), c.tlsConfig, &c.compression)
+	if err != nil {
+		return nil, err
+	}
+	c.setServerFeatures(conn.Hello)
+	return conn, nil
+}
+
+// timeoutOf returns the time left before the deadline of ctx, or dialTimeout if it is later or there is none
+func timeoutOf(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < dialTimeout {
+			return left
+		}
+	}
+	return dialTimeout
+}
+
+// helloOneShot makes the handshake over a connection of its own.
+// A server that does not know hello speaks protocol version 1 with no optional features
+func (c *Client) helloOneShot(ctx context.Context) error {
+	var resp communication.HelloResponse
+	if err := c.callOneShot(ctx, makeHelloRequest(), &resp); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case resp.Result == communication.Success:
+		c.setServerFeatures(resp)
+	case resp.ProtocolVersion == 0:
+		c.serverProtocolVersion = 1
+		c.serverFeatures = make(map[string]bool)
+	default:
+		return communication.ErrorOf(resp.ErrorCode, fmt.Sprintf("server is incompatible: %s", resp.DetailedResult))
+	}
+	return nil
+}
+
+func makeHelloRequest() communication.HelloRequest {
+	return communication.HelloRequest{
+		Op: communication.Hello,
+		Args: communication.HelloRequestArgs{
+			ProtocolVersion:    communication.ProtocolVersion,
+			MinProtocolVersion: communication.MinProtocolVersion,
+			Features:           features,
+		},
+	}
+}
+
+// setServerFeatures records what the handshake agreed on. The caller must hold the lock of c
+func (c *Client) setServerFeatures(resp communication.HelloResponse) {
+	c.serverProtocolVersion = resp.ProtocolVersion
+	c.serverFeatures = make(map[string]bool)
+	for _, f := range resp.Features {
+		c.serverFeatures[f] = true
+	}
+}
+
+// handshake agrees on the protocol version and the features with the server
+func (c *Client) handshake(ctx context.Context) error {
+	c.lock.Lock()
+	persistent := c.persistent
+	c.lock.Unlock()
+	if !persistent {
+		return c.helloOneShot(ctx)
+	}
+	_, err := c.persistentConnection(ctx)
+	return err
+}
+
+// forgetServer drops the server the client failed to connect to, or disconnected from
+func (c *Client) forgetServer() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.serverHostPort = ""
+	c.sessionToken = ""
+	c.closeConnection()
+}
+
+// closeConnection closes the persistent connection, which is redialed on the next request.
+// The caller must hold the lock of c
+func (c *Client) closeConnection() {
+	if c.serverConn != nil {
+		c.serverConn.Close()
+		c.serverConn = nil
+	}
+}
+
+// requireFeature fails if the server does not support a feature
+func (c *Client) requireFeature(feature string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.serverFeatures[feature] {
+		return communication.Errorf(communication.Unsupported, "server %q does not support %s", c.serverHostPort, feature)
+	}
+	return nil
+}
+
+// call sends a request to the server and decodes its response into resp
+func (c *Client) call(ctx context.Context, req interface{}, resp interface{}) error {
+	return c.pipeline(ctx, []interface{}{req}, []interface{}{resp})
+}
+
+// pipeline sends many requests before reading their responses, which come in the same order,
+// and decodes the responses into resps.
+// Without a persistent connection, the requests are sent one after another
+func (c *Client) pipeline(ctx context.Context, reqs []interface{}, resps []interface{}) error {
+	c.lock.Lock()
+	persistent := c.persistent
+	c.lock.Unlock()
+	if !persistent {
+		for i, req := range reqs {
+			if err := c.callOneShot(ctx, req, resps[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	conn, err := c.persistentConnection(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Pipeline(ctx, reqs, resps)
+}
+
+// persistentConnection returns the persistent connection to the server, redialing it if it is broken
+func (c *Client) persistentConnection(ctx context.Context) (*communication.FramedConnection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.serverHostPort == "" {
+		return nil, ErrNotConnected
+	}
+	if c.serverConn != nil && !c.serverConn.Broken() {
+		return c.serverConn, nil
+	}
+	conn, err := c.dialFramed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.serverConn = conn
+	return conn, nil
+}
+
+// callOneShot sends a request over a connection of its own, whose close delimits the response
+func (c *Client) callOneShot(ctx context.Context, req interface{}, resp interface{}) error {
+	r, _ := json.Marshal(req)
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// closing the connection interrupts the request when ctx is done
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+	if _, err := conn.Write(r); err != nil {
+		return contextError(ctx, err)
+	}
+
+	// get response from server
+	d := json.NewDecoder(conn)
+	return contextError(ctx, d.Decode(resp))
+}
+
+// contextError returns the error of ctx if it is done, since it is why a request failed, or else err
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// setTLSConfig enables TLS for the connections to the server, or disables it if config is nil
+func (c *Client) setTLSConfig(config *tls.Config) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.tlsConfig = config
+	c.closeConnection()
+}
+
+// setPersistent switches between a persistent framed connection and a connection per request
+func (c *Client) setPersistent(persistent bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.persistent = persistent
+	if !persistent {
+		c.closeConnection()
+	}
+}
+
+// handleTLS enables TLS for the connections to the server, verified with the CA, optionally presenting
+// a certificate of this client
+func handleTLS(caFile, certFile, keyFile string) (string, error) {
+	config, err := communication.LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return "", err
+	}
+	repl.setTLSConfig(config)
+	return "TLS enabled", nil
+}
+
+// handleConnectionMode switches between a persistent framed connection and a connection per request
+func handleConnectionMode(mode string) (string, error) {
+	switch mode {
+	case persistentMode:
+		repl.setPersistent(true)
+		if repl.ServerHostPort() != "" {
+			if err := repl.handshake(context.Background()); err != nil {
+				repl.setPersistent(false)
+				return "", err
+			}
+		}
+	case oneShotMode:
+		repl.setPersistent(false)
+	default:
+		return "", fmt.Errorf("unknown connection mode %q, must be %q or %q", mode, persistentMode, oneShotMode)
+	}
+	return fmt.Sprintf("requests are now sent in %s mode", mode), nil
+}
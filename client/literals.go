@@ -8,13 +8,44 @@ import (
 )
 
 const (
-	connectCmd = "connect"
-	readCmd    = "read"
-	writeCmd   = "write"
-	hCmd       = "h"
-	helpCmd    = "help"
-	qCmd       = "q"
-	quitCmd    = "quit"
+	connectCmd    = "connect"
+	connectionCmd = "connection"
+	tlsCmd        = "tls"
+	readCmd       = "read"
+	deleteCmd     = "delete"
+	writeCmd      = "write"
+	writeFileCmd  = "write-file"
+	chunkSizeCmd  = "chunk-size"
+	statsCmd      = "stats"
+	mgetCmd       = "mget"
+	msetCmd       = "mset"
+	historyCmd    = "history"
+	scanCmd       = "scan"
+	prefixCmd     = "prefix"
+	queryCmd      = "query"
+	watchCmd      = "watch"
+	unwatchCmd    = "unwatch"
+	casCmd        = "cas"
+	setnxCmd      = "setnx"
+	incrCmd       = "incr"
+	saddCmd       = "sadd"
+	sremCmd       = "srem"
+	smembersCmd   = "smembers"
+	mvsetCmd      = "mvset"
+	hCmd          = "h"
+	helpCmd       = "help"
+	qCmd          = "q"
+	quitCmd       = "quit"
+
+	persistentMode = "persistent"
+	oneShotMode    = "oneshot"
+
+	atKeyword   = "at"
+	ttlKeyword  = "ttl"
+	fromKeyword = "from"
+
+	// prefixWildcard ends a watched key to watch a prefix
+	prefixWildcard = "*"
 
 	badArguments        = "bad arguments"
 	goodbye             = "goodbye"
@@ -22,9 +53,32 @@ const (
 )
 
 var helpMessage = strings.Join([]string{
-	fmt.Sprintf("\t%s [ip:port of server]", connectCmd),
+	"\tkeys and values containing spaces or escapes may be double quoted, e.g. \"a value\\n\"",
+	fmt.Sprintf("\t%s [ip:port of server] [user (optional)] [password (optional)]", connectCmd),
+	fmt.Sprintf("\t%s [CA certificate file] [certificate file (optional)] [key file (optional)]", tlsCmd),
+	fmt.Sprintf("\t%s [%q to send all requests over one connection, or %q to send each over a connection of its own, %q by default]", connectionCmd, persistentMode, oneShotMode, persistentMode),
 	fmt.Sprintf("\t%s [key]", readCmd),
-	fmt.Sprintf("\t%s [key] [value] [delay replicated write ip:port of server (optional)] [delay in seconds (optional)]", writeCmd),
+	fmt.Sprintf("\t%s [key] %s [lamport's clock timestamp]", readCmd, atKeyword),
+	fmt.Sprintf("\t%s [key]", deleteCmd),
+	fmt.Sprintf("\t%s [key]", historyCmd),
+	fmt.Sprintf("\t%s [start key] [end key, exclusive] [cursor (optional)]", scanCmd),
+	fmt.Sprintf("\t%s [key prefix] [cursor (optional)]", prefixCmd),
+	fmt.Sprintf("\t%s [indexed json path] [field value]", queryCmd),
+	fmt.Sprintf("\t%s [key, or key prefix ending with %q] [%s [lamport's clock timestamp to resume from] (optional)]", watchCmd, prefixWildcard, fromKeyword),
+	fmt.Sprintf("\t%s [key, or key prefix ending with %q]", unwatchCmd, prefixWildcard),
+	fmt.Sprintf("\t%s [key] [value] [%s [time to live in seconds] (optional)] [delay replicated write ip:port of server (optional)] [delay in seconds (optional)]", writeCmd, ttlKeyword),
+	fmt.Sprintf("\t%s [key] [path of file holding the value]", writeFileCmd),
+	fmt.Sprintf("\t%s [size in bytes above which values are written in chunks, %d by default]", chunkSizeCmd, 64<<10),
+	fmt.Sprintf("\t%s [key] [more keys (optional, separate by space)]", mgetCmd),
+	fmt.Sprintf("\t%s [key] [value] [more keys and values (optional, separate by space)]", msetCmd),
+	fmt.Sprintf("\t%s [key] [value] [expected original server ip:port] [expected lamport's clock timestamp]", casCmd),
+	fmt.Sprintf("\t%s [key] [value]", setnxCmd),
+	fmt.Sprintf("\t%s [key] [delta, may be negative (optional, 1 by default)]", incrCmd),
+	fmt.Sprintf("\t%s [key] [element]", saddCmd),
+	fmt.Sprintf("\t%s [key] [element]", sremCmd),
+	fmt.Sprintf("\t%s [key]", smembersCmd),
+	fmt.Sprintf("\t%s [key] [value]", mvsetCmd),
+	fmt.Sprintf("\t%s", statsCmd),
 	fmt.Sprintf("\t%s, %s", helpCmd, hCmd),
 	fmt.Sprintf("\t%s, %s", quitCmd, qCmd),
 }, "\n")
@@ -0,0 +1,68 @@
+package communication
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// FeatureGob is the binary encoding of the messages of a framed connection with encoding/gob, which is more compact
+// and faster than json for messages with many fields, such as replicated writes with long dependency lists.
+// The hello starting a framed connection is always in json
+const FeatureGob = "gob"
+
+// Codec encodes and decodes the messages of a connection
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JsonCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+)
+
+// CodecOf returns the codec of a connection given the features agreed on in its handshake.
+// The messages it compresses are counted in metrics, unless it is nil
+func CodecOf(features []string, metrics *CompressionMetrics) Codec {
+	codec, compress := JsonCodec, false
+	for _, f := range features {
+		switch f {
+		case FeatureGob:
+			codec = GobCodec
+		case FeatureFlate:
+			compress = true
+		}
+	}
+	if compress {
+		return compressingCodec{codec: codec, metrics: metrics}
+	}
+	return codec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// gobCodec encodes every message as a gob stream of its own, carrying its type, so that messages can be decoded
+// independently and in any order. A message may be decoded into any struct with some of its fields, such as one
+// holding its Op only
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
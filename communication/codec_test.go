@@ -0,0 +1,79 @@
+package communication
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// replicatedWriteWithDependencies makes a replicated write depending on n keys, as written by a client
+// that read and wrote many keys before
+func replicatedWriteWithDependencies(n int) ServerReplicatedWriteRequest {
+	dependencies := make([]DependencyData, n)
+	for i := range dependencies {
+		dependencies[i] = DependencyData{Key: fmt.Sprintf("user:%d:profile", i), LamportsClockTimestamp: uint64(i + 1)}
+	}
+	return ServerReplicatedWriteRequest{
+		Op: ReplicatedWrite,
+		Args: ServerReplicatedWriteRequestArgs{
+			Key:            "user:0:profile",
+			Value:          `{"name":"alice","age":30}`,
+			OriginalServer: "127.0.0.1:8000",
+			Clock:          uint64(n + 1),
+			Dependencies:   dependencies,
+		},
+	}
+}
+
+func TestCodecsRoundTripReplicatedWrite(t *testing.T) {
+	req := replicatedWriteWithDependencies(100)
+	for name, codec := range map[string]Codec{"json": JsonCodec, "gob": GobCodec} {
+		data, err := codec.Marshal(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var decoded ServerReplicatedWriteRequest
+		if err := codec.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(decoded, req) {
+			t.Errorf("%s: decoded %+v, want %+v", name, decoded, req)
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec Codec) {
+	req := replicatedWriteWithDependencies(1000)
+	data, err := codec.Marshal(req)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := codec.Marshal(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			var decoded ServerReplicatedWriteRequest
+			if err := codec.Unmarshal(data, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkJsonCodec(b *testing.B) {
+	benchmarkCodec(b, JsonCodec)
+}
+
+func BenchmarkGobCodec(b *testing.B) {
+	benchmarkCodec(b, GobCodec)
+}
@@ -0,0 +1,161 @@
+package communication
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// FeatureFlate is the compression with deflate of the large messages of a framed connection, such as replicated
+// writes and client writes of large values. Every message after the hello then starts with a byte telling if
+// the rest of it is compressed
+const FeatureFlate = "flate"
+
+const (
+	// CompressionThreshold is the size from which a message is compressed, smaller ones are not worth it
+	CompressionThreshold = 1 << 10
+
+	uncompressed byte = 0
+	compressed   byte = 1
+)
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressingCodec compresses the messages encoded by another codec, counting them in metrics if it is not nil
+type compressingCodec struct {
+	codec   Codec
+	metrics *CompressionMetrics
+}
+
+func (c compressingCodec) Marshal(v interface{}) ([]byte, error) {
+	m, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(m) < CompressionThreshold {
+		return append([]byte{uncompressed}, m...), nil
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(compressed)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&b)
+	if _, err := w.Write(m); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if b.Len() > len(m) {
+		// incompressible, such as an already compressed value
+		return append([]byte{uncompressed}, m...), nil
+	}
+	c.metrics.recordSent(len(m), b.Len()-1)
+	return b.Bytes(), nil
+}
+
+func (c compressingCodec) Unmarshal(data []byte, v interface{}) error {
+	m, err := c.decompress(data, MaxFrameSize)
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(m, v)
+}
+
+// decompress returns the message carried by data, failing with a TooLarge error if it is larger than maxSize
+// once decompressed
+func (c compressingCodec) decompress(data []byte, maxSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+	switch data[0] {
+	case uncompressed:
+		return data[1:], nil
+	case compressed:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer func() {
+			_ = r.Close()
+		}()
+		m, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+		if err != nil {
+			return nil, fmt.Errorf("bad compressed message: %w", err)
+		}
+		if len(m) > maxSize {
+			return nil, Errorf(TooLarge, "decompressed message is larger than the maximum of %d bytes", maxSize)
+		}
+		c.metrics.recordReceived(len(m), len(data)-1)
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown message compression %d", data[0])
+	}
+}
+
+// NewDecoder returns a function decoding a message of a codec into any number of values, such as a generic request
+// then the request of its op. A compressed message is decompressed once, and fails to decode with a TooLarge error
+// if it is larger than maxSize once decompressed
+func NewDecoder(codec Codec, message []byte, maxSize int) func(v interface{}) error {
+	c, ok := codec.(compressingCodec)
+	if !ok {
+		return func(v interface{}) error {
+			return codec.Unmarshal(message, v)
+		}
+	}
+	m, err := c.decompress(message, maxSize)
+	return func(v interface{}) error {
+		if err != nil {
+			return err
+		}
+		return c.codec.Unmarshal(m, v)
+	}
+}
+
+// CompressionMetrics count the compressed messages of the connections sharing them, such as those of a server
+// or of a client, and their sizes before and after compression. The zero value is ready to use
+type CompressionMetrics struct {
+	sentMessages, sentBytes, sentCompressedBytes             uint64
+	receivedMessages, receivedBytes, receivedCompressedBytes uint64
+}
+
+func (m *CompressionMetrics) recordSent(size, compressedSize int) {
+	if m != nil {
+		record(&m.sentMessages, &m.sentBytes, &m.sentCompressedBytes, size, compressedSize)
+	}
+}
+
+func (m *CompressionMetrics) recordReceived(size, compressedSize int) {
+	if m != nil {
+		record(&m.receivedMessages, &m.receivedBytes, &m.receivedCompressedBytes, size, compressedSize)
+	}
+}
+
+func record(messages, bytes, compressedBytes *uint64, size, compressedSize int) {
+	atomic.AddUint64(messages, 1)
+	atomic.AddUint64(bytes, uint64(size))
+	atomic.AddUint64(compressedBytes, uint64(compressedSize))
+}
+
+// Report tells how many messages were compressed and the compression ratio, for both directions
+func (m *CompressionMetrics) Report() string {
+	return fmt.Sprintf("sent %s\nreceived %s",
+		formatCompression(&m.sentMessages, &m.sentBytes, &m.sentCompressedBytes),
+		formatCompression(&m.receivedMessages, &m.receivedBytes, &m.receivedCompressedBytes))
+}
+
+func formatCompression(messages, bytes, compressedBytes *uint64) string {
+	n, b, c := atomic.LoadUint64(messages), atomic.LoadUint64(bytes), atomic.LoadUint64(compressedBytes)
+	ratio := 1.0
+	if c > 0 {
+		ratio = float64(b) / float64(c)
+	}
+	return fmt.Sprintf("%d compressed messages: %d bytes compressed to %d bytes, ratio %.2f", n, b, c, ratio)
+}
@@ -0,0 +1,70 @@
+package communication
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressionIsCountedInTheMetricsOfItsConnection(t *testing.T) {
+	var senderMetrics, receiverMetrics CompressionMetrics
+	sender := CodecOf([]string{FeatureFlate}, &senderMetrics)
+	receiver := CodecOf([]string{FeatureFlate}, &receiverMetrics)
+
+	req := replicatedWriteWithDependencies(100)
+	data, err := sender.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ServerReplicatedWriteRequest
+	if err := receiver.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, req) {
+		t.Errorf("decoded %+v, want %+v", decoded, req)
+	}
+
+	if report := senderMetrics.Report(); !strings.HasPrefix(report, "sent 1 compressed messages") ||
+		!strings.Contains(report, "received 0 compressed messages") {
+		t.Errorf("metrics of the sender:\n%s", report)
+	}
+	if report := receiverMetrics.Report(); !strings.HasPrefix(report, "sent 0 compressed messages") ||
+		!strings.Contains(report, "received 1 compressed messages") {
+		t.Errorf("metrics of the receiver:\n%s", report)
+	}
+}
+
+func TestDecoderDecompressesOnceWithinItsLimit(t *testing.T) {
+	var metrics CompressionMetrics
+	codec := CodecOf([]string{FeatureFlate}, &metrics)
+	req := replicatedWriteWithDependencies(100)
+	data, err := codec.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decode := NewDecoder(codec, data, MaxFrameSize)
+	var generic struct{ Op string }
+	var decoded ServerReplicatedWriteRequest
+	if err := decode(&generic); err != nil {
+		t.Fatal(err)
+	}
+	if err := decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if generic.Op != req.Op || !reflect.DeepEqual(decoded, req) {
+		t.Errorf("decoded %+v and %+v, want %+v", generic, decoded, req)
+	}
+	if report := metrics.Report(); !strings.Contains(report, "received 1 compressed messages") {
+		t.Errorf("a message decoded twice was not decompressed once:\n%s", report)
+	}
+
+	// the frame fits within a limit the decompressed message exceeds
+	if len(data) >= 1024 {
+		t.Fatalf("the message compressed to %d bytes", len(data))
+	}
+	if err := NewDecoder(codec, data, 1024)(&decoded); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v decoding a message larger than the limit once decompressed, want a too large error", err)
+	}
+}
@@ -1,11 +1,69 @@
 package communication
 
 const (
+	// Hello negotiates the protocol version and features between a client and a server, or two servers.
+	// It must be the first request of a framed connection
+	Hello = "hello"
+
 	Connect = "connect"
 	Read    = "read"
 	Write   = "write"
+	ReadAt  = "read_at"
+	History = "history"
+
+	// Delete writes a tombstone version of a key, which is replicated like any write, so that the key reads as absent
+	// while its version remains a dependency that writes depending on it can be committed after
+	Delete = "delete"
+
+	// WriteChunk uploads a large value in many requests
+	WriteChunk = "write_chunk"
+
+	// MultiRead and MultiWrite read or write many keys in a single request, with a result per key
+	MultiRead  = "multi_read"
+	MultiWrite = "multi_write"
+
+	// Scan and Prefix list keys in lexicographical order, a page at a time
+	Scan   = "scan"
+	Prefix = "prefix"
+
+	// Query looks up keys by the field at a json path inside their values, which the server must index
+	Query = "query"
+
+	// Watch keeps the connection open and streams a ClientWatchEvent for every change committed to the watched
+	// key or prefix, in causal order
+	Watch = "watch"
+
+	// ChangeFeed keeps the connection open and streams, as newline-delimited json, a ChangeRecord for every write
+	// committed at the server in commit order. CommitChangeFeedOffset records how far a consumer has processed
+	// the feed, so that it can resume from there
+	ChangeFeed             = "change_feed"
+	CommitChangeFeedOffset = "commit_change_feed_offset"
+
+	// CompareAndSet and SetIfAbsent are conditional writes. Their condition is checked against the replica of the
+	// server handling the request only, so they are not linearizable: two clients connected to different servers
+	// may both succeed on the same expected version, and the replicas then converge to the write with the newest
+	// version, ordered by lamport's clock timestamp then by original server, whatever the order the writes arrive in.
+	// A successful conditional write causally follows the version it was checked against.
+	CompareAndSet = "compare_and_set"
+	SetIfAbsent   = "set_if_absent"
 
 	ReplicatedWrite = "replicated_write"
+	// ReplicatedWriteBatch carries the replicated writes a server has for another one in a single message
+	ReplicatedWriteBatch = "replicated_write_batch"
+
+	// Increment, SetAdd, SetRemove, SetMembers and RegisterSet operate on CRDT values, whose replicas converge
+	// regardless of the order replicated writes arrive in
+	Increment   = "increment"
+	SetAdd      = "set_add"
+	SetRemove   = "set_remove"
+	SetMembers  = "set_members"
+	RegisterSet = "register_set"
+
+	// RaftRequestVote, RaftAppendEntries and RaftPropose are exchanged between servers by the consensus group that
+	// orders the writes of strongly consistent keys
+	RaftRequestVote   = "raft_request_vote"
+	RaftAppendEntries = "raft_append_entries"
+	RaftPropose       = "raft_propose"
 
 	Success OperationResult = "success"
 	Fail    OperationResult = "fail"
@@ -13,15 +71,66 @@ const (
 
 type OperationResult string
 
+// Base64 is the ValueEncoding of a value that is not valid utf-8, which json strings cannot hold.
+// An empty ValueEncoding means the value is carried as is
+const Base64 = "base64"
+
+type CrdtType string
+
+const (
+	PNCounter  CrdtType = "pn_counter"
+	ORSet      CrdtType = "or_set"
+	MVRegister CrdtType = "mv_register"
+)
+
+// CrdtState is the full state of a CRDT value, which is replicated and merged by other servers
+type CrdtState struct {
+	Type CrdtType
+
+	// Counter maps a server to the increments and decrements it has originated
+	Counter map[string]PNCounterEntry
+
+	// SetAdds maps an element to the unique tags of its additions not yet removed,
+	// SetRemoves holds the tags of additions observed by removals
+	SetAdds    map[string][]string
+	SetRemoves []string
+
+	// Register holds the values written concurrently
+	Register []RegisterValue
+}
+
+type PNCounterEntry struct {
+	Increments uint64
+	Decrements uint64
+}
+
+type RegisterValue struct {
+	Value string
+	// VersionVector maps a server to the timestamp of the latest write it originated that this value has seen
+	VersionVector map[string]uint64
+}
+
 type DependencyData struct {
 	Key                    string
 	OriginalServer         string
 	LamportsClockTimestamp uint64
 }
 
+// VersionData is one recorded version of a key
+type VersionData struct {
+	Value                  string
+	ValueEncoding          string
+	OriginalServer         string
+	LamportsClockTimestamp uint64
+	// Deleted tells the version is the tombstone of a delete
+	Deleted bool
+}
+
 type GenericClientResponse struct {
 	Result         OperationResult
 	DetailedResult string
+	// ErrorCode tells why the request failed when Result is Fail, the responses of all ops carry it
+	ErrorCode ErrorCode
 }
 
 type ClientConnectRequest struct {
@@ -31,12 +140,18 @@ type ClientConnectRequest struct {
 
 type ClientConnectRequestArgs struct {
 	ClientId string
+	// User and Password are required if the server authenticates clients
+	User     string
+	Password string
 }
 
 type ClientConnectResponse struct {
 	Op             string
 	Result         OperationResult
 	DetailedResult string
+	ErrorCode      ErrorCode
+	// SessionToken must be sent with every request if the server authenticates clients
+	SessionToken string
 }
 
 type ClientReadRequest struct {
@@ -45,16 +160,249 @@ type ClientReadRequest struct {
 }
 
 type ClientReadRequestArgs struct {
-	ClientId string
-	Key      string
+	ClientId     string
+	SessionToken string
+	Key          string
 }
 
 type ClientReadResponse struct {
 	Op             string
 	Result         OperationResult
 	DetailedResult string
+	ErrorCode      ErrorCode
 	Key            string
 	Value          string
+	ValueEncoding  string
+	// OriginalServer and LamportsClockTimestamp are the version of the value read
+	OriginalServer         string
+	LamportsClockTimestamp uint64
+}
+
+type ClientReadAtRequest struct {
+	Op   string
+	Args ClientReadAtRequestArgs
+}
+
+type ClientReadAtRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+
+	// LamportsClockTimestamp selects the latest version written at or before it
+	LamportsClockTimestamp uint64
+}
+
+type ClientReadAtResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Key            string
+	Version        VersionData
+}
+
+type ClientHistoryRequest struct {
+	Op   string
+	Args ClientHistoryRequestArgs
+}
+
+type ClientHistoryRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+}
+
+type ClientHistoryResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Key            string
+	// Versions are ordered from the oldest to the newest
+	Versions []VersionData
+}
+
+type ClientMultiReadRequest struct {
+	Op   string
+	Args ClientMultiReadRequestArgs
+}
+
+type ClientMultiReadRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Keys         []string
+}
+
+type ClientMultiWriteRequest struct {
+	Op   string
+	Args ClientMultiWriteRequestArgs
+}
+
+type ClientMultiWriteRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Entries      []KeyValue
+	// TimeToLiveInSeconds applies to all the entries, 0 means the keys never expire
+	TimeToLiveInSeconds int64
+}
+
+// KeyResult is the result of the operation on one key of a MultiRead or MultiWrite
+type KeyResult struct {
+	Key            string
+	Value          string
+	ValueEncoding  string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+}
+
+// ClientMultiResponse is the response of MultiRead and MultiWrite, Result is Success even if some keys failed
+type ClientMultiResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Results        []KeyResult
+}
+
+type ClientScanRequest struct {
+	Op   string
+	Args ClientScanRequestArgs
+}
+
+// ClientScanRequestArgs are the arguments of Scan, listing keys from Start (inclusive) to End (exclusive),
+// and of Prefix, listing keys starting with Prefix
+type ClientScanRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Start        string
+	End          string
+	Prefix       string
+
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor string
+	// Limit is the maximum number of keys in a page, 0 for the server's default
+	Limit int
+}
+
+type KeyValue struct {
+	Key           string
+	Value         string
+	ValueEncoding string
+}
+
+type ClientScanResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Entries        []KeyValue
+	// NextCursor is empty when there are no more keys
+	NextCursor string
+}
+
+type ClientQueryRequest struct {
+	Op   string
+	Args ClientQueryRequestArgs
+}
+
+type ClientQueryRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	// Path is a dotted json path, Value is the field at the path, as is if a string or else as json
+	Path  string
+	Value string
+}
+
+type ClientQueryResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Entries        []KeyValue
+}
+
+type ClientWatchRequest struct {
+	Op   string
+	Args ClientWatchRequestArgs
+}
+
+type ClientWatchRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	// Key is the watched key, or the watched prefix if IsPrefix is true
+	Key      string
+	IsPrefix bool
+
+	// Resume, if true, first replays the retained versions written at or after FromLamportsClockTimestamp,
+	// so that a client reconnecting does not miss changes. Changes replayed may have been seen before
+	Resume                     bool
+	FromLamportsClockTimestamp uint64
+}
+
+// ClientWatchResponse acknowledges a watch, it is followed by a stream of ClientWatchEvent if successful
+type ClientWatchResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+}
+
+type ClientWatchEvent struct {
+	Key                    string
+	Value                  string
+	ValueEncoding          string
+	OriginalServer         string
+	LamportsClockTimestamp uint64
+	// Deleted tells the change is the delete of the key
+	Deleted bool
+}
+
+type ChangeFeedRequest struct {
+	Op   string
+	Args ChangeFeedRequestArgs
+}
+
+type ChangeFeedRequestArgs struct {
+	ConsumerId   string
+	SessionToken string
+	// FromOffset is the offset of the first record to stream,
+	// it is ignored if FromCommittedOffset is true and the consumer has committed an offset
+	FromOffset          uint64
+	FromCommittedOffset bool
+}
+
+// ChangeFeedResponse acknowledges a change feed request, it is followed by a stream of ChangeRecord if successful
+type ChangeFeedResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	FromOffset     uint64
+}
+
+type ChangeRecord struct {
+	Offset                 uint64
+	Key                    string
+	Value                  string
+	ValueEncoding          string
+	OriginalServer         string
+	LamportsClockTimestamp uint64
+	Dependencies           []DependencyData
+	// Deleted tells the record is the delete of the key
+	Deleted bool
+}
+
+type CommitChangeFeedOffsetRequest struct {
+	Op   string
+	Args CommitChangeFeedOffsetRequestArgs
+}
+
+type CommitChangeFeedOffsetRequestArgs struct {
+	ConsumerId   string
+	SessionToken string
+	// Offset is the offset of the next record the consumer has to process
+	Offset uint64
 }
 
 type ClientWriteRequest struct {
@@ -63,9 +411,14 @@ type ClientWriteRequest struct {
 }
 
 type ClientWriteRequestArgs struct {
-	ClientId string
-	Key      string
-	Value    string
+	ClientId      string
+	SessionToken  string
+	Key           string
+	Value         string
+	ValueEncoding string
+
+	// TimeToLiveInSeconds makes the key expire that long after the write, 0 means the key never expires
+	TimeToLiveInSeconds int64
 
 	// ReplicatedWriteDelayServer and ReplicatedWriteDelayInSeconds are used to simulate network delay of a ServerReplicatedWrite
 	ReplicatedWriteDelayServer    string
@@ -76,20 +429,298 @@ type ClientWriteResponse struct {
 	Op             string
 	Result         OperationResult
 	DetailedResult string
+	ErrorCode      ErrorCode
 	Key            string
 	Value          string
+	ValueEncoding  string
+}
+
+type ClientDeleteRequest struct {
+	Op   string
+	Args ClientDeleteRequestArgs
+}
+
+type ClientDeleteRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+}
+
+type ClientDeleteResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Key            string
+}
+
+type ClientIncrementRequest struct {
+	Op   string
+	Args ClientIncrementRequestArgs
+}
+
+type ClientIncrementRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+	// Delta is negative to decrement
+	Delta int64
+}
+
+type ClientSetElementRequest struct {
+	Op   string
+	Args ClientSetElementRequestArgs
+}
+
+// ClientSetElementRequestArgs are the arguments of SetAdd and SetRemove
+type ClientSetElementRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+	Element      string
+}
+
+type ClientSetMembersRequest struct {
+	Op   string
+	Args ClientSetMembersRequestArgs
+}
+
+type ClientSetMembersRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+}
+
+type ClientSetMembersResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Key            string
+	Members        []string
+}
+
+type ClientRegisterSetRequest struct {
+	Op   string
+	Args ClientRegisterSetRequestArgs
+}
+
+type ClientRegisterSetRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	Key          string
+	Value        string
+}
+
+// ClientCrdtResponse is the response of an operation updating a CRDT value
+type ClientCrdtResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Key            string
+	// Value is the rendered value after the update
+	Value string
+}
+
+type ClientCompareAndSetRequest struct {
+	Op   string
+	Args ClientCompareAndSetRequestArgs
+}
+
+type ClientCompareAndSetRequestArgs struct {
+	ClientId      string
+	SessionToken  string
+	Key           string
+	Value         string
+	ValueEncoding string
+
+	// ExpectedOriginalServer and ExpectedLamportsClockTimestamp identify the version the key must currently be at
+	ExpectedOriginalServer         string
+	ExpectedLamportsClockTimestamp uint64
+}
+
+type ClientSetIfAbsentRequest struct {
+	Op   string
+	Args ClientSetIfAbsentRequestArgs
+}
+
+type ClientSetIfAbsentRequestArgs struct {
+	ClientId      string
+	SessionToken  string
+	Key           string
+	Value         string
+	ValueEncoding string
+}
+
+type ClientConditionalWriteResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	Key            string
+	Value          string
+	ValueEncoding  string
+	// CurrentVersion is set when the condition does not hold and the key exists
+	CurrentVersion *VersionData
 }
 
 type ServerReplicatedWriteRequest struct {
 	Op   string
 	Args ServerReplicatedWriteRequestArgs
+	// Signature is set by the sending server if the servers share a secret, see Sign
+	Signature string
 }
 
 type ServerReplicatedWriteRequestArgs struct {
 	Key            string
 	Value          string
+	ValueEncoding  string
 	ClientId       string
 	Dependencies   []DependencyData
 	OriginalServer string
 	Clock          uint64
+	// Crdt is the state of a CRDT value after the write, it is nil for a plain value
+	Crdt *CrdtState
+	// ExpiresAtUnixNano is when the key expires, computed by the original server at the time of the write
+	// so that all replicas expire the key at the same instant. 0 means the key never expires
+	ExpiresAtUnixNano int64
+	// Deleted tells the write is the tombstone of a delete, whose Value is empty
+	Deleted bool
+}
+
+// ServerReplicatedWriteBatchRequest carries many replicated writes, each signed as if it were sent on its own
+type ServerReplicatedWriteBatchRequest struct {
+	Op   string
+	Args ServerReplicatedWriteBatchRequestArgs
+}
+
+type ServerReplicatedWriteBatchRequestArgs struct {
+	Writes []ServerReplicatedWriteRequest
+}
+
+// RaftLogEntry is a write of a strongly consistent key ordered by the consensus group
+type RaftLogEntry struct {
+	Term uint64
+	// Key is empty for the no-op entry appended by a newly elected leader
+	Key            string
+	Value          string
+	ValueEncoding  string
+	ClientId       string
+	OriginalServer string
+	Clock          uint64
+	// Dependencies are the versions the client depended on when writing, which are committed before the entry
+	// is applied, so that a strong write causally follows the writes of its client
+	Dependencies []DependencyData
+
+	// Condition is empty for a plain write, or CompareAndSet or SetIfAbsent for a conditional write,
+	// which is then checked when the entry is applied, making it linearizable
+	Condition                      string
+	ExpectedOriginalServer         string
+	ExpectedLamportsClockTimestamp uint64
+
+	// ExpiresAtUnixNano is when the key expires, 0 means the key never expires
+	ExpiresAtUnixNano int64
+	// Deleted tells the entry is the tombstone of a delete
+	Deleted bool
+	// ProposedAtUnixNano is the leader's time when proposing the entry, against which the condition of
+	// a conditional write is checked for expiration, so that all servers agree on it
+	ProposedAtUnixNano int64
+}
+
+type ServerRaftRequestVoteRequest struct {
+	Op   string
+	Args ServerRaftRequestVoteRequestArgs
+	// Signature is set by the sending server if the servers share a secret, see Sign
+	Signature string
+}
+
+type ServerRaftRequestVoteRequestArgs struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type ServerRaftRequestVoteResponse struct {
+	Op          string
+	Term        uint64
+	VoteGranted bool
+}
+
+type ServerRaftAppendEntriesRequest struct {
+	Op   string
+	Args ServerRaftAppendEntriesRequestArgs
+	// Signature is set by the sending server if the servers share a secret, see Sign
+	Signature string
+}
+
+type ServerRaftAppendEntriesRequestArgs struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []RaftLogEntry
+	LeaderCommit uint64
+}
+
+type ServerRaftAppendEntriesResponse struct {
+	Op      string
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader should retry from when Success is false
+	ConflictIndex uint64
+}
+
+type ServerRaftProposeRequest struct {
+	Op   string
+	Args ServerRaftProposeRequestArgs
+	// Signature is set by the sending server if the servers share a secret, see Sign
+	Signature string
+}
+
+type ServerRaftProposeRequestArgs struct {
+	Entry RaftLogEntry
+	// Sender is the server forwarding the write to the leader
+	Sender string
+}
+
+type ServerRaftProposeResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	// Index and Entry describe the committed entry when Result is Success
+	Index uint64
+	Entry RaftLogEntry
+	// CurrentVersion is set when the condition of a conditional write does not hold and the key exists
+	CurrentVersion *VersionData
+}
+
+type ClientWriteChunkRequest struct {
+	Op   string
+	Args ClientWriteChunkRequestArgs
+}
+
+// ClientWriteChunkRequestArgs carry a chunk of a large value uploaded in many requests.
+// The chunk with Final set commits Write, whose value is the concatenation of the chunks
+type ClientWriteChunkRequestArgs struct {
+	ClientId     string
+	SessionToken string
+	UploadId     string
+	// Offset is where the chunk starts in the value
+	Offset        int64
+	Chunk         string
+	ChunkEncoding string
+	Final         bool
+	Write         ClientWriteRequestArgs
+}
+
+type ClientWriteChunkResponse struct {
+	Op             string
+	Result         OperationResult
+	DetailedResult string
+	ErrorCode      ErrorCode
+	// Received is the size of the value uploaded so far
+	Received int64
 }
@@ -0,0 +1,30 @@
+package communication
+
+import (
+	"encoding/base64"
+	"unicode/utf8"
+)
+
+// EncodeValue makes a value safe to carry in json, returning the encoded value and its ValueEncoding
+func EncodeValue(value string) (string, string) {
+	if utf8.ValidString(value) {
+		return value, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(value)), Base64
+}
+
+// DecodeValue reverts EncodeValue
+func DecodeValue(encoded, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return encoded, nil
+	case Base64:
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", Errorf(BadRequest, "bad base64 value: %v", err)
+		}
+		return string(decoded), nil
+	default:
+		return "", Errorf(BadRequest, "unknown value encoding %q", encoding)
+	}
+}
@@ -0,0 +1,100 @@
+package communication
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode tells why a request failed, next to the DetailedResult of a response whose Result is Fail,
+// so that clients do not have to parse the detailed result
+type ErrorCode string
+
+const (
+	// NotFound is a key, a version, an index or a change feed offset that does not exist
+	NotFound ErrorCode = "not_found"
+	// Evicted is a key whose value a server running as a cache dropped to fit in its memory budget. The key still
+	// exists, at the version it was evicted at, but its value is lost until the key is written again
+	Evicted ErrorCode = "evicted"
+	// BadRequest is a request that cannot be decoded or whose arguments are invalid
+	BadRequest ErrorCode = "bad_request"
+	// Unauthorized is a client that is not authenticated, or whose credentials are wrong
+	Unauthorized ErrorCode = "unauthorized"
+	// Forbidden is a client or a server that may not make the request
+	Forbidden ErrorCode = "forbidden"
+	// Conflict is a key that is not of the type the request needs, or a conditional write whose condition does not hold
+	Conflict ErrorCode = "conflict"
+	// Timeout is a request that was not received or completed in time
+	Timeout ErrorCode = "timeout"
+	// Unavailable is a server that cannot serve the request now, such as one without a known consensus leader,
+	// the request may be retried later
+	Unavailable ErrorCode = "unavailable"
+	// DependencyPending is a request depending on another one the server has not received yet, such as a chunk
+	// ahead of the chunks received, it may be retried once the other one is sent
+	DependencyPending ErrorCode = "dependency_pending"
+	// TooLarge is a request or a value larger than the server accepts
+	TooLarge ErrorCode = "too_large"
+	// RateLimited is a client sending requests faster than it may, the request may be retried later
+	RateLimited ErrorCode = "rate_limited"
+	// Unsupported is an operation or a feature the server does not support, or not over this connection
+	Unsupported ErrorCode = "unsupported"
+	// Internal is any other failure
+	Internal ErrorCode = "internal"
+)
+
+// Error is a failed request, with its code and its detailed result
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// sentinel errors to compare errors with errors.Is, which matches any Error with the same code
+var (
+	ErrNotFound          = &Error{Code: NotFound}
+	ErrEvicted           = &Error{Code: Evicted}
+	ErrBadRequest        = &Error{Code: BadRequest}
+	ErrUnauthorized      = &Error{Code: Unauthorized}
+	ErrForbidden         = &Error{Code: Forbidden}
+	ErrConflict          = &Error{Code: Conflict}
+	ErrTimeout           = &Error{Code: Timeout}
+	ErrUnavailable       = &Error{Code: Unavailable}
+	ErrDependencyPending = &Error{Code: DependencyPending}
+	ErrTooLarge          = &Error{Code: TooLarge}
+	ErrRateLimited       = &Error{Code: RateLimited}
+	ErrUnsupported       = &Error{Code: Unsupported}
+	ErrInternal          = &Error{Code: Internal}
+)
+
+// Errorf makes an Error with a code and a formatted detailed result
+func Errorf(code ErrorCode, format string, a ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// ErrorOf makes the error of a failed response, whose code is Internal if the server did not tell it
+func ErrorOf(code ErrorCode, detailedResult string) error {
+	if code == "" {
+		code = Internal
+	}
+	return &Error{Code: code, Message: detailedResult}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return e.Message
+}
+
+// Is matches the sentinel error with the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Message == "" && t.Code == e.Code
+}
+
+// CodeOf returns the code of an error, Internal if it is not an Error
+func CodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Internal
+}
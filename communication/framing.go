@@ -0,0 +1,256 @@
+package communication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A connection starting with FramedPreamble carries many requests, each in a frame, instead of a single json
+// request delimited by the connection close. A frame is the big-endian uint32 length of the rest of the frame,
+// the big-endian uint64 id of the request, then the message, in json or in the codec agreed on in the handshake. The response to a request is sent in a frame
+// with the id of the request, so a client may send many requests before reading their responses.
+// The one-shot mode stays available, since a json request never starts with FramedPreamble
+const FramedPreamble = "LAB2FRAMED\n"
+
+// MaxFrameSize bounds the size of a frame, which must hold a chunk of a large value encoded in base64
+const MaxFrameSize = 96 << 20
+
+const frameHeaderSize = 4 + 8
+
+// WriteFrame writes a message in a frame with the id of the request it belongs to
+func WriteFrame(w io.Writer, requestId uint64, message []byte) error {
+	if frameHeaderSize-4+len(message) > MaxFrameSize {
+		return fmt.Errorf("message of %d bytes is larger than the maximum frame size", len(message))
+	}
+	frame := make([]byte, frameHeaderSize+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(frameHeaderSize-4+len(message)))
+	binary.BigEndian.PutUint64(frame[4:], requestId)
+	copy(frame[frameHeaderSize:], message)
+	_, err := w.Write(frame)
+	return err
+}
+
+// FrameTooLargeError tells a frame holds a message larger than the reader accepts. The message is not read,
+// so the connection cannot be read any further
+type FrameTooLargeError struct {
+	RequestId     uint64
+	Size, MaxSize int
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("message of %d bytes is larger than the maximum of %d bytes", e.Size, e.MaxSize)
+}
+
+// ReadFrame reads a frame, returning the id of the request it belongs to and the message
+func ReadFrame(r io.Reader) (uint64, []byte, error) {
+	return ReadFrameLimited(r, MaxFrameSize)
+}
+
+// ReadFrameLimited reads a frame holding a message of at most maxSize bytes
+func ReadFrameLimited(r io.Reader, maxSize int) (uint64, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size < frameHeaderSize-4 || size > MaxFrameSize {
+		return 0, nil, fmt.Errorf("bad frame size %d", size)
+	}
+	requestId := binary.BigEndian.Uint64(header[4:])
+	if messageSize := int(size) - (frameHeaderSize - 4); messageSize > maxSize {
+		return requestId, nil, &FrameTooLargeError{RequestId: requestId, Size: messageSize, MaxSize: maxSize}
+	}
+	message := make([]byte, size-(frameHeaderSize-4))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return 0, nil, err
+	}
+	return requestId, message, nil
+}
+
+// FramedConnection carries many framed requests to a server. Requests may be sent by many goroutines
+// and pipelined, their responses are matched by request id
+type FramedConnection struct {
+	conn net.Conn
+	// Hello is the response to the handshake starting the connection
+	Hello HelloResponse
+	// Codec encodes the requests after the hello, and decodes their responses
+	Codec Codec
+	// writeLock keeps the frames of concurrent requests from interleaving
+	writeLock sync.Mutex
+
+	nextRequestId uint64
+	// pending maps the id of a request to the channel its response is delivered to
+	pending map[uint64]chan FrameResult
+	// err is set once the connection is broken, failing every request after it
+	err  error
+	lock sync.Mutex
+}
+
+// FrameResult is the response to a request sent over a framed connection, or the error that broke the connection
+type FrameResult struct {
+	message []byte
+	err     error
+}
+
+// DialFramed opens a framed connection, over TLS if tlsConfig is not nil,
+// and makes the handshake starting it, which must succeed. The messages compressed over it are counted in metrics,
+// unless it is nil
+func DialFramed(hostPort string, hello HelloRequest, timeout time.Duration, tlsConfig *tls.Config, metrics *CompressionMetrics) (*FramedConnection, error) {
+	conn, err := Dial(hostPort, timeout, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := &FramedConnection{
+		conn:    conn,
+		Codec:   JsonCodec,
+		pending: make(map[uint64]chan FrameResult),
+	}
+	if err := c.shakeHands(hello, timeout); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c.Codec = CodecOf(c.Hello.Features, metrics)
+	go c.receive()
+	return c, nil
+}
+
+// shakeHands sends the preamble and the hello, which is always in json
+func (c *FramedConnection) shakeHands(hello HelloRequest, timeout time.Duration) error {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write([]byte(FramedPreamble)); err != nil {
+		return err
+	}
+	req, _ := json.Marshal(hello)
+	if err := WriteFrame(c.conn, 0, req); err != nil {
+		return err
+	}
+	_, message, err := ReadFrame(c.conn)
+	if err != nil {
+		return fmt.Errorf("server does not speak the framed protocol: %w", err)
+	}
+	if err := json.Unmarshal(message, &c.Hello); err != nil {
+		return err
+	}
+	if c.Hello.Result != Success {
+		return fmt.Errorf("server is incompatible: %s", c.Hello.DetailedResult)
+	}
+	return c.conn.SetDeadline(time.Time{})
+}
+
+// Send sends a request and returns the channel its response will be delivered to
+func (c *FramedConnection) Send(req interface{}) (<-chan FrameResult, error) {
+	message, err := c.Codec.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.nextRequestId++
+	requestId := c.nextRequestId
+	result := make(chan FrameResult, 1)
+	c.pending[requestId] = result
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	err = WriteFrame(c.conn, requestId, message)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// Receive waits for the response delivered to the channel returned by Send, and decodes it into resp.
+// It gives up when ctx is done, in which case the response is dropped when it arrives
+func (c *FramedConnection) Receive(ctx context.Context, result <-chan FrameResult, resp interface{}) error {
+	var r FrameResult
+	select {
+	case r = <-result:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return c.Codec.Unmarshal(r.message, resp)
+}
+
+// Pipeline sends many requests before reading their responses, and decodes the responses into resps
+func (c *FramedConnection) Pipeline(ctx context.Context, reqs []interface{}, resps []interface{}) error {
+	results := make([]<-chan FrameResult, 0, len(reqs))
+	for _, req := range reqs {
+		result, err := c.Send(req)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	for i, result := range results {
+		if err := c.Receive(ctx, result, resps[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Broken tells if the connection is broken, in which case it must be dialed again
+func (c *FramedConnection) Broken() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err != nil
+}
+
+// Close closes the connection, failing the pending requests
+func (c *FramedConnection) Close() {
+	c.fail(fmt.Errorf("connection is closed"))
+}
+
+// receive delivers the responses to the pending requests until the connection is broken
+func (c *FramedConnection) receive() {
+	r := bufio.NewReader(c.conn)
+	for {
+		requestId, message, err := ReadFrame(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.lock.Lock()
+		result, ok := c.pending[requestId]
+		delete(c.pending, requestId)
+		c.lock.Unlock()
+		if ok {
+			result <- FrameResult{message: message}
+		}
+	}
+}
+
+// fail marks the connection as broken and fails the pending requests
+func (c *FramedConnection) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err == nil {
+		c.err = fmt.Errorf("connection is broken: %w", err)
+		_ = c.conn.Close()
+	}
+	for requestId, result := range c.pending {
+		result <- FrameResult{err: c.err}
+		delete(c.pending, requestId)
+	}
+}
@@ -0,0 +1,79 @@
+package communication
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// ProtocolVersion is the latest version of the protocol, and MinProtocolVersion the oldest one still spoken.
+	// Version 1 is the protocol of one json request per connection, before the handshake existed
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Features are the optional parts of the protocol, which are only used if both ends support them
+const (
+	// FeatureFraming is the framed connection carrying many requests
+	FeatureFraming = "framing"
+	// FeatureBatching is MultiRead and MultiWrite
+	FeatureBatching = "batching"
+	// FeatureChunking is WriteChunk
+	FeatureChunking = "chunking"
+	// FeatureVersionVectors is the CRDT values, of which multi-value registers carry version vectors
+	FeatureVersionVectors = "version_vectors"
+	// FeatureStrongConsistency is the consensus group ordering the writes of strongly consistent keys
+	FeatureStrongConsistency = "strong_consistency"
+	// FeatureReplicationBatching is ReplicatedWriteBatch
+	FeatureReplicationBatching = "replication_batching"
+)
+
+type HelloRequest struct {
+	Op   string
+	Args HelloRequestArgs
+}
+
+// HelloRequestArgs tell the range of protocol versions and the features the sender supports
+type HelloRequestArgs struct {
+	ProtocolVersion    int
+	MinProtocolVersion int
+	Features           []string
+	// Sender is the ip:port of the sending server, empty for a client
+	Sender string
+}
+
+// HelloResponse tells the protocol version and the features both ends will use
+type HelloResponse struct {
+	Op              string
+	Result          OperationResult
+	DetailedResult  string
+	ErrorCode       ErrorCode
+	ProtocolVersion int
+	Features        []string
+}
+
+// Negotiate picks the latest protocol version both ends speak, and the features both ends support.
+// It fails if the ranges of protocol versions do not overlap
+func Negotiate(args HelloRequestArgs, features []string) (int, []string, error) {
+	version := args.ProtocolVersion
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < MinProtocolVersion || version < args.MinProtocolVersion {
+		return 0, nil, fmt.Errorf("incompatible protocol versions: peer speaks versions %d to %d, this end speaks versions %d to %d",
+			args.MinProtocolVersion, args.ProtocolVersion, MinProtocolVersion, ProtocolVersion)
+	}
+
+	supported := make(map[string]bool, len(features))
+	for _, f := range features {
+		supported[f] = true
+	}
+	common := make([]string, 0, len(args.Features))
+	for _, f := range args.Features {
+		if supported[f] {
+			common = append(common, f)
+		}
+	}
+	sort.Strings(common)
+	return version, common, nil
+}
@@ -0,0 +1,85 @@
+package communication
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Sign computes the HMAC-SHA256 signature of a server-to-server message with the secret shared by the servers.
+// It covers the op and the canonical encoding of the arguments, see canonicalJson
+func Sign(secret []byte, op string, args interface{}) string {
+	m := canonicalJson(args)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(op))
+	mac.Write([]byte{'\n'})
+	mac.Write(m)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature tells if a server-to-server message was signed with the shared secret
+func VerifySignature(secret []byte, op string, args interface{}, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	actual, _ := hex.DecodeString(Sign(secret, op, args))
+	return hmac.Equal(expected, actual)
+}
+
+// canonicalJson encodes a message in json with sorted keys and without the zero values, empty lists and empty
+// objects, which gob does not carry, so that the encoding is the same whatever codec carried the message
+func canonicalJson(v interface{}) []byte {
+	m, _ := json.Marshal(v)
+	var generic interface{}
+	d := json.NewDecoder(bytes.NewReader(m))
+	// numbers are kept as written, large clocks would lose precision as float64
+	d.UseNumber()
+	if err := d.Decode(&generic); err != nil {
+		return m
+	}
+	m, _ = json.Marshal(pruneZeroValues(generic))
+	return m
+}
+
+// pruneZeroValues drops the zero values from a decoded json value, returning nil if nothing is left of it
+func pruneZeroValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if p := pruneZeroValues(e); p == nil {
+				delete(v, k)
+			} else {
+				v[k] = p
+			}
+		}
+		if len(v) == 0 {
+			return nil
+		}
+		return v
+	case []interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		for i, e := range v {
+			// elements are kept in place so that positions are preserved
+			v[i] = pruneZeroValues(e)
+		}
+		return v
+	case string:
+		if v == "" {
+			return nil
+		}
+	case json.Number:
+		if v == "0" {
+			return nil
+		}
+	case bool:
+		if !v {
+			return nil
+		}
+	}
+	return v
+}
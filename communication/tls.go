@@ -0,0 +1,77 @@
+package communication
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"Lab2/util"
+)
+
+// LoadTLSConfig loads a certificate and its key, both optional for a client, and the certificate of the CA
+// that signs the certificates of the cluster. The CA verifies the servers dialed, and the clients and servers
+// presenting a certificate to a server
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %q", caFile)
+	}
+
+	config := &tls.Config{
+		RootCAs:    pool,
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Dial opens a connection, over TLS if config is not nil
+func Dial(hostPort string, timeout time.Duration, config *tls.Config) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if config == nil {
+		return dialer.Dial("tcp", hostPort)
+	}
+	return tls.DialWithDialer(&dialer, "tcp", hostPort, config)
+}
+
+// VerifiedServer tells if the connection is over TLS with a peer presenting a certificate signed by the CA,
+// with the organizational unit of servers, and valid for one of the hosts
+func VerifiedServer(conn net.Conn, hosts []string) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return false
+	}
+	// a client certificate may be valid for the host of a server, such as a client running on it
+	isServer := false
+	for _, unit := range state.PeerCertificates[0].Subject.OrganizationalUnit {
+		isServer = isServer || unit == util.ServerOrganizationalUnit
+	}
+	if !isServer {
+		return false
+	}
+	for _, host := range hosts {
+		if state.PeerCertificates[0].VerifyHostname(host) == nil {
+			return true
+		}
+	}
+	return false
+}
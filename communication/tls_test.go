@@ -0,0 +1,64 @@
+package communication
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"Lab2/util"
+)
+
+// acceptPeer handshakes over TLS as a server with a peer presenting the certificate of peerConfig, if any,
+// returning the connection of the server
+func acceptPeer(t *testing.T, serverConfig, peerConfig *tls.Config) *tls.Conn {
+	t.Helper()
+	serverEnd, peerEnd := net.Pipe()
+	t.Cleanup(func() {
+		_ = serverEnd.Close()
+		_ = peerEnd.Close()
+	})
+	peerConfig = peerConfig.Clone()
+	peerConfig.ServerName = "localhost"
+	go func() {
+		_ = tls.Client(peerEnd, peerConfig).Handshake()
+	}()
+	conn := tls.Server(serverEnd, serverConfig)
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestOnlyServerCertificatesAuthenticateServers(t *testing.T) {
+	dir := t.TempDir()
+	if err := util.GenerateTestCertificates(dir, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	load := func(name string) *tls.Config {
+		cert, key := "", ""
+		if name != "" {
+			cert, key = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		}
+		config, err := LoadTLSConfig(cert, key, filepath.Join(dir, "ca.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	server := load("server")
+	hosts := []string{"127.0.0.1"}
+
+	if !VerifiedServer(acceptPeer(t, server, server), hosts) {
+		t.Errorf("a peer presenting the server certificate is not verified as a server")
+	}
+	if VerifiedServer(acceptPeer(t, server, load("client")), hosts) {
+		t.Errorf("a peer presenting the client certificate is verified as a server")
+	}
+	if VerifiedServer(acceptPeer(t, server, load("")), hosts) {
+		t.Errorf("a peer presenting no certificate is verified as a server")
+	}
+	if VerifiedServer(acceptPeer(t, server, server), []string{"10.1.2.3"}) {
+		t.Errorf("a peer presenting the server certificate is verified as a server of another host")
+	}
+}
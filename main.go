@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"Lab2/client"
 	"Lab2/server"
@@ -27,11 +28,97 @@ func main() {
 				},
 			},
 			{
-				Name:  "server",
-				Usage: "Run in server mode",
+				Name:      "server",
+				Usage:     "Run in server mode, configured with the server commands unless any flag is given",
+				UsageText: fmt.Sprintf("%s server [--config file] [--listen ip:port] [--peers ip:port,...] [flags]", util.AppName),
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "json configuration file, which the other flags override",
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "ip:port to listen to",
+					},
+					&cli.StringSliceFlag{
+						Name:  "peers",
+						Usage: "ip:port of the other servers, may be repeated or separated by commas",
+					},
+					&cli.StringSliceFlag{
+						Name:  "strong",
+						Usage: "key prefix of strongly consistent keys, may be repeated or separated by commas",
+					},
+					&cli.StringFlag{
+						Name:  "secret",
+						Usage: "secret shared by all servers to sign the messages between them",
+					},
+					&cli.StringFlag{
+						Name:  "tls-cert",
+						Usage: "certificate file of this server, enabling TLS",
+					},
+					&cli.StringFlag{
+						Name:  "tls-key",
+						Usage: "key file of the certificate of this server",
+					},
+					&cli.StringFlag{
+						Name:  "tls-ca",
+						Usage: "CA certificate file verifying the certificates of the peers",
+					},
+					&cli.StringFlag{
+						Name:  "data-file",
+						Usage: "file to save the state to when the server stops, and restore it from when it starts",
+					},
+					&cli.DurationFlag{
+						Name:  "shutdown-timeout",
+						Usage: "time to wait for the requests in flight and the outbound replicated writes when stopping (default: 10s)",
+					},
+					&cli.BoolFlag{
+						Name:  "cache-only",
+						Usage: "run as a cache, which drops the values evicted to fit in its memory budget instead of writing them to disk",
+					},
+					&cli.BoolFlag{
+						Name:  "interactive",
+						Usage: "read server commands from stdin once the server started, instead of running until SIGINT or SIGTERM",
+					},
+				},
 				Action: func(context *cli.Context) error {
-					server.Start()
-					return nil
+					if context.NumFlags() == 0 {
+						server.Start()
+						return nil
+					}
+					return server.Run(server.Options{
+						ConfigFile:        context.String("config"),
+						Listen:            context.String("listen"),
+						Peers:             splitList(context.StringSlice("peers")),
+						StrongKeyPrefixes: splitList(context.StringSlice("strong")),
+						SharedSecret:      context.String("secret"),
+						TLSCertFile:       context.String("tls-cert"),
+						TLSKeyFile:        context.String("tls-key"),
+						TLSCAFile:         context.String("tls-ca"),
+						DataFile:          context.String("data-file"),
+						ShutdownTimeout:   context.Duration("shutdown-timeout"),
+						CacheOnly:         context.Bool("cache-only"),
+						Interactive:       context.Bool("interactive"),
+					})
+				},
+			},
+			{
+				Name:  "gencert",
+				Usage: "Generate a CA, and certificates signed by it for the servers and for the clients of a test cluster",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "dir",
+						Value: ".",
+						Usage: "directory to write ca.pem, ca-key.pem, server.pem, server-key.pem, client.pem and client-key.pem to",
+					},
+					&cli.StringSliceFlag{
+						Name:  "host",
+						Value: cli.NewStringSlice("localhost", "127.0.0.1"),
+						Usage: "host name or ip address the server certificate is valid for, may be repeated",
+					},
+				},
+				Action: func(context *cli.Context) error {
+					return util.GenerateTestCertificates(context.String("dir"), context.StringSlice("host"))
 				},
 			},
 		},
@@ -42,3 +129,16 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// splitList splits the values of a flag that may be repeated or separated by commas
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"Lab2/communication"
+)
+
+// permission is what a user may do with the keys of a prefix
+type permission string
+
+const (
+	readPermission  permission = "read"
+	writePermission permission = "write"
+
+	// allKeys is the prefix granting a permission on all keys
+	allKeys = "*"
+)
+
+const (
+	// passwordIterations is the number of iterations of the key derivation of passwords, making guesses expensive
+	passwordIterations = 100000
+	saltSize           = 16
+	sessionTokenSize   = 32
+	// sessionLifetime is how long a session token issued by connect is valid
+	sessionLifetime = 24 * time.Hour
+)
+
+// grant is a permission of a user on the keys with a prefix, empty for all keys
+type grant struct {
+	permission permission
+	prefix     string
+}
+
+// account is a user allowed to connect, with the salted hash of its password and its grants
+type account struct {
+	salt         []byte
+	passwordHash []byte
+	grants       []grant
+}
+
+// userSession is the user a session token was issued to, valid until it expires
+type userSession struct {
+	user      string
+	expiresAt time.Time
+}
+
+// accountRegistry holds the users allowed to connect and their sessions.
+// Clients are only authenticated if there is at least one user
+type accountRegistry struct {
+	accountByUser  map[string]*account
+	sessionByToken map[string]userSession
+	sync.Mutex
+}
+
+// addUser adds a user, or changes the password of an existing one
+func (srv *Server) addUser(user, password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := derivePasswordKey(password, salt, passwordIterations)
+
+	srv.accounts.Lock()
+	defer srv.accounts.Unlock()
+	if a, ok := srv.accounts.accountByUser[user]; ok {
+		a.salt, a.passwordHash = salt, hash
+		return fmt.Sprintf("password of user %q is changed", user), nil
+	}
+	srv.accounts.accountByUser[user] = &account{salt: salt, passwordHash: hash}
+	return fmt.Sprintf("user %q is added, clients must now connect with a user and a password", user), nil
+}
+
+// grantPermission grants a user a permission on the keys with a prefix, or on all keys
+func (srv *Server) grantPermission(user, p, prefix string) (string, error) {
+	perm := permission(p)
+	if perm != readPermission && perm != writePermission {
+		return "", fmt.Errorf("unknown permission %q, must be %q or %q", p, readPermission, writePermission)
+	}
+	if prefix == allKeys {
+		prefix = ""
+	}
+
+	srv.accounts.Lock()
+	defer srv.accounts.Unlock()
+	a, ok := srv.accounts.accountByUser[user]
+	if !ok {
+		return "", fmt.Errorf("unknown user %q", user)
+	}
+	a.grants = append(a.grants, grant{permission: perm, prefix: prefix})
+	if prefix == "" {
+		return fmt.Sprintf("user %q may now %s all keys", user, perm), nil
+	}
+	return fmt.Sprintf("user %q may now %s keys with prefix %q", user, perm, prefix), nil
+}
+
+// reportUsers lists the users and their permissions
+func (srv *Server) reportUsers() string {
+	srv.accounts.Lock()
+	defer srv.accounts.Unlock()
+
+	if len(srv.accounts.accountByUser) == 0 {
+		return "there are no users, clients are not authenticated"
+	}
+	users := make([]string, 0, len(srv.accounts.accountByUser))
+	for u := range srv.accounts.accountByUser {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	lines := make([]string, 0, len(users))
+	for _, u := range users {
+		grants := make([]string, 0, len(srv.accounts.accountByUser[u].grants))
+		for _, g := range srv.accounts.accountByUser[u].grants {
+			prefix := g.prefix
+			if prefix == "" {
+				prefix = allKeys
+			}
+			grants = append(grants, fmt.Sprintf("%s %q", g.permission, prefix))
+		}
+		lines = append(lines, fmt.Sprintf("%q: %s", u, strings.Join(grants, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// authenticate checks the password of a user and issues a session token, or an empty token if clients
+// are not authenticated
+func (srv *Server) authenticate(user, password string) (string, error) {
+	srv.accounts.Lock()
+	if len(srv.accounts.accountByUser) == 0 {
+		srv.accounts.Unlock()
+		return "", nil
+	}
+	a, ok := srv.accounts.accountByUser[user]
+	var salt, hash []byte
+	if ok {
+		salt, hash = a.salt, a.passwordHash
+	}
+	srv.accounts.Unlock()
+
+	// the derivation is slow on purpose, it is done without holding the lock
+	if !ok || !hmac.Equal(derivePasswordKey(password, salt, passwordIterations), hash) {
+		return "", communication.Errorf(communication.Unauthorized, "bad user or password")
+	}
+
+	srv.accounts.Lock()
+	defer srv.accounts.Unlock()
+	now := time.Now()
+	for token, s := range srv.accounts.sessionByToken {
+		if now.After(s.expiresAt) {
+			delete(srv.accounts.sessionByToken, token)
+		}
+	}
+	b := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	srv.accounts.sessionByToken[token] = userSession{user: user, expiresAt: now.Add(sessionLifetime)}
+	return token, nil
+}
+
+// sessionUser returns the user of a session token, or an empty user if clients are not authenticated
+func (srv *Server) sessionUser(token string) (string, error) {
+	srv.accounts.Lock()
+	defer srv.accounts.Unlock()
+	return srv.accounts.sessionUser(token)
+}
+
+// the caller must hold the lock of accounts
+func (r *accountRegistry) sessionUser(token string) (string, error) {
+	if len(r.accountByUser) == 0 {
+		return "", nil
+	}
+	s, ok := r.sessionByToken[token]
+	if !ok || time.Now().After(s.expiresAt) {
+		return "", communication.Errorf(communication.Unauthorized, "not authenticated, connect with a user and a password")
+	}
+	if _, ok := r.accountByUser[s.user]; !ok {
+		return "", communication.Errorf(communication.Unauthorized, "user %q no longer exists", s.user)
+	}
+	return s.user, nil
+}
+
+// authorize checks the user of a session token has a permission on a key, or on all the keys of a prefix
+func (srv *Server) authorize(token string, perm permission, key string) error {
+	srv.accounts.Lock()
+	defer srv.accounts.Unlock()
+
+	user, err := srv.accounts.sessionUser(token)
+	if err != nil || user == "" {
+		return err
+	}
+	for _, g := range srv.accounts.accountByUser[user].grants {
+		if g.permission == perm && strings.HasPrefix(key, g.prefix) {
+			return nil
+		}
+	}
+	return communication.Errorf(communication.Forbidden, "user %q may not %s key %q", user, perm, key)
+}
+
+// derivePasswordKey derives the hash of a password with PBKDF2-HMAC-SHA256 in the given number of iterations,
+// producing a single block
+func derivePasswordKey(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
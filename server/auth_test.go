@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"Lab2/communication"
+)
+
+func TestPasswordKeyDerivationIsPbkdf2(t *testing.T) {
+	cases := []struct {
+		iterations int
+		key        string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, c := range cases {
+		if key := hex.EncodeToString(derivePasswordKey("password", []byte("salt"), c.iterations)); key != c.key {
+			t.Errorf("%d iterations: derived %s, want %s", c.iterations, key, c.key)
+		}
+	}
+}
+
+func TestAuthenticateRejectsBadCredentials(t *testing.T) {
+	srv := New(Config{})
+	if _, err := srv.addUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		ok       bool
+	}{
+		{"right password", "alice", "secret", true},
+		{"wrong password", "alice", "guess", false},
+		{"empty password", "alice", "", false},
+		{"unknown user", "bob", "secret", false},
+		{"no user", "", "", false},
+	}
+	for _, c := range cases {
+		token, err := srv.authenticate(c.user, c.password)
+		if c.ok && (err != nil || token == "") {
+			t.Errorf("%s: got token %q and %v, want a token", c.name, token, err)
+		}
+		if !c.ok && (!errors.Is(err, communication.ErrUnauthorized) || token != "") {
+			t.Errorf("%s: got token %q and %v, want an unauthorized error", c.name, token, err)
+		}
+	}
+}
+
+func TestPermissionsApplyToTheKeysOfTheirPrefix(t *testing.T) {
+	srv := New(Config{})
+	for _, user := range []string{"alice", "admin"} {
+		if _, err := srv.addUser(user, "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, g := range []struct{ user, permission, prefix string }{
+		{"alice", "read", "public/"},
+		{"alice", "write", "alice/"},
+		{"alice", "read", "alice/"},
+		{"admin", "write", allKeys},
+	} {
+		if _, err := srv.grantPermission(g.user, g.permission, g.prefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokenOf := func(user string) string {
+		token, err := srv.authenticate(user, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	alice, admin := tokenOf("alice"), tokenOf("admin")
+
+	cases := []struct {
+		name  string
+		token string
+		perm  permission
+		key   string
+		err   error
+	}{
+		{"read under a read prefix", alice, readPermission, "public/news", nil},
+		{"write under a read prefix", alice, writePermission, "public/news", communication.ErrForbidden},
+		{"write under a write prefix", alice, writePermission, "alice/notes", nil},
+		{"read outside the prefixes", alice, readPermission, "bob/notes", communication.ErrForbidden},
+		{"key containing the prefix elsewhere", alice, readPermission, "x/public/news", communication.ErrForbidden},
+		{"the prefix without its slash", alice, readPermission, "public", communication.ErrForbidden},
+		{"write on all keys", admin, writePermission, "bob/notes", nil},
+		{"read with write on all keys only", admin, readPermission, "bob/notes", communication.ErrForbidden},
+		{"unknown session", "not-a-token", readPermission, "public/news", communication.ErrUnauthorized},
+		{"no session", "", readPermission, "public/news", communication.ErrUnauthorized},
+	}
+	for _, c := range cases {
+		err := srv.authorize(c.token, c.perm, c.key)
+		if c.err == nil && err != nil {
+			t.Errorf("%s: refused: %v", c.name, err)
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	if err := New(Config{}).authorize("", writePermission, "any"); err != nil {
+		t.Errorf("a server without users refused a request: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"Lab2/communication"
+	"Lab2/util"
+)
+
+// maxChangeRecords bounds the records kept by the change feed, the oldest ones are dropped first
+const maxChangeRecords = 100000
+
+type changeFeed struct {
+	records []communication.ChangeRecord
+	// firstOffset is the offset of records[0]
+	firstOffset     uint64
+	consumerOffsets map[string]uint64
+	// appended is closed, then replaced, whenever records are appended
+	appended chan struct{}
+	sync.Mutex
+}
+
+// append adds the record of a committed write to the feed.
+// It is called with the lock of storage held, so records are in commit order
+func (f *changeFeed) append(key string, v valueOfKey, dependencies []communication.DependencyData) {
+	f.Lock()
+	defer f.Unlock()
+
+	value, encoding := communication.EncodeValue(v.value)
+	f.records = append(f.records, communication.ChangeRecord{
+		Offset:                 f.end(),
+		Key:                    key,
+		Value:                  value,
+		ValueEncoding:          encoding,
+		OriginalServer:         v.originalServer,
+		LamportsClockTimestamp: v.lamportsClockTimestamp,
+		Dependencies:           append([]communication.DependencyData(nil), dependencies...),
+		Deleted:                v.deleted,
+	})
+	if len(f.records) > maxChangeRecords {
+		dropped := len(f.records) - maxChangeRecords
+		f.records = append([]communication.ChangeRecord(nil), f.records[dropped:]...)
+		f.firstOffset += uint64(dropped)
+	}
+
+	close(f.appended)
+	f.appended = make(chan struct{})
+}
+
+// end is the offset the next record will have. The caller must hold the lock of the feed
+func (f *changeFeed) end() uint64 {
+	return f.firstOffset + uint64(len(f.records))
+}
+
+// offsetBeyondEnd tells an offset was never reached, such as an offset of a previous run of a server whose change
+// feed is not saved
+func offsetBeyondEnd(offset, end uint64) string {
+	return fmt.Sprintf("offset %d is beyond the end of the change feed at %d, it may come from a previous run of the server", offset, end)
+}
+
+// handleChangeFeed handles a consumer reading the change feed, streaming records until the consumer disconnects
+func (srv *Server) handleChangeFeed(conn net.Conn, req communication.ChangeFeedRequest) {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	e := json.NewEncoder(conn)
+
+	// a consumer of the change feed reads all keys
+	if err := srv.authorize(req.Args.SessionToken, readPermission, ""); err != nil {
+		_ = e.Encode(communication.ChangeFeedResponse{
+			Op:             req.Op,
+			Result:         communication.Fail,
+			DetailedResult: err.Error(),
+			ErrorCode:      communication.CodeOf(err),
+		})
+		return
+	}
+
+	srv.changes.Lock()
+	next := req.Args.FromOffset
+	if committed, ok := srv.changes.consumerOffsets[req.Args.ConsumerId]; ok && req.Args.FromCommittedOffset {
+		next = committed
+	}
+	first, end := srv.changes.firstOffset, srv.changes.end()
+	srv.changes.Unlock()
+	if next < first {
+		_ = e.Encode(communication.ChangeFeedResponse{
+			Op:             req.Op,
+			Result:         communication.Fail,
+			DetailedResult: fmt.Sprintf("offset %d has been dropped, the oldest offset available is %d", next, first),
+			ErrorCode:      communication.NotFound,
+		})
+		return
+	}
+	if next > end {
+		_ = e.Encode(communication.ChangeFeedResponse{
+			Op:             req.Op,
+			Result:         communication.Fail,
+			DetailedResult: offsetBeyondEnd(next, end),
+			ErrorCode:      communication.NotFound,
+		})
+		return
+	}
+
+	if err := e.Encode(communication.ChangeFeedResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "change feed is successful",
+		FromOffset:     next,
+	}); err != nil {
+		return
+	}
+
+	// the consumer is not expected to send anything more, so a read returns when it disconnects
+	disconnected := make(chan struct{})
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		close(disconnected)
+	}()
+
+	for {
+		srv.changes.Lock()
+		if next < srv.changes.firstOffset {
+			// the consumer has fallen behind records being dropped, it has to reconnect
+			srv.changes.Unlock()
+			errorLogger.Printf("consumer %q of the change feed has fallen behind", req.Args.ConsumerId)
+			return
+		}
+		var batch []communication.ChangeRecord
+		if i := next - srv.changes.firstOffset; i < uint64(len(srv.changes.records)) {
+			batch = append(batch, srv.changes.records[i:]...)
+		}
+		appended := srv.changes.appended
+		srv.changes.Unlock()
+
+		for _, record := range batch {
+			if err := e.Encode(record); err != nil {
+				return
+			}
+			next = record.Offset + 1
+		}
+		if len(batch) == 0 {
+			select {
+			case <-appended:
+			case <-disconnected:
+				return
+			}
+		}
+	}
+}
+
+// handleCommitChangeFeedOffset handles a consumer recording how far it has processed the change feed
+func (srv *Server) handleCommitChangeFeedOffset(req communication.CommitChangeFeedOffsetRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	// a consumer of the change feed reads all keys
+	if err := srv.authorize(req.Args.SessionToken, readPermission, ""); err != nil {
+		return makeErrorResp(err)
+	}
+
+	srv.changes.Lock()
+	if end := srv.changes.end(); req.Args.Offset > end {
+		srv.changes.Unlock()
+		return makeFailResp(communication.NotFound, offsetBeyondEnd(req.Args.Offset, end))
+	}
+	srv.changes.consumerOffsets[req.Args.ConsumerId] = req.Args.Offset
+	srv.changes.Unlock()
+
+	return communication.GenericClientResponse{
+		Result:         communication.Success,
+		DetailedResult: fmt.Sprintf("offset %d is committed for consumer %q", req.Args.Offset, req.Args.ConsumerId),
+	}
+}
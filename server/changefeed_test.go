@@ -0,0 +1,65 @@
+package server
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"Lab2/communication"
+)
+
+func commitOffset(srv *Server, consumer string, offset uint64) communication.GenericClientResponse {
+	return srv.handleCommitChangeFeedOffset(communication.CommitChangeFeedOffsetRequest{
+		Op:   communication.CommitChangeFeedOffset,
+		Args: communication.CommitChangeFeedOffsetRequestArgs{ConsumerId: consumer, Offset: offset},
+	}).(communication.GenericClientResponse)
+}
+
+func TestChangeFeedAndConsumerOffsetsSurviveRestart(t *testing.T) {
+	config := Config{DataFile: filepath.Join(t.TempDir(), "data")}
+	srv := New(config)
+	for i, value := range []string{"v1", "v2", "v3"} {
+		srv.commitReplicatedWrite(communication.ServerReplicatedWriteRequestArgs{
+			Key: "k", Value: value, OriginalServer: "a:1", Clock: uint64(i + 1),
+		})
+	}
+	if r := commitOffset(srv, "consumer", 2); r.Result != communication.Success {
+		t.Fatalf("offset not committed: %+v", r)
+	}
+	if err := srv.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := New(config)
+	if _, err := restarted.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restarted.changes.records, srv.changes.records) {
+		t.Errorf("restored records %+v, want %+v", restarted.changes.records, srv.changes.records)
+	}
+	if offset := restarted.changes.consumerOffsets["consumer"]; offset != 2 {
+		t.Errorf("restored committed offset %d, want 2", offset)
+	}
+
+	restarted.commitReplicatedWrite(communication.ServerReplicatedWriteRequestArgs{
+		Key: "k", Value: "v4", OriginalServer: "a:1", Clock: 4,
+	})
+	if records := restarted.changes.records; records[len(records)-1].Offset != 3 {
+		t.Errorf("record appended after a restart at offset %d, want 3", records[len(records)-1].Offset)
+	}
+}
+
+func TestOffsetsBeyondTheEndOfTheChangeFeedAreRejected(t *testing.T) {
+	srv := New(Config{})
+	srv.commitReplicatedWrite(communication.ServerReplicatedWriteRequestArgs{Key: "k", Value: "v", OriginalServer: "a:1", Clock: 1})
+
+	if r := commitOffset(srv, "consumer", 1); r.Result != communication.Success {
+		t.Errorf("offset at the end of the feed not committed: %+v", r)
+	}
+	if r := commitOffset(srv, "consumer", 5); r.ErrorCode != communication.NotFound {
+		t.Errorf("offset beyond the end of the feed: got %+v, want a not found error", r)
+	}
+	if offset := srv.changes.consumerOffsets["consumer"]; offset != 1 {
+		t.Errorf("committed offset %d after a rejected one, want 1", offset)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"Lab2/communication"
+)
+
+const (
+	// uploadTimeout is how long an upload of a large value may stay without receiving a chunk
+	uploadTimeout = 1 * time.Minute
+	// uploadSweepInterval is how often the uploads which timed out are dropped
+	uploadSweepInterval = 10 * time.Second
+	// maxUploadSize bounds the size of a value uploaded in chunks, along with the maximum message size
+	maxUploadSize = 64 << 20
+	// maxUploadsPerClient bounds the uploads a client may have in progress, and maxUploadsSize the bytes received
+	// by all the uploads in progress
+	maxUploadsPerClient = 4
+	maxUploadsSize      = 256 << 20
+)
+
+type upload struct {
+	clientId   string
+	value      strings.Builder
+	lastUpdate time.Time
+}
+
+type uploadRegistry struct {
+	uploadById map[string]*upload
+	// size is the bytes received by the uploads in progress, at most maxSize, and maxPerClient bounds
+	// the uploads of a client
+	size         int64
+	maxSize      int64
+	maxPerClient int
+	sync.Mutex
+}
+
+// remove drops an upload, done or abandoned. The caller must hold the lock of r
+func (r *uploadRegistry) remove(id string) {
+	if u, ok := r.uploadById[id]; ok {
+		r.size -= int64(u.value.Len())
+		delete(r.uploadById, id)
+	}
+}
+
+// expire drops the uploads which received no chunk for the upload timeout. The caller must hold the lock of r
+func (r *uploadRegistry) expire(now time.Time) {
+	for id, u := range r.uploadById {
+		if now.Sub(u.lastUpdate) > uploadTimeout {
+			r.remove(id)
+		}
+	}
+}
+
+// countOf returns the number of uploads of a client in progress. The caller must hold the lock of r
+func (r *uploadRegistry) countOf(clientId string) int {
+	n := 0
+	for _, u := range r.uploadById {
+		if u.clientId == clientId {
+			n++
+		}
+	}
+	return n
+}
+
+// uploadLimit returns the size a value uploaded in chunks may have, which is no larger than the maximum message
+// size, like a value written in a single request, so that the other servers accept the replicated write of the value
+func uploadLimit(maxMessageSize int) int64 {
+	if maxMessageSize < maxUploadSize {
+		return int64(maxMessageSize)
+	}
+	return maxUploadSize
+}
+
+// sweepAbandonedUploads periodically drops the uploads which timed out, so that an upload a client never finishes
+// does not hold its chunks until another chunk arrives
+func (srv *Server) sweepAbandonedUploads() {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.stopped:
+			return
+		case now := <-ticker.C:
+			srv.uploads.Lock()
+			srv.uploads.expire(now)
+			srv.uploads.Unlock()
+		}
+	}
+}
+
+// handleClientWriteChunk handles a chunk of a large value uploaded by a client, and commits the value with the
+// final chunk. A chunk sent again, at an offset already received, is ignored. A client may only have a few uploads
+// in progress, and the chunks of all uploads are bounded in size
+func (srv *Server) handleClientWriteChunk(req communication.ClientWriteChunkRequest) interface{} {
+	infoLogger.Printf("handling chunk at offset %d of upload %q", req.Args.Offset, req.Args.UploadId)
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Write.Key); err != nil {
+		return makeErrorResp(err)
+	}
+	chunk, err := communication.DecodeValue(req.Args.Chunk, req.Args.ChunkEncoding)
+	if err != nil {
+		return makeErrorResp(err)
+	}
+
+	id := req.Args.ClientId + "/" + req.Args.UploadId
+	srv.uploads.Lock()
+	now := time.Now()
+	srv.uploads.expire(now)
+	u, ok := srv.uploads.uploadById[id]
+	if !ok {
+		if n := srv.uploads.countOf(req.Args.ClientId); n >= srv.uploads.maxPerClient {
+			srv.uploads.Unlock()
+			return makeFailResp(communication.Unavailable, fmt.Sprintf("client has %d uploads in progress, retry once one of them is done", n))
+		}
+		u = &upload{clientId: req.Args.ClientId}
+	}
+	received := int64(u.value.Len())
+	switch {
+	case req.Args.Offset > received:
+		srv.uploads.Unlock()
+		return makeFailResp(communication.DependencyPending, fmt.Sprintf("chunk at offset %d is ahead of the %d bytes received", req.Args.Offset, received))
+	case req.Args.Offset == received:
+		if limit := uploadLimit(srv.limits.get().maxMessageSize); received+int64(len(chunk)) > limit {
+			srv.uploads.remove(id)
+			srv.uploads.Unlock()
+			return makeFailResp(communication.TooLarge, fmt.Sprintf("value is larger than %d bytes", limit))
+		}
+		if srv.uploads.size+int64(len(chunk)) > srv.uploads.maxSize {
+			srv.uploads.Unlock()
+			return makeFailResp(communication.Unavailable, "the uploads in progress hold too many bytes, retry later")
+		}
+		u.value.WriteString(chunk)
+		srv.uploads.size += int64(len(chunk))
+		received += int64(len(chunk))
+	}
+	u.lastUpdate = now
+	srv.uploads.uploadById[id] = u
+	if req.Args.Final {
+		srv.uploads.remove(id)
+	}
+	srv.uploads.Unlock()
+
+	if req.Args.Final {
+		write := req.Args.Write
+		write.ClientId, write.SessionToken = req.Args.ClientId, req.Args.SessionToken
+		write.Value, write.ValueEncoding = u.value.String(), ""
+		infoLogger.Printf("committing upload %q of %d bytes to %q", req.Args.UploadId, received, write.Key)
+		if err := srv.clientWrite(write); err != nil {
+			return makeErrorResp(err)
+		}
+	}
+
+	return communication.ClientWriteChunkResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "chunk is received",
+		Received:       received,
+	}
+}
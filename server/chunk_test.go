@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"Lab2/communication"
+)
+
+// writeChunk sends a chunk of an upload, returning the response as a generic one, which failures are
+func writeChunk(srv *Server, clientId, uploadId string, offset int64, chunk string) communication.GenericClientResponse {
+	resp := srv.handleClientWriteChunk(communication.ClientWriteChunkRequest{
+		Op: communication.WriteChunk,
+		Args: communication.ClientWriteChunkRequestArgs{
+			ClientId: clientId, UploadId: uploadId, Offset: offset, Chunk: chunk,
+			Write: communication.ClientWriteRequestArgs{Key: "k"},
+		},
+	})
+	if r, ok := resp.(communication.ClientWriteChunkResponse); ok {
+		return communication.GenericClientResponse{Result: r.Result, DetailedResult: r.DetailedResult, ErrorCode: r.ErrorCode}
+	}
+	return resp.(communication.GenericClientResponse)
+}
+
+func TestUploadsInProgressAreBounded(t *testing.T) {
+	srv := New(Config{})
+	for i := 0; i < maxUploadsPerClient; i++ {
+		if r := writeChunk(srv, "c1", string(rune('a'+i)), 0, "chunk"); r.Result != communication.Success {
+			t.Fatalf("upload %d refused: %+v", i, r)
+		}
+	}
+	if r := writeChunk(srv, "c1", "one too many", 0, "chunk"); r.ErrorCode != communication.Unavailable {
+		t.Errorf("upload beyond the uploads of a client: got %+v, want an unavailable error", r)
+	}
+	if r := writeChunk(srv, "c1", "a", 5, "more"); r.Result != communication.Success {
+		t.Errorf("chunk of an upload in progress refused: %+v", r)
+	}
+	if r := writeChunk(srv, "c2", "a", 0, "chunk"); r.Result != communication.Success {
+		t.Errorf("upload of another client refused: %+v", r)
+	}
+
+	srv.uploads.Lock()
+	srv.uploads.maxSize = srv.uploads.size + 3
+	srv.uploads.Unlock()
+	if r := writeChunk(srv, "c3", "a", 0, "chunk"); r.ErrorCode != communication.Unavailable {
+		t.Errorf("chunk beyond the bytes of all uploads: got %+v, want an unavailable error", r)
+	}
+	if r := writeChunk(srv, "c3", "a", 0, "abc"); r.Result != communication.Success {
+		t.Errorf("chunk within the bytes of all uploads refused: %+v", r)
+	}
+}
+
+func TestAbandonedUploadsExpire(t *testing.T) {
+	srv := New(Config{})
+	for _, id := range []string{"abandoned", "active"} {
+		if r := writeChunk(srv, "c", id, 0, "chunk"); r.Result != communication.Success {
+			t.Fatalf("upload refused: %+v", r)
+		}
+	}
+	srv.uploads.Lock()
+	srv.uploads.uploadById["c/abandoned"].lastUpdate = time.Now().Add(-2 * uploadTimeout)
+	srv.uploads.expire(time.Now())
+	_, abandoned := srv.uploads.uploadById["c/abandoned"]
+	_, active := srv.uploads.uploadById["c/active"]
+	size := srv.uploads.size
+	srv.uploads.Unlock()
+	if abandoned || !active || size != int64(len("chunk")) {
+		t.Errorf("after expiry: abandoned upload kept %v, active upload kept %v, %d bytes held", abandoned, active, size)
+	}
+}
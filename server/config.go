@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"Lab2/communication"
+)
+
+// Options run a server from flags and a configuration file, instead of the server commands
+type Options struct {
+	// ConfigFile is the path of a json configuration file, empty if there is none
+	ConfigFile string
+	// The other options override the configuration file if they are set
+	Listen            string
+	Peers             []string
+	StrongKeyPrefixes []string
+	SharedSecret      string
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSCAFile         string
+	DataFile          string
+	ShutdownTimeout   time.Duration
+	CacheOnly         bool
+	// Interactive reads server commands from stdin once the server started, instead of running until a signal
+	Interactive bool
+}
+
+// configFile is the json configuration file of a server, setting what the server commands would
+type configFile struct {
+	Listen            string   `json:"listen"`
+	Peers             []string `json:"peers"`
+	StrongKeyPrefixes []string `json:"strong-key-prefixes"`
+	SharedSecret      string   `json:"shared-secret"`
+	TLS               struct {
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+		CA   string `json:"ca"`
+	} `json:"tls"`
+	Users []struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Grants   []struct {
+			Permission string `json:"permission"`
+			Prefix     string `json:"prefix"`
+		} `json:"grants"`
+	} `json:"users"`
+	DataFile string `json:"data-file"`
+	// ShutdownTimeout is in seconds
+	ShutdownTimeout float64            `json:"shutdown-timeout"`
+	Indexes         []string           `json:"indexes"`
+	CacheOnly       bool               `json:"cache-only"`
+	MaxMemory       int64              `json:"max-memory"`
+	EvictionPolicy  string             `json:"eviction-policy"`
+	Limits          map[string]float64 `json:"limits"`
+}
+
+// Run configures a server from options, starts it and runs it until SIGINT or SIGTERM, or until quit if it is
+// interactive, then stops it gracefully
+func Run(options Options) error {
+	var file configFile
+	if options.ConfigFile != "" {
+		if err := loadConfigFile(options.ConfigFile, &file); err != nil {
+			return err
+		}
+	}
+	if options.Listen != "" {
+		file.Listen = options.Listen
+	}
+	if len(options.Peers) > 0 {
+		file.Peers = options.Peers
+	}
+	if len(options.StrongKeyPrefixes) > 0 {
+		file.StrongKeyPrefixes = options.StrongKeyPrefixes
+	}
+	if options.SharedSecret != "" {
+		file.SharedSecret = options.SharedSecret
+	}
+	if options.TLSCertFile != "" || options.TLSKeyFile != "" || options.TLSCAFile != "" {
+		file.TLS.Cert, file.TLS.Key, file.TLS.CA = options.TLSCertFile, options.TLSKeyFile, options.TLSCAFile
+	}
+	if options.DataFile != "" {
+		file.DataFile = options.DataFile
+	}
+	if options.ShutdownTimeout != 0 {
+		file.ShutdownTimeout = options.ShutdownTimeout.Seconds()
+	}
+	if options.CacheOnly {
+		file.CacheOnly = true
+	}
+	if file.Listen == "" {
+		return fmt.Errorf("no ip:port to listen to, set it with --listen or in the configuration file")
+	}
+
+	config := Config{
+		HostPort:          file.Listen,
+		OtherServers:      file.Peers,
+		StrongKeyPrefixes: file.StrongKeyPrefixes,
+		SharedSecret:      file.SharedSecret,
+		DataFile:          file.DataFile,
+		ShutdownTimeout:   time.Duration(file.ShutdownTimeout * float64(time.Second)),
+		CacheOnly:         file.CacheOnly,
+	}
+	if file.TLS.Cert != "" || file.TLS.Key != "" || file.TLS.CA != "" {
+		tlsConfig, err := communication.LoadTLSConfig(file.TLS.Cert, file.TLS.Key, file.TLS.CA)
+		if err != nil {
+			return err
+		}
+		config.TLSConfig = tlsConfig
+	}
+	srv := New(config)
+	if err := srv.applyConfigFile(file); err != nil {
+		return err
+	}
+	if err := srv.Start(); err != nil {
+		return err
+	}
+
+	if options.Interactive {
+		repl(srv)
+		return nil
+	}
+	waitForSignal()
+	srv.Stop()
+	genericLogger.Printf("%s!", goodbye)
+	return nil
+}
+
+func loadConfigFile(path string, file *configFile) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, file); err != nil {
+		return fmt.Errorf("bad configuration file %q: %w", path, err)
+	}
+	return nil
+}
+
+// applyConfigFile sets the users, indexes, memory budget and limits of the configuration file,
+// as the server commands would
+func (srv *Server) applyConfigFile(file configFile) error {
+	var results []string
+	for _, u := range file.Users {
+		result, err := srv.addUser(u.User, u.Password)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+		for _, g := range u.Grants {
+			result, err := srv.grantPermission(u.User, g.Permission, g.Prefix)
+			if err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+	}
+	for _, path := range file.Indexes {
+		result, err := srv.createIndex(path)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	if file.MaxMemory != 0 || file.EvictionPolicy != "" {
+		policy := file.EvictionPolicy
+		if policy == "" {
+			policy = string(leastRecentlyUsed)
+		}
+		result, err := srv.setMemoryBudget(strconv.FormatInt(file.MaxMemory, 10), policy)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	names := make([]string, 0, len(file.Limits))
+	for name := range file.Limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result, err := srv.setLimit(name, strconv.FormatFloat(file.Limits[name], 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+
+	for _, result := range results {
+		infoLogger.Printf("%s", result)
+	}
+	return nil
+}
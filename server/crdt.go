@@ -0,0 +1,378 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"Lab2/communication"
+	"Lab2/util"
+)
+
+// CRDT values are replicated with their full state. A server receiving a replicated write of a CRDT value merges it
+// with its local state, so that all replicas converge regardless of the order the replicated writes arrive in.
+
+// handleClientIncrement handles client increment or decrement of a PN-counter
+func (srv *Server) handleClientIncrement(req communication.ClientIncrementRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	return srv.updateCrdt(req.Op, req.Args.ClientId, req.Args.Key, communication.PNCounter, func(c *communication.CrdtState, tag string) {
+		entry := c.Counter[srv.selfHostPort]
+		if req.Args.Delta >= 0 {
+			entry.Increments += uint64(req.Args.Delta)
+		} else {
+			// negating the smallest int64 overflows, so the magnitude is computed from the delta plus one
+			entry.Decrements += uint64(-(req.Args.Delta + 1)) + 1
+		}
+		c.Counter[srv.selfHostPort] = entry
+	})
+}
+
+// handleClientSetAdd handles client addition of an element to an OR-set
+func (srv *Server) handleClientSetAdd(req communication.ClientSetElementRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	return srv.updateCrdt(req.Op, req.Args.ClientId, req.Args.Key, communication.ORSet, func(c *communication.CrdtState, tag string) {
+		c.SetAdds[req.Args.Element] = append(c.SetAdds[req.Args.Element], tag)
+	})
+}
+
+// handleClientSetRemove handles client removal of an element from an OR-set,
+// which only removes the additions of the element observed by this server
+func (srv *Server) handleClientSetRemove(req communication.ClientSetElementRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	return srv.updateCrdt(req.Op, req.Args.ClientId, req.Args.Key, communication.ORSet, func(c *communication.CrdtState, tag string) {
+		c.SetRemoves = append(c.SetRemoves, c.SetAdds[req.Args.Element]...)
+		delete(c.SetAdds, req.Args.Element)
+	})
+}
+
+// handleClientRegisterSet handles client write of a multi-value register,
+// which replaces all the values this server has seen
+func (srv *Server) handleClientRegisterSet(req communication.ClientRegisterSetRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	return srv.updateCrdt(req.Op, req.Args.ClientId, req.Args.Key, communication.MVRegister, func(c *communication.CrdtState, tag string) {
+		vv := make(map[string]uint64)
+		for _, rv := range c.Register {
+			for server, ts := range rv.VersionVector {
+				if ts > vv[server] {
+					vv[server] = ts
+				}
+			}
+		}
+		// the write is about to be committed at the next tick of the local lamport's clock
+		vv[srv.selfHostPort] = srv.clock.clock + 1
+		c.Register = []communication.RegisterValue{{Value: req.Args.Value, VersionVector: vv}}
+	})
+}
+
+// handleClientSetMembers handles client read of the elements of an OR-set while updating dependency data
+func (srv *Server) handleClientSetMembers(req communication.ClientSetMembersRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, readPermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	defer func() {
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+	}()
+
+	v, ok := srv.storage.live(req.Args.Key)
+	if !ok {
+		return makeFailResp(communication.NotFound, fmt.Sprintf("key %q does not exist", req.Args.Key))
+	}
+	if v.crdt == nil || v.crdt.Type != communication.ORSet {
+		return makeFailResp(communication.Conflict, fmt.Sprintf("key %q is not a %s", req.Args.Key, communication.ORSet))
+	}
+
+	// update dependency data
+	d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+	srv.maintainer.dependencyByClientId[req.Args.ClientId] = append(d, communication.DependencyData{
+		Key:                    req.Args.Key,
+		OriginalServer:         v.originalServer,
+		LamportsClockTimestamp: v.lamportsClockTimestamp,
+	})
+
+	return communication.ClientSetMembersResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "set members is successful",
+		Key:            req.Args.Key,
+		Members:        setMembers(v.crdt),
+	}
+}
+
+// updateCrdt applies an update to a copy of the CRDT value of the key, then commits and replicates it.
+// The update is given a tag unique to this write
+func (srv *Server) updateCrdt(op, clientId, key string, t communication.CrdtType, update func(c *communication.CrdtState, tag string)) interface{} {
+	if srv.isStrongKey(key) {
+		return makeFailResp(communication.Conflict, fmt.Sprintf("key %q is strongly consistent and cannot hold a CRDT value", key))
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.clock.Lock()
+
+	c := newCrdt(t)
+	if current, ok := srv.storage.live(key); ok {
+		if current.crdt == nil || current.crdt.Type != t {
+			srv.clock.Unlock()
+			srv.maintainer.Unlock()
+			srv.storage.Unlock()
+			return makeFailResp(communication.Conflict, fmt.Sprintf("key %q is not a %s", key, t))
+		}
+		c = copyCrdt(current.crdt)
+	}
+	update(c, fmt.Sprintf("%s@%d", srv.selfHostPort, srv.clock.clock+1))
+	value := renderCrdt(c)
+	srv.writeLocally(communication.ClientWriteRequestArgs{
+		ClientId: clientId,
+		Key:      key,
+		Value:    value,
+	}, c, false)
+
+	return communication.ClientCrdtResponse{
+		Op:             op,
+		Result:         communication.Success,
+		DetailedResult: fmt.Sprintf("%s is successful", op),
+		Key:            key,
+		Value:          value,
+	}
+}
+
+func newCrdt(t communication.CrdtType) *communication.CrdtState {
+	return &communication.CrdtState{
+		Type:    t,
+		Counter: make(map[string]communication.PNCounterEntry),
+		SetAdds: make(map[string][]string),
+	}
+}
+
+// copyCrdt deep copies a CRDT value, since versions kept in the history must not change
+func copyCrdt(c *communication.CrdtState) *communication.CrdtState {
+	cp := newCrdt(c.Type)
+	for server, entry := range c.Counter {
+		cp.Counter[server] = entry
+	}
+	for element, tags := range c.SetAdds {
+		cp.SetAdds[element] = append([]string(nil), tags...)
+	}
+	cp.SetRemoves = append([]string(nil), c.SetRemoves...)
+	for _, rv := range c.Register {
+		vv := make(map[string]uint64, len(rv.VersionVector))
+		for server, ts := range rv.VersionVector {
+			vv[server] = ts
+		}
+		cp.Register = append(cp.Register, communication.RegisterValue{Value: rv.Value, VersionVector: vv})
+	}
+	return cp
+}
+
+// mergeCrdt returns the join of two states of the same CRDT type, which is commutative, associative and idempotent
+func mergeCrdt(a, b *communication.CrdtState) *communication.CrdtState {
+	merged := copyCrdt(a)
+
+	// PN-counter: each server's entry only grows, so take the maximum
+	for server, entry := range b.Counter {
+		m := merged.Counter[server]
+		if entry.Increments > m.Increments {
+			m.Increments = entry.Increments
+		}
+		if entry.Decrements > m.Decrements {
+			m.Decrements = entry.Decrements
+		}
+		merged.Counter[server] = m
+	}
+
+	// OR-set: union the additions and the removals, then drop the removed additions
+	removed := make(map[string]bool)
+	for _, tag := range append(merged.SetRemoves, b.SetRemoves...) {
+		removed[tag] = true
+	}
+	merged.SetRemoves = merged.SetRemoves[:0]
+	for tag := range removed {
+		merged.SetRemoves = append(merged.SetRemoves, tag)
+	}
+	sort.Strings(merged.SetRemoves)
+	for element, tags := range b.SetAdds {
+		merged.SetAdds[element] = append(merged.SetAdds[element], tags...)
+	}
+	for element, tags := range merged.SetAdds {
+		seen := make(map[string]bool)
+		kept := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if !removed[tag] && !seen[tag] {
+				seen[tag] = true
+				kept = append(kept, tag)
+			}
+		}
+		if len(kept) == 0 {
+			delete(merged.SetAdds, element)
+			continue
+		}
+		sort.Strings(kept)
+		merged.SetAdds[element] = kept
+	}
+
+	// MV-register: keep the values not superseded by another one
+	candidates := append(merged.Register, copyCrdt(b).Register...)
+	merged.Register = nil
+	for i, rv := range candidates {
+		superseded := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			if dominates(other.VersionVector, rv.VersionVector) ||
+				(j < i && equalVersionVectors(other.VersionVector, rv.VersionVector)) {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			merged.Register = append(merged.Register, rv)
+		}
+	}
+	sort.Slice(merged.Register, func(i, j int) bool {
+		return merged.Register[i].Value < merged.Register[j].Value
+	})
+	return merged
+}
+
+// The versions of a key holding CRDT values merge, while other versions replace each other, so that replicas converge
+// whatever the order the versions arrive in. The current value of a key is the one the versions of its history make
+// when folded from the oldest to the newest with mergeVersion:
+//   - two live states of the same CRDT type are merged, and the merged state takes the newer of the two versions,
+//     with its expiration, so that the version of the key never goes backwards
+//   - any other version, such as a plain value, a delete or a CRDT value of another type, resets the key:
+//     the states older than the newest such version are dropped
+//
+// A version older than the current one is folded in by mergeOlderVersion, which only needs the history from that
+// version on. A state merged by a replica before it expires, and not by a replica it arrives at after it expired,
+// and a version older than the whole bounded history of a key, are the only cases the replicas may disagree on.
+
+// mergeVersion returns the current version of a key once v, not older than the current version if the key exists,
+// is committed. now is the unix time in nanoseconds the versions are checked for expiration at
+func mergeVersion(current valueOfKey, exists bool, v valueOfKey, now int64) valueOfKey {
+	if !exists || current.crdt == nil || v.crdt == nil || current.crdt.Type != v.crdt.Type ||
+		current.evicted || current.expiredAt(now) || v.expiredAt(now) {
+		return v
+	}
+	merged := v
+	if v.before(current) {
+		merged = current
+	}
+	merged.crdt = mergeCrdt(current.crdt, v.crdt)
+	merged.value = renderCrdt(merged.crdt)
+	return merged
+}
+
+// mergeOlderVersion returns the current version of a key once a version older than the current one is committed.
+// versions is the history of the key from that version on, up to the current one
+func mergeOlderVersion(current valueOfKey, versions []valueOfKey, now int64) valueOfKey {
+	v, newer := versions[0], versions[1:]
+	if v.crdt == nil {
+		if current.crdt == nil {
+			return current
+		}
+		// the states merged into the current one since v must be folded again without the older ones
+		merged := v
+		for _, h := range newer {
+			merged = mergeVersion(merged, true, h, now)
+		}
+		return merged
+	}
+	for _, h := range newer {
+		if h.crdt == nil || h.crdt.Type != v.crdt.Type {
+			// a newer version reset the key
+			return current
+		}
+	}
+	return mergeVersion(current, true, v, now)
+}
+
+// dominates tells if version vector a has seen everything b has, and more
+func dominates(a, b map[string]uint64) bool {
+	for server, ts := range b {
+		if a[server] < ts {
+			return false
+		}
+	}
+	return !equalVersionVectors(a, b)
+}
+
+func equalVersionVectors(a, b map[string]uint64) bool {
+	for server, ts := range a {
+		if b[server] != ts {
+			return false
+		}
+	}
+	for server, ts := range b {
+		if a[server] != ts {
+			return false
+		}
+	}
+	return true
+}
+
+func setMembers(c *communication.CrdtState) []string {
+	members := make([]string, 0, len(c.SetAdds))
+	for element := range c.SetAdds {
+		members = append(members, element)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// renderCrdt turns a CRDT value into the string returned by a read:
+// the total of a counter, or a json array of the elements of a set or the values of a register
+func renderCrdt(c *communication.CrdtState) string {
+	switch c.Type {
+	case communication.PNCounter:
+		var total int64
+		for _, entry := range c.Counter {
+			total += int64(entry.Increments) - int64(entry.Decrements)
+		}
+		return strconv.FormatInt(total, 10)
+	case communication.ORSet:
+		r, _ := json.Marshal(setMembers(c))
+		return string(r)
+	case communication.MVRegister:
+		values := make([]string, 0, len(c.Register))
+		for _, rv := range c.Register {
+			values = append(values, rv.Value)
+		}
+		r, _ := json.Marshal(values)
+		return string(r)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"Lab2/communication"
+)
+
+// crdtSamples returns states of a CRDT type reached by concurrent updates at different servers
+func crdtSamples(t communication.CrdtType) []*communication.CrdtState {
+	a, b, c := newCrdt(t), newCrdt(t), newCrdt(t)
+	switch t {
+	case communication.PNCounter:
+		a.Counter["s1"] = communication.PNCounterEntry{Increments: 3, Decrements: 1}
+		b.Counter["s1"] = communication.PNCounterEntry{Increments: 2}
+		b.Counter["s2"] = communication.PNCounterEntry{Decrements: 4}
+		c.Counter["s3"] = communication.PNCounterEntry{Increments: 5}
+	case communication.ORSet:
+		a.SetAdds["x"] = []string{"s1@1"}
+		a.SetAdds["y"] = []string{"s1@2"}
+		// b observed the addition of x by a, removed it, then added x again
+		b.SetRemoves = []string{"s1@1"}
+		b.SetAdds["x"] = []string{"s2@3"}
+		c.SetAdds["z"] = []string{"s3@1"}
+		c.SetAdds["x"] = []string{"s3@2"}
+	case communication.MVRegister:
+		a.Register = []communication.RegisterValue{{Value: "a", VersionVector: map[string]uint64{"s1": 1}}}
+		b.Register = []communication.RegisterValue{{Value: "b", VersionVector: map[string]uint64{"s2": 1}}}
+		c.Register = []communication.RegisterValue{{Value: "c", VersionVector: map[string]uint64{"s1": 1, "s3": 2}}}
+	}
+	return []*communication.CrdtState{a, b, c}
+}
+
+var crdtTypes = []communication.CrdtType{communication.PNCounter, communication.ORSet, communication.MVRegister}
+
+func TestMergeCrdtIsCommutative(t *testing.T) {
+	for _, typ := range crdtTypes {
+		samples := crdtSamples(typ)
+		for i, a := range samples {
+			for j, b := range samples {
+				ab, ba := mergeCrdt(a, b), mergeCrdt(b, a)
+				if !reflect.DeepEqual(ab, ba) {
+					t.Errorf("%s: merge of %d and %d is %+v, but merge of %d and %d is %+v", typ, i, j, ab, j, i, ba)
+				}
+			}
+		}
+	}
+}
+
+func TestMergeCrdtIsIdempotent(t *testing.T) {
+	for _, typ := range crdtTypes {
+		samples := crdtSamples(typ)
+		for i, a := range samples {
+			if aa, a0 := mergeCrdt(a, a), mergeCrdt(a, newCrdt(typ)); !reflect.DeepEqual(aa, a0) {
+				t.Errorf("%s: merge of %d with itself is %+v, want %+v", typ, i, aa, a0)
+			}
+			for j, b := range samples {
+				ab := mergeCrdt(a, b)
+				if again := mergeCrdt(ab, b); !reflect.DeepEqual(again, ab) {
+					t.Errorf("%s: merging %d again into the merge of %d and %d gives %+v, want %+v", typ, j, i, j, again, ab)
+				}
+			}
+		}
+	}
+}
+
+func TestMergeCrdtIsAssociative(t *testing.T) {
+	for _, typ := range crdtTypes {
+		s := crdtSamples(typ)
+		left := mergeCrdt(mergeCrdt(s[0], s[1]), s[2])
+		right := mergeCrdt(s[0], mergeCrdt(s[1], s[2]))
+		if !reflect.DeepEqual(left, right) {
+			t.Errorf("%s: merge is not associative: %+v and %+v", typ, left, right)
+		}
+	}
+}
+
+func TestMergeCrdtResults(t *testing.T) {
+	want := map[communication.CrdtType]string{
+		// s1 keeps its largest entries 3-1, s2 gives -4, s3 gives 5
+		communication.PNCounter: "3",
+		// the addition of x by a is removed, the ones by b and c are not
+		communication.ORSet: `["x","y","z"]`,
+		// c has seen a but not b
+		communication.MVRegister: `["b","c"]`,
+	}
+	for _, typ := range crdtTypes {
+		s := crdtSamples(typ)
+		if got := renderCrdt(mergeCrdt(mergeCrdt(s[0], s[1]), s[2])); got != want[typ] {
+			t.Errorf("%s: merge of all the samples reads %s, want %s", typ, got, want[typ])
+		}
+	}
+}
+
+// permutations returns all the orders of the indexes 0 to n-1
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{nil}
+	}
+	var all [][]int
+	for _, p := range permutations(n - 1) {
+		for i := 0; i <= len(p); i++ {
+			q := append(append(append([]int(nil), p[:i]...), n-1), p[i:]...)
+			all = append(all, q)
+		}
+	}
+	return all
+}
+
+func TestReplicatedWritesConvergeWhateverTheOrder(t *testing.T) {
+	crdtWrite := func(server string, clock uint64, c *communication.CrdtState) communication.ServerReplicatedWriteRequestArgs {
+		value, encoding := communication.EncodeValue(renderCrdt(c))
+		return communication.ServerReplicatedWriteRequestArgs{
+			Key: "k", Value: value, ValueEncoding: encoding, OriginalServer: server, Clock: clock, Crdt: c,
+		}
+	}
+	counters, sets := crdtSamples(communication.PNCounter), crdtSamples(communication.ORSet)
+	cases := map[string][]communication.ServerReplicatedWriteRequestArgs{
+		"counters": {
+			crdtWrite("s1", 1, counters[0]), crdtWrite("s2", 2, counters[1]), crdtWrite("s3", 3, counters[2]),
+		},
+		"counters and a newer plain write": {
+			crdtWrite("s1", 1, counters[0]), crdtWrite("s2", 3, counters[1]),
+			{Key: "k", Value: "plain", OriginalServer: "s3", Clock: 2},
+			{Key: "k", Value: "newer", OriginalServer: "s3", Clock: 4},
+		},
+		"sets and a delete": {
+			crdtWrite("s1", 1, sets[0]), crdtWrite("s2", 3, sets[1]), crdtWrite("s3", 5, sets[2]),
+			{Key: "k", OriginalServer: "s2", Clock: 4, Deleted: true},
+		},
+		"counter and set": {
+			crdtWrite("s1", 2, counters[0]), crdtWrite("s2", 2, sets[0]),
+		},
+	}
+	for name, writes := range cases {
+		var want valueOfKey
+		for i, order := range permutations(len(writes)) {
+			srv := New(Config{})
+			for _, w := range order {
+				srv.commitReplicatedWrite(writes[w])
+			}
+			got := srv.storage.storage["k"]
+			if i == 0 {
+				want = got
+				continue
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: in order %v the key is %s, in the first order it is %s", name, order, describe(got), describe(want))
+			}
+		}
+	}
+}
+
+func describe(v valueOfKey) string {
+	return fmt.Sprintf("%q at (%q, %d) deleted=%v", v.value, v.originalServer, v.lamportsClockTimestamp, v.deleted)
+}
+
+func TestDecrementBySmallestDelta(t *testing.T) {
+	srv := New(Config{})
+	for _, delta := range []int64{math.MinInt64, -1} {
+		r := srv.handleClientIncrement(communication.ClientIncrementRequest{
+			Op:   communication.Increment,
+			Args: communication.ClientIncrementRequestArgs{Key: "k", Delta: delta},
+		}).(communication.ClientCrdtResponse)
+		if r.Result != communication.Success {
+			t.Fatalf("decrement by %d failed: %+v", delta, r)
+		}
+	}
+	if entry := srv.storage.storage["k"].crdt.Counter[srv.selfHostPort]; entry.Increments != 0 || entry.Decrements != 1<<63+1 {
+		t.Errorf("counter entry %+v after decrements by %d and 1, want %d decrements", entry, int64(math.MinInt64), uint64(1<<63+1))
+	}
+}
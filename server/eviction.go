@@ -0,0 +1,291 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// evictionPolicy tells which values are evicted first when the memory budget is exceeded
+type evictionPolicy string
+
+const (
+	// leastRecentlyUsed evicts the values of the keys accessed the longest time ago
+	leastRecentlyUsed evictionPolicy = "lru"
+	// leastFrequentlyUsed evicts the values of the keys accessed the fewest times
+	leastFrequentlyUsed evictionPolicy = "lfu"
+)
+
+// evictionSamples is the number of keys sampled to pick the one to evict, which approximates the policy
+// without keeping the keys ordered by access
+const evictionSamples = 16
+
+// keyAccess records the accesses to a key, to rank it under the eviction policy
+type keyAccess struct {
+	// lastAccess is the tick of storage's access counter at the latest access
+	lastAccess uint64
+	hits       uint64
+}
+
+// setCacheOnly runs the server as a cache, which drops the values evicted to fit in its memory budget
+func (srv *Server) setCacheOnly() (string, error) {
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+	srv.config.CacheOnly = true
+	return "the server runs as a cache, the values evicted to fit in its memory budget are lost", nil
+}
+
+// setMemoryBudget bounds the bytes taken by the keys, values and histories in storage, evicting values as needed.
+// A budget of 0 means no limit. A server running as a cache drops the values evicted for good, any other server
+// writes them to disk and reads them from there
+func (srv *Server) setMemoryBudget(bytes, policy string) (string, error) {
+	budget, err := strconv.ParseInt(bytes, 10, 64)
+	if err != nil || budget < 0 {
+		return "", fmt.Errorf("bad memory budget %q: must be a non-negative number of bytes", bytes)
+	}
+	p := evictionPolicy(policy)
+	if p != leastRecentlyUsed && p != leastFrequentlyUsed {
+		return "", fmt.Errorf("unknown eviction policy %q, must be %q or %q", policy, leastRecentlyUsed, leastFrequentlyUsed)
+	}
+
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+
+	if budget > 0 && !srv.config.CacheOnly && srv.storage.spillDir == "" {
+		dir, err := srv.makeSpillDir()
+		if err != nil {
+			return "", fmt.Errorf("cannot make the directory the evicted values are written to: %w", err)
+		}
+		srv.storage.spillDir = dir
+	}
+	srv.storage.maxMemory = budget
+	srv.storage.policy = p
+	srv.evictIfNeeded("")
+	return srv.storage.memoryUsage(), nil
+}
+
+// makeSpillDir makes an empty directory for the evicted values, next to the data file if there is one.
+// The files left by a server which did not stop are removed, the data file holds the values as of its last stop
+func (srv *Server) makeSpillDir() (string, error) {
+	if srv.config.DataFile == "" {
+		return ioutil.TempDir("", "lab2-spill")
+	}
+	dir := srv.config.DataFile + ".spill"
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// removeSpillDir removes the evicted values written to disk, once the data file holds them.
+// The caller must hold the lock of the storage
+func (s *kvStorage) removeSpillDir() {
+	if s.spillDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.spillDir); err != nil {
+		errorLogger.Printf("failed to remove the evicted values in %q: %v", s.spillDir, err)
+	}
+}
+
+// spillPath returns the file the value and history of an evicted key are written to
+func (s *kvStorage) spillPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.spillDir, hex.EncodeToString(sum[:]))
+}
+
+// spill writes the value and history of a key to disk. The caller must hold the lock of the storage
+func (s *kvStorage) spill(key string) error {
+	m, err := json.Marshal(makeSnapshotKey(s.storage[key], s.history[key]))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.spillPath(key), m, 0600)
+}
+
+// readSpilled reads the value and history of a key written to disk. The caller must hold the lock of the storage
+func (s *kvStorage) readSpilled(key string) (valueOfKey, []valueOfKey, error) {
+	m, err := ioutil.ReadFile(s.spillPath(key))
+	if err != nil {
+		return valueOfKey{}, nil, err
+	}
+	var saved snapshotKey
+	if err := json.Unmarshal(m, &saved); err != nil {
+		return valueOfKey{}, nil, err
+	}
+	return saved.versions()
+}
+
+// unspill brings the value and history of a key written to disk back to memory, before a write changes them.
+// A value which cannot be read back is lost, and the key reads as evicted. The caller must hold the lock of the storage
+func (s *kvStorage) unspill(key string) {
+	v, ok := s.storage[key]
+	if !ok || !v.spilled {
+		return
+	}
+	before := s.footprint(key)
+	current, history, err := s.readSpilled(key)
+	if err != nil {
+		errorLogger.Printf("failed to read the value of %q from disk: %v", key, err)
+		v.spilled, v.evicted = false, true
+		s.storage[key] = v
+		return
+	}
+	s.storage[key] = current
+	if history != nil {
+		s.history[key] = history
+	}
+	s.usedMemory += s.footprint(key) - before
+	s.removeSpilled(key)
+}
+
+// removeSpilled removes the value of a key written to disk. The caller must hold the lock of the storage
+func (s *kvStorage) removeSpilled(key string) {
+	if err := os.Remove(s.spillPath(key)); err != nil && !os.IsNotExist(err) {
+		errorLogger.Printf("failed to remove the value of %q from disk: %v", key, err)
+	}
+}
+
+// versionsOf returns the retained versions of a key, read from disk if its value was written there.
+// The caller must hold the lock of the storage
+func (s *kvStorage) versionsOf(key string) ([]valueOfKey, bool) {
+	if v, ok := s.storage[key]; ok && v.spilled {
+		_, history, err := s.readSpilled(key)
+		if err == nil {
+			return history, history != nil
+		}
+		errorLogger.Printf("failed to read the versions of %q from disk: %v", key, err)
+	}
+	versions, ok := s.history[key]
+	return versions, ok
+}
+
+// reportMemoryUsage tells the memory taken by storage against the budget
+func (srv *Server) reportMemoryUsage() string {
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+
+	return srv.storage.memoryUsage()
+}
+
+// the caller must hold the lock of the storage
+func (s *kvStorage) memoryUsage() string {
+	if s.maxMemory == 0 {
+		return fmt.Sprintf("using %d bytes with no memory budget, %d values evicted so far", s.usedMemory, s.evictions)
+	}
+	return fmt.Sprintf("using %d of %d bytes, evicting by %s, %d values evicted so far",
+		s.usedMemory, s.maxMemory, s.policy, s.evictions)
+}
+
+// footprint approximates the bytes taken by a key and its history, which shares the bytes of the value.
+// The caller must hold the lock of the storage
+func (s *kvStorage) footprint(key string) int64 {
+	if _, ok := s.storage[key]; !ok {
+		return 0
+	}
+	n := int64(len(key))
+	for _, version := range s.history[key] {
+		n += int64(len(version.value))
+	}
+	return n
+}
+
+// touch records an access to a key. The caller must hold the lock of the storage
+func (s *kvStorage) touch(key string) {
+	if s.accessByKey == nil {
+		return
+	}
+	s.accessTick++
+	a := s.accessByKey[key]
+	a.lastAccess = s.accessTick
+	a.hits++
+	s.accessByKey[key] = a
+}
+
+// colder tells if key a should be evicted before key b under the eviction policy
+func (s *kvStorage) colder(a, b string) bool {
+	accessA, accessB := s.accessByKey[a], s.accessByKey[b]
+	if s.policy == leastFrequentlyUsed && accessA.hits != accessB.hits {
+		return accessA.hits < accessB.hits
+	}
+	return accessA.lastAccess < accessB.lastAccess
+}
+
+// evictable tells if the value of a key can be evicted. CRDT values cannot, since a replicated write merges with
+// the local state, and neither can strongly consistent values, which the consensus group applied in order
+func (srv *Server) evictable(key string, v valueOfKey) bool {
+	s := &srv.storage
+	return !v.evicted && !v.spilled && (v.value != "" || len(s.history[key]) > 0) && v.crdt == nil && !srv.isStrongKey(key)
+}
+
+// evictIfNeeded evicts values, other than the one of key except, until storage fits in the memory budget.
+// An evicted key keeps its version, so that replicated writes depending on it can still be committed.
+// On a server running as a cache it is no longer read until it is written again, on any other server it is
+// read from disk.
+// The caller must hold the lock of the storage
+func (srv *Server) evictIfNeeded(except string) {
+	s := &srv.storage
+	for s.maxMemory > 0 && s.usedMemory > s.maxMemory {
+		victim, sampled := "", 0
+		// the iteration order of a map is random, so the first evictable keys are a random sample
+		for k, v := range s.storage {
+			if k == except || !srv.evictable(k, v) {
+				continue
+			}
+			if victim == "" || s.colder(k, victim) {
+				victim = k
+			}
+			if sampled++; sampled == evictionSamples {
+				break
+			}
+		}
+		if victim == "" {
+			errorLogger.Printf("memory budget of %d bytes exceeded with no value left to evict", s.maxMemory)
+			return
+		}
+		if !srv.evict(victim) {
+			return
+		}
+	}
+}
+
+// evict drops the value and history of a key from memory while retaining its latest version, writing them to disk
+// unless the server runs as a cache. It tells if the value was evicted.
+// The caller must hold the lock of the storage
+func (srv *Server) evict(key string) bool {
+	s := &srv.storage
+	spill := !srv.config.CacheOnly && s.spillDir != ""
+	if spill {
+		if err := s.spill(key); err != nil {
+			errorLogger.Printf("failed to write the value of %q to disk, evicting no more values: %v", key, err)
+			return false
+		}
+	}
+	v := s.storage[key]
+	before := s.footprint(key)
+	s.storage[key] = valueOfKey{
+		originalServer:         v.originalServer,
+		lamportsClockTimestamp: v.lamportsClockTimestamp,
+		expiresAt:              v.expiresAt,
+		deleted:                v.deleted,
+		evicted:                !spill,
+		spilled:                spill,
+	}
+	delete(s.history, key)
+	delete(s.accessByKey, key)
+	s.usedMemory += s.footprint(key) - before
+	s.evictions++
+	if spill {
+		// the value is still read, from disk, so the key stays indexed
+		infoLogger.Printf("wrote the value of %q written by %q at %d to disk", key, v.originalServer, v.lamportsClockTimestamp)
+		return true
+	}
+	srv.indexes.update(key, "")
+	infoLogger.Printf("evicted the value of %q written by %q at %d", key, v.originalServer, v.lamportsClockTimestamp)
+	return true
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"Lab2/communication"
+)
+
+func TestEvictedValuesAreWrittenToDiskAndReadBack(t *testing.T) {
+	config := Config{HostPort: freeHostPorts(t, 1)[0], DataFile: filepath.Join(t.TempDir(), "data")}
+	srv := startServer(t, config)
+	c := connect(t, srv)
+	ctx := context.Background()
+	value := strings.Repeat("v", 100)
+	if err := c.Put(ctx, "spilled", value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.setMemoryBudget("150", string(leastRecentlyUsed)); err != nil {
+		t.Fatalf("a memory budget was refused on a server not running as a cache: %v", err)
+	}
+	if err := c.Put(ctx, "kept", value); err != nil {
+		t.Fatal(err)
+	}
+	srv.storage.Lock()
+	spilled := srv.storage.storage["spilled"]
+	used := srv.storage.usedMemory
+	srv.storage.Unlock()
+	if !spilled.spilled || used > 150 {
+		t.Fatalf("the value of the coldest key was not written to disk, %d bytes used", used)
+	}
+	if files, err := ioutil.ReadDir(config.DataFile + ".spill"); err != nil || len(files) != 1 {
+		t.Fatalf("got %d files written next to the data file and %v, want the evicted value", len(files), err)
+	}
+
+	if v, err := c.Get(ctx, "spilled"); err != nil || v.Value != value {
+		t.Fatalf("read of a value written to disk: got %+v and %v, want %q", v, err, value)
+	}
+	if err := c.Put(ctx, "spilled", "newer"); err != nil {
+		t.Fatal(err)
+	}
+	h := srv.handleClientHistory(communication.ClientHistoryRequest{
+		Op:   communication.History,
+		Args: communication.ClientHistoryRequestArgs{Key: "spilled"},
+	}).(communication.ClientHistoryResponse)
+	if len(h.Versions) != 2 || h.Versions[0].Value != value || h.Versions[1].Value != "newer" {
+		t.Errorf("history of a key written again after its value was written to disk: %+v", h.Versions)
+	}
+
+	// the data file holds every value, whether it was in memory or on disk
+	srv.Stop()
+	saved := readSnapshot(t, config.DataFile)
+	for key, want := range map[string]string{"spilled": "newer", "kept": value} {
+		if k := saved.Keys[key]; k.Current.Value != want || k.Current.Evicted {
+			t.Errorf("saved %q as %+v, want %q", key, k.Current, want)
+		}
+	}
+	if _, err := os.Stat(config.DataFile + ".spill"); !os.IsNotExist(err) {
+		t.Errorf("the values written to disk were not removed once saved: %v", err)
+	}
+}
+
+func TestMemoryBudgetWithoutDataFile(t *testing.T) {
+	srv := New(Config{})
+	if _, err := srv.setMemoryBudget("1024", string(leastFrequentlyUsed)); err != nil {
+		t.Fatalf("a memory budget was refused on a server without data file: %v", err)
+	}
+	defer srv.storage.removeSpillDir()
+	if srv.storage.spillDir == "" {
+		t.Errorf("no directory for the evicted values")
+	}
+
+	cache := New(Config{CacheOnly: true})
+	if _, err := cache.setMemoryBudget("1024", string(leastRecentlyUsed)); err != nil {
+		t.Fatal(err)
+	}
+	if cache.storage.spillDir != "" {
+		t.Errorf("a server running as a cache writes its evicted values to %q", cache.storage.spillDir)
+	}
+}
+
+func TestEvictedKeysStillExist(t *testing.T) {
+	srv := startServer(t, Config{HostPort: freeHostPorts(t, 1)[0], CacheOnly: true})
+	c := connect(t, srv)
+	ctx := context.Background()
+	value := strings.Repeat("v", 100)
+	if err := c.Put(ctx, "evicted", value); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.setMemoryBudget("150", string(leastRecentlyUsed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "kept", value); err != nil {
+		t.Fatal(err)
+	}
+	srv.storage.Lock()
+	evicted := srv.storage.storage["evicted"]
+	srv.storage.Unlock()
+	if !evicted.evicted {
+		t.Fatalf("the value of the coldest key was not evicted")
+	}
+
+	if _, err := c.Get(ctx, "evicted"); !errors.Is(err, communication.ErrEvicted) {
+		t.Errorf("read of an evicted key: got %v, want an evicted error", err)
+	}
+	if _, err := c.Get(ctx, "absent"); !errors.Is(err, communication.ErrNotFound) {
+		t.Errorf("read of an absent key: got %v, want a not found error", err)
+	}
+
+	r := srv.handleClientSetIfAbsent(communication.ClientSetIfAbsentRequest{
+		Op:   communication.SetIfAbsent,
+		Args: communication.ClientSetIfAbsentRequestArgs{Key: "evicted", Value: "overwritten"},
+	}).(communication.ClientConditionalWriteResponse)
+	if r.ErrorCode != communication.Conflict || r.CurrentVersion == nil ||
+		r.CurrentVersion.LamportsClockTimestamp != evicted.lamportsClockTimestamp {
+		t.Errorf("set-if-absent of an evicted key: got %+v, want a conflict at its version", r)
+	}
+
+	r = srv.handleClientCompareAndSet(communication.ClientCompareAndSetRequest{
+		Op: communication.CompareAndSet,
+		Args: communication.ClientCompareAndSetRequestArgs{
+			Key: "evicted", Value: "swapped",
+			ExpectedOriginalServer:         evicted.originalServer,
+			ExpectedLamportsClockTimestamp: evicted.lamportsClockTimestamp,
+		},
+	}).(communication.ClientConditionalWriteResponse)
+	if r.Result != communication.Success {
+		t.Errorf("compare-and-set of an evicted key at its version: got %+v, want a success", r)
+	}
+}
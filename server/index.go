@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"Lab2/communication"
+	"Lab2/util"
+)
+
+// Secondary indexes map the field at a json path inside values to the keys holding them.
+// They are maintained on every commit, so a query sees exactly the writes committed at this server.
+
+type secondaryIndexes struct {
+	// keysByField maps a json path, then the field at the path, to the keys
+	keysByField map[string]map[string]map[string]struct{}
+	// fieldByKey maps a json path, then a key, to the field indexed for the key
+	fieldByKey map[string]map[string]string
+	sync.Mutex
+}
+
+// createIndex declares a secondary index on a json path, such as "address.city" or "tags.0",
+// and indexes the values already stored
+func (srv *Server) createIndex(path string) (string, error) {
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+	srv.indexes.Lock()
+	defer srv.indexes.Unlock()
+
+	if _, ok := srv.indexes.keysByField[path]; ok {
+		return "", fmt.Errorf("index on %q already exists", path)
+	}
+	srv.indexes.keysByField[path] = make(map[string]map[string]struct{})
+	srv.indexes.fieldByKey[path] = make(map[string]string)
+	for k, v := range srv.storage.storage {
+		if v.spilled {
+			if spilled, _, err := srv.storage.readSpilled(k); err == nil {
+				v = spilled
+			}
+		}
+		srv.indexes.updateLocked(path, k, v.value)
+	}
+	return fmt.Sprintf("created index on %q", path), nil
+}
+
+// update reindexes a key after a commit. The caller must hold the lock of storage
+func (x *secondaryIndexes) update(key, value string) {
+	x.Lock()
+	defer x.Unlock()
+
+	for path := range x.keysByField {
+		x.updateLocked(path, key, value)
+	}
+}
+
+// the caller must hold the lock of the indexes
+func (x *secondaryIndexes) updateLocked(path, key, value string) {
+	if old, ok := x.fieldByKey[path][key]; ok {
+		delete(x.keysByField[path][old], key)
+		if len(x.keysByField[path][old]) == 0 {
+			delete(x.keysByField[path], old)
+		}
+		delete(x.fieldByKey[path], key)
+	}
+
+	field, ok := fieldAtPath(value, path)
+	if !ok {
+		return
+	}
+	if _, ok := x.keysByField[path][field]; !ok {
+		x.keysByField[path][field] = make(map[string]struct{})
+	}
+	x.keysByField[path][field][key] = struct{}{}
+	x.fieldByKey[path][key] = field
+}
+
+// fieldAtPath extracts the field at a dotted json path of a value. A string field is returned as is,
+// any other field as json
+func fieldAtPath(value, path string) (string, bool) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return "", false
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[segment]
+			if !ok {
+				return "", false
+			}
+			doc = child
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			doc = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	if str, ok := doc.(string); ok {
+		return str, true
+	}
+	field, _ := json.Marshal(doc)
+	return string(field), true
+}
+
+// handleClientQuery handles client lookup of the keys whose indexed field equals a value,
+// while updating dependency data with every key found
+func (srv *Server) handleClientQuery(req communication.ClientQueryRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if _, err := srv.sessionUser(req.Args.SessionToken); err != nil {
+		return makeErrorResp(err)
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.indexes.Lock()
+	defer func() {
+		srv.indexes.Unlock()
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+	}()
+
+	byField, ok := srv.indexes.keysByField[req.Args.Path]
+	if !ok {
+		return makeFailResp(communication.NotFound, fmt.Sprintf("there is no index on %q", req.Args.Path))
+	}
+	keys := make([]string, 0, len(byField[req.Args.Value]))
+	for k := range byField[req.Args.Value] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]communication.KeyValue, 0, len(keys))
+	d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+	for _, k := range keys {
+		v, ok := srv.storage.live(k)
+		// keys the user may not read are left out
+		if !ok || srv.authorize(req.Args.SessionToken, readPermission, k) != nil {
+			continue
+		}
+		entries = append(entries, makeKeyValue(k, v))
+		d = append(d, communication.DependencyData{
+			Key:                    k,
+			OriginalServer:         v.originalServer,
+			LamportsClockTimestamp: v.lamportsClockTimestamp,
+		})
+	}
+	srv.maintainer.dependencyByClientId[req.Args.ClientId] = d
+
+	return communication.ClientQueryResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "query is successful",
+		Entries:        entries,
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Lab2/communication"
+)
+
+// names of the limits, as given to the limit command
+const (
+	maxMessageSizeLimit = "max-message-size"
+	readTimeoutLimit    = "read-timeout"
+	idleTimeoutLimit    = "idle-timeout"
+	writeTimeoutLimit   = "write-timeout"
+	maxConnectionsLimit = "max-connections"
+	rateLimit           = "rate"
+	burstLimit          = "burst"
+)
+
+// maxRateLimitedClients bounds the number of token buckets kept, the full ones are dropped beyond it
+const maxRateLimitedClients = 10000
+
+// limitSettings bound the resources a connection may take. A zero timeout, connection count or rate means no limit
+type limitSettings struct {
+	// maxMessageSize bounds the size of a request
+	maxMessageSize int
+	// readTimeout bounds the time taken to receive a request once it has started, and idleTimeout the time
+	// a framed connection may wait for its next request
+	readTimeout  time.Duration
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	// maxConnections bounds the number of connections served at once
+	maxConnections int
+	// rate is the number of requests per second a client may send on average, and burst the number it may send
+	// at once. Clients are told apart by their user, or else by their address. Other servers are not limited
+	rate  float64
+	burst int
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type connectionLimits struct {
+	settings          limitSettings
+	activeConnections int
+	bucketByClient    map[string]*tokenBucket
+	sync.Mutex
+}
+
+// defaultLimitSettings are the limits of a new server
+var defaultLimitSettings = limitSettings{
+	maxMessageSize: 16 << 20,
+	readTimeout:    30 * time.Second,
+	writeTimeout:   30 * time.Second,
+	maxConnections: 1024,
+	burst:          100,
+}
+
+func (l *connectionLimits) get() limitSettings {
+	l.Lock()
+	defer l.Unlock()
+	return l.settings
+}
+
+// acquireConnection counts a new connection, unless there are already as many as allowed
+func (l *connectionLimits) acquireConnection() bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.settings.maxConnections > 0 && l.activeConnections >= l.settings.maxConnections {
+		return false
+	}
+	l.activeConnections++
+	return true
+}
+
+func (l *connectionLimits) releaseConnection() {
+	l.Lock()
+	l.activeConnections--
+	l.Unlock()
+}
+
+// allow takes a token from the bucket of a client, failing if it is empty
+func (l *connectionLimits) allow(client string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.settings.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	burst := float64(l.settings.burst)
+	if burst < 1 {
+		burst = 1
+	}
+	b, ok := l.bucketByClient[client]
+	if !ok {
+		if len(l.bucketByClient) >= maxRateLimitedClients {
+			l.dropFullBuckets(now, burst)
+		}
+		b = &tokenBucket{tokens: burst, lastRefill: now}
+		l.bucketByClient[client] = b
+	}
+	b.tokens += now.Sub(b.lastRefill).Seconds() * l.settings.rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.lastRefill = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// dropFullBuckets forgets the clients that have not sent requests for long enough for their bucket to be full.
+// The caller must hold the lock of limits
+func (l *connectionLimits) dropFullBuckets(now time.Time, burst float64) {
+	for client, b := range l.bucketByClient {
+		if b.tokens+now.Sub(b.lastRefill).Seconds()*l.settings.rate >= burst {
+			delete(l.bucketByClient, client)
+		}
+	}
+}
+
+// setLimit changes a limit, which applies to the connections and requests served from then on
+func (srv *Server) setLimit(name, value string) (string, error) {
+	srv.limits.Lock()
+	defer srv.limits.Unlock()
+
+	s := &srv.limits.settings
+	switch name {
+	case maxMessageSizeLimit, maxConnectionsLimit, burstLimit:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("bad %s %q, must be a non-negative integer", name, value)
+		}
+		switch name {
+		case maxMessageSizeLimit:
+			if n == 0 || n > communication.MaxFrameSize {
+				return "", fmt.Errorf("%s must be between 1 and %d bytes", name, communication.MaxFrameSize)
+			}
+			s.maxMessageSize = n
+		case maxConnectionsLimit:
+			s.maxConnections = n
+		case burstLimit:
+			s.burst = n
+		}
+	case readTimeoutLimit, idleTimeoutLimit, writeTimeoutLimit, rateLimit:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 {
+			return "", fmt.Errorf("bad %s %q, must be a non-negative number", name, value)
+		}
+		d := time.Duration(f * float64(time.Second))
+		switch name {
+		case readTimeoutLimit:
+			s.readTimeout = d
+		case idleTimeoutLimit:
+			s.idleTimeout = d
+		case writeTimeoutLimit:
+			s.writeTimeout = d
+		case rateLimit:
+			s.rate = f
+			srv.limits.bucketByClient = make(map[string]*tokenBucket)
+		}
+	default:
+		return "", fmt.Errorf("unknown limit %q", name)
+	}
+	return fmt.Sprintf("%s is now %s", name, value), nil
+}
+
+// reportLimits lists the limits, and the number of connections being served
+func (srv *Server) reportLimits() string {
+	srv.limits.Lock()
+	defer srv.limits.Unlock()
+
+	s := srv.limits.settings
+	orNone := func(v interface{}, zero bool) string {
+		if zero {
+			return "none"
+		}
+		return fmt.Sprint(v)
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("%s: %d bytes", maxMessageSizeLimit, s.maxMessageSize),
+		fmt.Sprintf("%s: %s", readTimeoutLimit, orNone(s.readTimeout, s.readTimeout == 0)),
+		fmt.Sprintf("%s: %s", idleTimeoutLimit, orNone(s.idleTimeout, s.idleTimeout == 0)),
+		fmt.Sprintf("%s: %s", writeTimeoutLimit, orNone(s.writeTimeout, s.writeTimeout == 0)),
+		fmt.Sprintf("%s: %s, %d being served", maxConnectionsLimit, orNone(s.maxConnections, s.maxConnections == 0), srv.limits.activeConnections),
+		fmt.Sprintf("%s: %s requests per second per client", rateLimit, orNone(s.rate, s.rate == 0)),
+		fmt.Sprintf("%s: %d requests", burstLimit, s.burst),
+	}, "\n")
+}
+
+// setReadDeadline sets the deadline of the next read of a connection, or clears it if timeout is 0
+func setReadDeadline(conn net.Conn, timeout time.Duration) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = conn.SetReadDeadline(deadline)
+}
+
+// deadlineConn sets the write deadline of a connection before every write, so that a client that stops reading,
+// such as the consumer of a watch, cannot block the server forever
+type deadlineConn struct {
+	net.Conn
+	limits *connectionLimits
+}
+
+func (c deadlineConn) Write(b []byte) (int, error) {
+	if timeout := c.limits.get().writeTimeout; timeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// rateLimitKey identifies the client sending a request, by its user if clients are authenticated, or else by its
+// address. The id of a client is not used since a client may choose any
+func (srv *Server) rateLimitKey(conn net.Conn, decode func(req interface{}) error) string {
+	var req struct {
+		Args struct {
+			SessionToken string
+		}
+	}
+	if err := decode(&req); err == nil && req.Args.SessionToken != "" {
+		if user, err := srv.sessionUser(req.Args.SessionToken); err == nil && user != "" {
+			return "user " + user
+		}
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		return host
+	}
+	return conn.RemoteAddr().String()
+}
+
+// limitRequest returns the fail response to a request exceeding the rate of its client, nil if it may be served
+func (srv *Server) limitRequest(conn net.Conn, op string, decode func(req interface{}) error) interface{} {
+	if serverOps[op] || srv.limits.get().rate <= 0 {
+		return nil
+	}
+	if !srv.limits.allow(srv.rateLimitKey(conn, decode)) {
+		return makeFailResp(communication.RateLimited, fmt.Sprintf("rate limit of %g requests per second exceeded, retry later", srv.limits.get().rate))
+	}
+	return nil
+}
+
+// rejectConnection tells a client there are too many connections, then closes its connection
+func (srv *Server) rejectConnection(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	c := deadlineConn{conn, &srv.limits}
+	m, _ := json.Marshal(makeFailResp(communication.Unavailable, "too many connections, retry later"))
+	_, _ = c.Write(m)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"Lab2/client"
+	"Lab2/communication"
+)
+
+func TestTokenBucketRefillsAtTheRate(t *testing.T) {
+	l := connectionLimits{settings: limitSettings{rate: 1, burst: 3}, bucketByClient: map[string]*tokenBucket{}}
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("request %d of a burst of 3 refused", i+1)
+		}
+	}
+	if l.allow("a") {
+		t.Fatalf("a request beyond the burst was allowed")
+	}
+	if !l.allow("b") {
+		t.Fatalf("a client was refused for the requests of another")
+	}
+
+	// a second at a rate of one request per second refills one token
+	l.bucketByClient["a"].lastRefill = l.bucketByClient["a"].lastRefill.Add(-time.Second)
+	if !l.allow("a") {
+		t.Fatalf("a request was refused once the bucket refilled")
+	}
+	if l.allow("a") {
+		t.Fatalf("the bucket refilled more than the rate")
+	}
+
+	// a bucket never holds more than the burst
+	l.bucketByClient["a"].lastRefill = l.bucketByClient["a"].lastRefill.Add(-time.Hour)
+	allowed := 0
+	for l.allow("a") {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("%d requests allowed after an hour, want the burst of 3", allowed)
+	}
+}
+
+func TestRequestsBeyondTheRateAreRefused(t *testing.T) {
+	srv := startServer(t, Config{HostPort: freeHostPorts(t, 1)[0]})
+	for name, value := range map[string]string{rateLimit: "0.001", burstLimit: "5"} {
+		if _, err := srv.setLimit(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := connect(t, srv)
+
+	var err error
+	succeeded := 0
+	for i := 0; i < 10 && err == nil; i++ {
+		if err = c.Put(context.Background(), "k", "v"); err == nil {
+			succeeded++
+		}
+	}
+	if !errors.Is(err, communication.ErrRateLimited) {
+		t.Fatalf("got %v once the bucket is empty, want a rate limited error", err)
+	}
+	if succeeded > 5 {
+		t.Errorf("%d requests succeeded, more than the burst of 5", succeeded)
+	}
+}
+
+func TestConnectionsBeyondTheMaximumAreRejected(t *testing.T) {
+	srv := startServer(t, Config{HostPort: freeHostPorts(t, 1)[0]})
+	if _, err := srv.setLimit(maxConnectionsLimit, "1"); err != nil {
+		t.Fatal(err)
+	}
+	held, err := net.Dial("tcp", srv.config.HostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	conn, err := net.Dial("tcp", srv.config.HostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp communication.GenericClientResponse
+	if err := json.Unmarshal(m, &resp); err != nil {
+		t.Fatalf("bad rejection %q: %v", m, err)
+	}
+	if resp.Result != communication.Fail || resp.ErrorCode != communication.Unavailable {
+		t.Errorf("got %+v, want an unavailable error", resp)
+	}
+}
+
+func TestCompressedRequestsAreBoundedOnceDecompressed(t *testing.T) {
+	srv := startServer(t, Config{HostPort: freeHostPorts(t, 1)[0]})
+	if _, err := srv.setLimit(maxMessageSizeLimit, "4096"); err != nil {
+		t.Fatal(err)
+	}
+	// the value is not written in chunks, and compresses to a frame well within the limit
+	c := client.New(client.Config{ChunkSize: 8 << 20})
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.Connect(ctx, srv.config.HostPort, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put(ctx, "k", strings.Repeat("a", 3<<20)); !errors.Is(err, communication.ErrTooLarge) {
+		t.Fatalf("got %v writing a value larger than the limit once decompressed, want a too large error", err)
+	}
+	if _, ok := currentValue(srv, "k"); ok {
+		t.Fatalf("a value larger than the limit was written")
+	}
+	// the connection is still usable
+	if err := c.Put(ctx, "small", "v"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicatedWriteTooLargeForTheOtherServerIsDropped(t *testing.T) {
+	hostPorts := freeHostPorts(t, 2)
+	srv := startServer(t, Config{HostPort: hostPorts[0], OtherServers: hostPorts[1:], ShutdownTimeout: time.Second})
+	c := connect(t, srv)
+	ctx := context.Background()
+
+	// random bytes hardly compress, so the replicated write is larger than the limit of the other server
+	b := make([]byte, 8<<10)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	// the other server is not started yet, so both writes are due together, and the small one depends on the
+	// large one
+	if err := c.Put(ctx, "large", hex.EncodeToString(b)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(ctx, "small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	other := New(Config{HostPort: hostPorts[1], OtherServers: hostPorts[:1], ShutdownTimeout: time.Second})
+	if _, err := other.setLimit(maxMessageSizeLimit, "4096"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(other.Stop)
+
+	eventually(t, "the small write is replicated", func() bool {
+		v, ok := currentValue(other, "small")
+		return ok && v == "v"
+	})
+	eventually(t, "no write stays queued", func() bool {
+		return srv.outbound.len() == 0
+	})
+	if _, ok := currentValue(other, "large"); ok {
+		t.Errorf("the other server committed a write larger than its limit")
+	}
+	srv.outbound.Lock()
+	dropped := srv.outbound.droppedWrites
+	srv.outbound.Unlock()
+	if dropped != 1 {
+		t.Errorf("%d writes dropped, want the large one", dropped)
+	}
+
+	// the writes after the dropped one are still replicated
+	if err := c.Put(ctx, "later", "v"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a later write is replicated", func() bool {
+		v, ok := currentValue(other, "later")
+		return ok && v == "v"
+	})
+}
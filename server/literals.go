@@ -8,19 +8,48 @@ import (
 )
 
 const (
-	startCmd = "start"
-	hCmd     = "h"
-	helpCmd  = "help"
-	qCmd     = "q"
-	quitCmd  = "quit"
+	startCmd     = "start"
+	strongCmd    = "strong"
+	tlsCmd       = "tls"
+	secretCmd    = "secret"
+	dataCmd      = "data"
+	userCmd      = "user"
+	grantCmd     = "grant"
+	usersCmd     = "users"
+	indexCmd     = "index"
+	cacheCmd     = "cache"
+	maxMemoryCmd = "maxmemory"
+	memoryCmd    = "memory"
+	limitCmd     = "limit"
+	limitsCmd    = "limits"
+	statsCmd     = "stats"
+	hCmd         = "h"
+	helpCmd      = "help"
+	qCmd         = "q"
+	quitCmd      = "quit"
 
-	badArguments                     = "bad arguments"
-	goodbye                          = "goodbye"
-	unrecognizedCommand              = "unrecognized command"
+	badArguments        = "bad arguments"
+	goodbye             = "goodbye"
+	unrecognizedCommand = "unrecognized command"
 )
 
 var helpMessage = strings.Join([]string{
 	fmt.Sprintf("\t%s [ip:port to listen to] [ip:port of other servers (if multiple, separate by space)]", startCmd),
+	fmt.Sprintf("\t%s [certificate file] [key file] [CA certificate file]", tlsCmd),
+	fmt.Sprintf("\t%s [secret shared by all servers to sign the messages between them]", secretCmd),
+	fmt.Sprintf("\t%s [file to save the state to when the server stops, and restore it from when it starts]", dataCmd),
+	fmt.Sprintf("\t%s [user] [password]", userCmd),
+	fmt.Sprintf("\t%s [user] [%q or %q] [key prefix, or %q for all keys]", grantCmd, readPermission, writePermission, allKeys),
+	fmt.Sprintf("\t%s", usersCmd),
+	fmt.Sprintf("\t%s [key prefix] [more key prefixes (optional, separate by space)]", strongCmd),
+	fmt.Sprintf("\t%s [json path inside values, such as address.city]", indexCmd),
+	fmt.Sprintf("\t%s (run as a cache, which drops the values evicted to fit in its memory budget)", cacheCmd),
+	fmt.Sprintf("\t%s [memory budget in bytes, 0 for no limit] [eviction policy, %q or %q (optional, %q by default)]", maxMemoryCmd, leastRecentlyUsed, leastFrequentlyUsed, leastRecentlyUsed),
+	fmt.Sprintf("\t%s", memoryCmd),
+	fmt.Sprintf("\t%s [%s, %s or %s in bytes or requests, or %s, %s, %s in seconds, or %s in requests per second per client] [value, 0 for no limit]",
+		limitCmd, maxMessageSizeLimit, maxConnectionsLimit, burstLimit, readTimeoutLimit, idleTimeoutLimit, writeTimeoutLimit, rateLimit),
+	fmt.Sprintf("\t%s", limitsCmd),
+	fmt.Sprintf("\t%s", statsCmd),
 	fmt.Sprintf("\t%s, %s", quitCmd, qCmd),
 	fmt.Sprintf("\t%s, %s", helpCmd, hCmd),
 }, "\n")
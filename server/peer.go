@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"Lab2/communication"
+	"Lab2/util"
+)
+
+// features are the optional parts of the protocol this server supports
+var features = []string{
+	communication.FeatureFraming,
+	communication.FeatureBatching,
+	communication.FeatureChunking,
+	communication.FeatureVersionVectors,
+	communication.FeatureStrongConsistency,
+	communication.FeatureReplicationBatching,
+	communication.FeatureGob,
+	communication.FeatureFlate,
+}
+
+// peerLink is the outcome of the handshake with another server
+type peerLink struct {
+	protocolVersion int
+	features        map[string]bool
+	// err is set if the other server is incompatible, in which case nothing is sent to it
+	err error
+
+	// conn is the persistent connection replicated writes are sent over, if the other server supports framing
+	conn     *communication.FramedConnection
+	connLock sync.Mutex
+}
+
+type peerRegistry struct {
+	linkByHostPort map[string]*peerLink
+	sync.Mutex
+}
+
+// handleHello handles the handshake of a client or another server
+func handleHello(req communication.HelloRequest) interface{} {
+	return hello(req)
+}
+
+func hello(req communication.HelloRequest) communication.HelloResponse {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	version, common, err := communication.Negotiate(req.Args, features)
+	if err != nil {
+		if req.Args.Sender != "" {
+			errorLogger.Printf("rejecting server %q: %v", req.Args.Sender, err)
+		}
+		return communication.HelloResponse{
+			Op:              req.Op,
+			Result:          communication.Fail,
+			DetailedResult:  err.Error(),
+			ErrorCode:       communication.Unsupported,
+			ProtocolVersion: communication.ProtocolVersion,
+		}
+	}
+	return communication.HelloResponse{
+		Op:              req.Op,
+		Result:          communication.Success,
+		DetailedResult:  fmt.Sprintf("speaking protocol version %d", version),
+		ProtocolVersion: version,
+		Features:        common,
+	}
+}
+
+// connectPeer returns the link with another server, saying hello to it first if not done yet.
+// A server that does not know hello speaks protocol version 1 with no optional features
+func (srv *Server) connectPeer(hostPort string, timeout time.Duration) (*peerLink, error) {
+	srv.peers.Lock()
+	link, ok := srv.peers.linkByHostPort[hostPort]
+	srv.peers.Unlock()
+	if ok {
+		return link, link.err
+	}
+
+	var resp communication.HelloResponse
+	err := srv.exchangeWithPeer(hostPort, srv.makeHelloRequest(), &resp, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	link = &peerLink{protocolVersion: resp.ProtocolVersion, features: make(map[string]bool)}
+	switch {
+	case resp.Result == communication.Success:
+		for _, f := range resp.Features {
+			link.features[f] = true
+		}
+	case resp.ProtocolVersion == 0:
+		link.protocolVersion = 1
+	default:
+		link.err = fmt.Errorf("server %q is incompatible: %s", hostPort, resp.DetailedResult)
+		errorLogger.Printf("%v", link.err)
+	}
+	srv.peers.Lock()
+	srv.peers.linkByHostPort[hostPort] = link
+	srv.peers.Unlock()
+	return link, link.err
+}
+
+// forgetPeer drops the link with another server that could not be reached,
+// so that the handshake is made again in case it restarted with another version
+func (srv *Server) forgetPeer(hostPort string) {
+	srv.peers.Lock()
+	link, ok := srv.peers.linkByHostPort[hostPort]
+	delete(srv.peers.linkByHostPort, hostPort)
+	srv.peers.Unlock()
+
+	if ok {
+		link.connLock.Lock()
+		if link.conn != nil {
+			link.conn.Close()
+		}
+		link.connLock.Unlock()
+	}
+}
+
+// callPeerWithFeature sends a request needing a feature to another server and waits for its response
+func (srv *Server) callPeerWithFeature(hostPort, feature string, req interface{}, resp interface{}, timeout time.Duration) error {
+	link, err := srv.connectPeer(hostPort, timeout)
+	if err != nil {
+		return err
+	}
+	if !link.features[feature] {
+		return fmt.Errorf("server %q does not support %s", hostPort, feature)
+	}
+	if err := srv.exchangeWithPeer(hostPort, req, resp, timeout); err != nil {
+		srv.forgetPeer(hostPort)
+		return err
+	}
+	return nil
+}
+
+const (
+	// peerDialTimeout bounds the time taken to open a connection to another server a request is sent to
+	peerDialTimeout = 3 * time.Second
+	// peerResponseTimeout bounds the time another server takes to accept a request sent over the persistent
+	// connection to it
+	peerResponseTimeout = 5 * time.Second
+)
+
+// sendToPeer sends a request expecting no result to another server. Over the persistent connection to it, if it
+// supports framing, sendToPeer waits until the other server accepts the request, failing with the error of the
+// other server if it rejects it. A server speaking protocol version 1 does not answer, so the request is taken
+// as accepted once sent
+func (srv *Server) sendToPeer(hostPort string, req interface{}) error {
+	link, err := srv.connectPeer(hostPort, peerDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	if link.features[communication.FeatureFraming] {
+		var resp communication.GenericClientResponse
+		conn, err := link.connection(hostPort, srv.makeHelloRequest(), peerDialTimeout, srv.tlsConfig, &srv.compression)
+		if err == nil {
+			var result <-chan communication.FrameResult
+			if result, err = conn.Send(req); err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), peerResponseTimeout)
+				err = conn.Receive(ctx, result, &resp)
+				cancel()
+			}
+		}
+		if err != nil {
+			srv.forgetPeer(hostPort)
+			return err
+		}
+		if resp.Result != communication.Success {
+			if resp.ErrorCode == communication.TooLarge {
+				// the other server closes the connection after a frame too large to read, so the next request
+				// redials instead of failing on the closed connection
+				link.close()
+			}
+			return fmt.Errorf("server %q rejected the request: %w", hostPort, communication.ErrorOf(resp.ErrorCode, resp.DetailedResult))
+		}
+		return nil
+	}
+
+	conn, err := communication.Dial(hostPort, peerDialTimeout, srv.tlsConfig)
+	if err != nil {
+		srv.forgetPeer(hostPort)
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	r, _ := json.Marshal(req)
+	_, err = conn.Write(r)
+	return err
+}
+
+// connection returns the persistent connection to another server, redialing it if it is broken.
+// The messages compressed over it are counted in metrics
+func (l *peerLink) connection(hostPort string, hello communication.HelloRequest, timeout time.Duration, tlsConfig *tls.Config, metrics *communication.CompressionMetrics) (*communication.FramedConnection, error) {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+
+	if l.conn != nil && !l.conn.Broken() {
+		return l.conn, nil
+	}
+	conn, err := communication.DialFramed(hostPort, hello, timeout, tlsConfig, metrics)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+// close closes the persistent connection to another server
+func (l *peerLink) close() {
+	l.connLock.Lock()
+	defer l.connLock.Unlock()
+
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
+func (srv *Server) makeHelloRequest() communication.HelloRequest {
+	return communication.HelloRequest{
+		Op: communication.Hello,
+		Args: communication.HelloRequestArgs{
+			ProtocolVersion:    communication.ProtocolVersion,
+			MinProtocolVersion: communication.MinProtocolVersion,
+			Features:           features,
+			Sender:             srv.selfHostPort,
+		},
+	}
+}
+
+// exchangeWithPeer sends a request to another server over a connection of its own and waits for its response
+func (srv *Server) exchangeWithPeer(hostPort string, req interface{}, resp interface{}, timeout time.Duration) error {
+	r, _ := json.Marshal(req)
+
+	conn, err := communication.Dial(hostPort, timeout, srv.tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(r); err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(conn)
+	return d.Decode(resp)
+}
@@ -0,0 +1,716 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"Lab2/communication"
+	"Lab2/util"
+)
+
+// Writes of keys under a strongly consistent prefix are ordered by a Raft consensus group made of all the servers,
+// instead of going through the causal ReplicatedWrite path. With a data file, the term, the vote and the log are
+// saved to a raft file next to it before the server replies to a consensus message or sends one, so that a restarted
+// server neither votes twice in a term nor forgets entries it acknowledged. Without a data file they live in memory
+// only, and a restarted server rejoins with an empty log and catches up from the leader.
+
+const (
+	raftHeartbeatInterval  = 100 * time.Millisecond
+	raftMinElectionTimeout = 500 * time.Millisecond
+	raftMaxElectionTimeout = 1000 * time.Millisecond
+	raftRpcTimeout         = 1 * time.Second
+	raftCommitTimeout      = 5 * time.Second
+	raftFollower           = "follower"
+	raftCandidate          = "candidate"
+	raftLeader             = "leader"
+
+	// raftDependencyPollInterval is how often an entry waiting for its dependencies checks them again
+	raftDependencyPollInterval = 50 * time.Millisecond
+)
+
+type raftApplyResult struct {
+	entry communication.RaftLogEntry
+	// applied is false when the condition of a conditional write does not hold
+	applied bool
+	// interrupted tells the entry was not applied because the server stopped while it waited for its dependencies
+	interrupted bool
+	current     valueOfKey
+	exists      bool
+}
+
+type raftState struct {
+	role        string
+	currentTerm uint64
+	votedFor    string
+	leaderId    string
+	// log[0] is a sentinel so that the first real entry has index 1
+	log         []communication.RaftLogEntry
+	commitIndex uint64
+	lastApplied uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inFlight   map[string]bool
+
+	electionDeadline time.Time
+	waiters          map[uint64][]chan raftApplyResult
+	applyCh          chan struct{}
+
+	// file is where the term, the vote and the log are saved, empty if they are not persisted,
+	// and dirty tells they changed since they were last saved
+	file  string
+	dirty bool
+	sync.Mutex
+}
+
+// raftPersistentState is the part of the raft state saved to the raft file
+type raftPersistentState struct {
+	CurrentTerm uint64
+	VotedFor    string
+	Log         []communication.RaftLogEntry
+}
+
+// isStrongKey tells if writes of the key must go through the consensus group
+func (srv *Server) isStrongKey(key string) bool {
+	for _, p := range srv.strongKeyPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// raftFile is the file the raft state is saved to, next to the data file, empty if the server has no data file
+func (srv *Server) raftFile() string {
+	if srv.config.DataFile == "" {
+		return ""
+	}
+	return srv.config.DataFile + ".raft"
+}
+
+// loadRaftState reads the raft state saved to the raft file, if the server has a data file and the raft file exists
+func (srv *Server) loadRaftState() (*raftPersistentState, error) {
+	file := srv.raftFile()
+	if file == "" {
+		if len(srv.strongKeyPrefixes) > 0 {
+			errorLogger.Printf("raft: without a data file, a restarted server may vote twice in a term or lose entries it acknowledged")
+		}
+		return nil, nil
+	}
+	m, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved raftPersistentState
+	if err := json.Unmarshal(m, &saved); err != nil {
+		return nil, fmt.Errorf("bad raft file %q: %w", file, err)
+	}
+	if len(saved.Log) == 0 {
+		return nil, fmt.Errorf("bad raft file %q: the log has no sentinel entry", file)
+	}
+	infoLogger.Printf("raft: restored term %d and %d log entries from %q", saved.CurrentTerm, len(saved.Log)-1, file)
+	return &saved, nil
+}
+
+// save writes the term, the vote and the log to the raft file if they changed, and syncs it before returning.
+// The caller must hold the lock of raft
+func (r *raftState) save() error {
+	if r.file == "" || !r.dirty {
+		return nil
+	}
+	m, err := json.Marshal(raftPersistentState{CurrentTerm: r.currentTerm, VotedFor: r.votedFor, Log: r.log})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(r.file, m); err != nil {
+		return fmt.Errorf("raft: failed to save the raft state: %w", err)
+	}
+	r.dirty = false
+	return nil
+}
+
+// saveOrLog saves the raft state for the callers that have no one to report the error to.
+// The caller must hold the lock of raft
+func (r *raftState) saveOrLog() {
+	if err := r.save(); err != nil {
+		errorLogger.Printf("%v", err)
+	}
+}
+
+// startRaft initializes the raft state from the saved one if any, and runs the consensus group if any strongly
+// consistent prefix is configured
+func (srv *Server) startRaft(saved *raftPersistentState) {
+	srv.storage.Lock()
+	raftApplied := srv.storage.raftApplied
+	srv.storage.Unlock()
+
+	srv.raft.Lock()
+	srv.raft.role = raftFollower
+	srv.raft.log = []communication.RaftLogEntry{{}}
+	if saved != nil {
+		srv.raft.currentTerm, srv.raft.votedFor, srv.raft.log = saved.CurrentTerm, saved.VotedFor, saved.Log
+	}
+	srv.raft.file = srv.raftFile()
+	// the entries applied to the restored storage are not applied again
+	srv.raft.lastApplied = raftApplied
+	if last := uint64(len(srv.raft.log) - 1); srv.raft.lastApplied > last {
+		srv.raft.lastApplied = last
+	}
+	srv.raft.commitIndex = srv.raft.lastApplied
+	srv.raft.nextIndex = make(map[string]uint64)
+	srv.raft.matchIndex = make(map[string]uint64)
+	srv.raft.inFlight = make(map[string]bool)
+	srv.raft.waiters = make(map[uint64][]chan raftApplyResult)
+	srv.raft.applyCh = make(chan struct{}, 1)
+	srv.raft.resetElectionDeadline()
+	srv.raft.Unlock()
+
+	rand.Seed(time.Now().UnixNano())
+	go srv.raftApplier()
+	if len(srv.strongKeyPrefixes) == 0 {
+		return
+	}
+	infoLogger.Printf("keys with prefixes %q are strongly consistent", srv.strongKeyPrefixes)
+	go func() {
+		ticker := time.NewTicker(raftHeartbeatInterval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-srv.stopped:
+				return
+			case <-ticker.C:
+			}
+			srv.raft.Lock()
+			switch {
+			case srv.raft.role == raftLeader:
+				srv.broadcastAppendEntries()
+			case time.Now().After(srv.raft.electionDeadline):
+				srv.startElection()
+			}
+			srv.raft.Unlock()
+		}
+	}()
+}
+
+// the caller must hold the lock of raft
+func (r *raftState) resetElectionDeadline() {
+	timeout := raftMinElectionTimeout + time.Duration(rand.Int63n(int64(raftMaxElectionTimeout-raftMinElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// the caller must hold the lock of raft
+func (r *raftState) lastLogIndexAndTerm() (uint64, uint64) {
+	last := uint64(len(r.log) - 1)
+	return last, r.log[last].Term
+}
+
+// the caller must hold the lock of raft
+func (r *raftState) becomeFollower(term uint64) {
+	if r.role != raftFollower {
+		infoLogger.Printf("raft: becoming follower at term %d", term)
+	}
+	r.role = raftFollower
+	if term > r.currentTerm {
+		r.currentTerm = term
+		r.votedFor = ""
+		r.dirty = true
+	}
+	r.resetElectionDeadline()
+}
+
+// the caller must hold the lock of raft
+func (srv *Server) startElection() {
+	r := &srv.raft
+	r.role = raftCandidate
+	r.currentTerm++
+	r.votedFor = srv.selfHostPort
+	r.leaderId = ""
+	r.dirty = true
+	r.resetElectionDeadline()
+	if err := r.save(); err != nil {
+		// the vote for itself must be saved before asking for votes, so try again at the next election
+		errorLogger.Printf("%v", err)
+		return
+	}
+	infoLogger.Printf("raft: starting election at term %d", r.currentTerm)
+
+	term := r.currentTerm
+	lastIndex, lastTerm := r.lastLogIndexAndTerm()
+	votes := 1
+	if votes > (len(srv.otherServersHostPorts)+1)/2 {
+		srv.becomeLeader()
+		return
+	}
+
+	for _, hp := range srv.otherServersHostPorts {
+		go func(hp string) {
+			var resp communication.ServerRaftRequestVoteResponse
+			req := communication.ServerRaftRequestVoteRequest{
+				Op: communication.RaftRequestVote,
+				Args: communication.ServerRaftRequestVoteRequestArgs{
+					Term:         term,
+					CandidateId:  srv.selfHostPort,
+					LastLogIndex: lastIndex,
+					LastLogTerm:  lastTerm,
+				},
+			}
+			req.Signature = srv.signMessage(req.Op, req.Args)
+			err := srv.callPeer(hp, req, &resp)
+			if err != nil {
+				return
+			}
+
+			r.Lock()
+			defer r.Unlock()
+			if resp.Term > r.currentTerm {
+				r.becomeFollower(resp.Term)
+				r.saveOrLog()
+				return
+			}
+			if r.role != raftCandidate || r.currentTerm != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes > (len(srv.otherServersHostPorts)+1)/2 {
+				srv.becomeLeader()
+			}
+		}(hp)
+	}
+}
+
+// the caller must hold the lock of raft
+func (srv *Server) becomeLeader() {
+	r := &srv.raft
+	infoLogger.Printf("raft: elected leader at term %d", r.currentTerm)
+	r.role = raftLeader
+	r.leaderId = srv.selfHostPort
+	for _, hp := range srv.otherServersHostPorts {
+		r.nextIndex[hp] = uint64(len(r.log))
+		r.matchIndex[hp] = 0
+	}
+	// a no-op entry of the new term lets entries of previous terms be committed
+	r.log = append(r.log, communication.RaftLogEntry{Term: r.currentTerm})
+	r.dirty = true
+	r.saveOrLog()
+	srv.advanceCommitIndex()
+	srv.broadcastAppendEntries()
+}
+
+// the caller must hold the lock of raft
+func (srv *Server) broadcastAppendEntries() {
+	r := &srv.raft
+	for _, hp := range srv.otherServersHostPorts {
+		if r.inFlight[hp] {
+			continue
+		}
+		r.inFlight[hp] = true
+
+		prevIndex := r.nextIndex[hp] - 1
+		entries := make([]communication.RaftLogEntry, len(r.log[prevIndex+1:]))
+		copy(entries, r.log[prevIndex+1:])
+		args := communication.ServerRaftAppendEntriesRequestArgs{
+			Term:         r.currentTerm,
+			LeaderId:     srv.selfHostPort,
+			PrevLogIndex: prevIndex,
+			PrevLogTerm:  r.log[prevIndex].Term,
+			Entries:      entries,
+			LeaderCommit: r.commitIndex,
+		}
+
+		go func(hp string) {
+			var resp communication.ServerRaftAppendEntriesResponse
+			err := srv.callPeer(hp, communication.ServerRaftAppendEntriesRequest{
+				Op:        communication.RaftAppendEntries,
+				Args:      args,
+				Signature: srv.signMessage(communication.RaftAppendEntries, args),
+			}, &resp)
+
+			r.Lock()
+			defer r.Unlock()
+			r.inFlight[hp] = false
+			if err != nil {
+				return
+			}
+			if resp.Term > r.currentTerm {
+				r.becomeFollower(resp.Term)
+				r.saveOrLog()
+				return
+			}
+			if r.role != raftLeader || r.currentTerm != args.Term {
+				return
+			}
+			if resp.Success {
+				match := args.PrevLogIndex + uint64(len(args.Entries))
+				if match > r.matchIndex[hp] {
+					r.matchIndex[hp] = match
+				}
+				r.nextIndex[hp] = r.matchIndex[hp] + 1
+				srv.advanceCommitIndex()
+				return
+			}
+			if resp.ConflictIndex >= 1 && resp.ConflictIndex < r.nextIndex[hp] {
+				r.nextIndex[hp] = resp.ConflictIndex
+			} else if r.nextIndex[hp] > 1 {
+				r.nextIndex[hp]--
+			}
+		}(hp)
+	}
+}
+
+// advanceCommitIndex commits the latest entry of the current term stored on a majority of servers.
+// The caller must hold the lock of raft
+func (srv *Server) advanceCommitIndex() {
+	r := &srv.raft
+	for n := uint64(len(r.log) - 1); n > r.commitIndex; n-- {
+		if r.log[n].Term != r.currentTerm {
+			break
+		}
+		count := 1
+		for _, hp := range srv.otherServersHostPorts {
+			if r.matchIndex[hp] >= n {
+				count++
+			}
+		}
+		if count > (len(srv.otherServersHostPorts)+1)/2 {
+			r.commitIndex = n
+			r.signalApply()
+			return
+		}
+	}
+}
+
+// the caller must hold the lock of raft
+func (r *raftState) signalApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// raftApplier applies committed entries to the storage in log order
+func (srv *Server) raftApplier() {
+	for {
+		select {
+		case <-srv.stopped:
+			return
+		case <-srv.raft.applyCh:
+		}
+		for {
+			srv.raft.Lock()
+			if srv.raft.lastApplied >= srv.raft.commitIndex {
+				srv.raft.Unlock()
+				break
+			}
+			srv.raft.lastApplied++
+			index := srv.raft.lastApplied
+			entry := srv.raft.log[index]
+			waiters := srv.raft.waiters[index]
+			delete(srv.raft.waiters, index)
+			srv.raft.Unlock()
+
+			result := srv.applyRaftEntry(index, entry)
+			for _, w := range waiters {
+				w <- result
+			}
+			if result.interrupted {
+				return
+			}
+		}
+	}
+}
+
+// applyRaftEntry applies the committed entry at index to the storage, once its dependencies are committed.
+// The entries after it wait meanwhile, since entries are applied in log order. An entry still waiting for its
+// dependencies when the server stops is not applied, and is applied again once the server restarts
+func (srv *Server) applyRaftEntry(index uint64, entry communication.RaftLogEntry) raftApplyResult {
+	result := raftApplyResult{entry: entry}
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+	for !srv.storage.satisfiesAll(entry.Dependencies) {
+		if srv.isDraining() {
+			infoLogger.Printf("the consensus log entry %d is left unapplied", index)
+			result.interrupted = true
+			return result
+		}
+		srv.storage.Unlock()
+		infoLogger.Printf("delaying the consensus log entry %d until its dependencies are committed", index)
+		select {
+		case <-time.After(raftDependencyPollInterval):
+		case <-srv.draining:
+		}
+		srv.storage.Lock()
+	}
+	srv.storage.raftApplied = index
+	if entry.Key == "" {
+		return result
+	}
+	// an entry applied again after the server restarted, such as when the leader sends its log again, may already
+	// be committed, and must not show twice in the history and the change feed
+	if srv.storage.hasVersion(entry.Key, entry.OriginalServer, entry.Clock) {
+		result.current, result.exists = srv.storage.liveAt(entry.Key, entry.ProposedAtUnixNano)
+		result.applied = true
+		return result
+	}
+
+	result.current, result.exists = srv.storage.liveAt(entry.Key, entry.ProposedAtUnixNano)
+	switch entry.Condition {
+	case communication.SetIfAbsent:
+		if result.exists {
+			return result
+		}
+	case communication.CompareAndSet:
+		if !result.exists || result.current.originalServer != entry.ExpectedOriginalServer ||
+			result.current.lamportsClockTimestamp != entry.ExpectedLamportsClockTimestamp {
+			return result
+		}
+	}
+
+	value, err := communication.DecodeValue(entry.Value, entry.ValueEncoding)
+	if err != nil {
+		errorLogger.Printf("%v", err)
+		return result
+	}
+	srv.clock.Lock()
+	srv.clock.clock = nextLamportsClock(srv.clock.clock, entry.Clock)
+	srv.clock.Unlock()
+	srv.commit(entry.Key, valueOfKey{
+		value:                  value,
+		originalServer:         entry.OriginalServer,
+		lamportsClockTimestamp: entry.Clock,
+		expiresAt:              entry.ExpiresAtUnixNano,
+		deleted:                entry.Deleted,
+	}, nil)
+	if entry.Deleted {
+		genericLogger.Printf(">>>>> committed delete of %q through consensus", entry.Key)
+	} else {
+		genericLogger.Printf(">>>>> committed %q->%q through consensus", entry.Key, value)
+	}
+	result.applied = true
+	return result
+}
+
+// waitForApply registers for the result of applying the entry at index.
+// The caller must hold the lock of raft
+func (r *raftState) waitForApply(index uint64) chan raftApplyResult {
+	w := make(chan raftApplyResult, 1)
+	r.waiters[index] = append(r.waiters[index], w)
+	return w
+}
+
+// proposeStrongWrite orders a write of a strongly consistent key through the consensus group,
+// forwarding it to the leader if necessary, and returns once this server has applied it
+func (srv *Server) proposeStrongWrite(entry communication.RaftLogEntry, forwarded bool) communication.ServerRaftProposeResponse {
+	srv.raft.Lock()
+	if srv.raft.role != raftLeader {
+		leader := srv.raft.leaderId
+		srv.raft.Unlock()
+		if leader == "" || forwarded {
+			return makeRaftProposeFailResp(communication.Unavailable, "no leader of the consensus group is known, try again later")
+		}
+
+		var resp communication.ServerRaftProposeResponse
+		req := communication.ServerRaftProposeRequest{
+			Op:   communication.RaftPropose,
+			Args: communication.ServerRaftProposeRequestArgs{Entry: entry, Sender: srv.selfHostPort},
+		}
+		req.Signature = srv.signMessage(req.Op, req.Args)
+		if err := srv.callPeerWithTimeout(leader, req, &resp, raftCommitTimeout); err != nil {
+			return makeRaftProposeFailResp(communication.Unavailable, fmt.Sprintf("fail to forward to leader %q: %v", leader, err))
+		}
+		if resp.Result != communication.Success {
+			return resp
+		}
+
+		// wait until this server has applied the entry as well, so that the client reads its own write
+		srv.raft.Lock()
+		if srv.raft.lastApplied >= resp.Index {
+			srv.raft.Unlock()
+			return resp
+		}
+		w := srv.raft.waitForApply(resp.Index)
+		srv.raft.Unlock()
+		select {
+		case <-w:
+			return resp
+		case <-time.After(raftCommitTimeout):
+			return makeRaftProposeFailResp(communication.Timeout, "timeout waiting for the write to be applied locally")
+		}
+	}
+
+	// the log order and the timestamps of strong writes agree, so that every entry applied is newer than
+	// the ones before it, even if this server has not applied all of them yet
+	srv.clock.Lock()
+	srv.clock.clock++
+	if last := srv.raft.log[len(srv.raft.log)-1].Clock; srv.clock.clock <= last {
+		srv.clock.clock = last + 1
+	}
+	entry.Clock = srv.clock.clock
+	srv.clock.Unlock()
+	entry.Term = srv.raft.currentTerm
+	entry.OriginalServer = srv.selfHostPort
+	entry.ProposedAtUnixNano = time.Now().UnixNano()
+	srv.raft.log = append(srv.raft.log, entry)
+	srv.raft.dirty = true
+	if err := srv.raft.save(); err != nil {
+		srv.raft.log = srv.raft.log[:len(srv.raft.log)-1]
+		srv.raft.Unlock()
+		return makeRaftProposeFailResp(communication.Unavailable, err.Error())
+	}
+	index := uint64(len(srv.raft.log) - 1)
+	w := srv.raft.waitForApply(index)
+	srv.advanceCommitIndex()
+	srv.broadcastAppendEntries()
+	srv.raft.Unlock()
+
+	select {
+	case result := <-w:
+		if result.interrupted {
+			return makeRaftProposeFailResp(communication.Unavailable, "the server stopped before the write was applied")
+		}
+		if result.entry.Term != entry.Term || result.entry.Clock != entry.Clock {
+			return makeRaftProposeFailResp(communication.Unavailable, "leadership lost before the write was committed")
+		}
+		if !result.applied {
+			r := makeRaftProposeFailResp(communication.NotFound, fmt.Sprintf("key %q does not exist", entry.Key))
+			if result.exists {
+				r.ErrorCode = communication.Conflict
+				version := result.current.toVersionData()
+				r.DetailedResult = fmt.Sprintf("key %q is at version (%q, %d)",
+					entry.Key, result.current.originalServer, result.current.lamportsClockTimestamp)
+				r.CurrentVersion = &version
+			}
+			return r
+		}
+		return communication.ServerRaftProposeResponse{
+			Op:             communication.RaftPropose,
+			Result:         communication.Success,
+			DetailedResult: "write is committed",
+			Index:          index,
+			Entry:          entry,
+		}
+	case <-time.After(raftCommitTimeout):
+		return makeRaftProposeFailResp(communication.Timeout, "timeout waiting for the write to be committed")
+	}
+}
+
+// handleServerRaftRequestVote handles vote request from a candidate
+func (srv *Server) handleServerRaftRequestVote(req communication.ServerRaftRequestVoteRequest) interface{} {
+	srv.raft.Lock()
+	defer srv.raft.Unlock()
+
+	if req.Args.Term > srv.raft.currentTerm {
+		srv.raft.becomeFollower(req.Args.Term)
+	}
+	lastIndex, lastTerm := srv.raft.lastLogIndexAndTerm()
+	upToDate := req.Args.LastLogTerm > lastTerm || (req.Args.LastLogTerm == lastTerm && req.Args.LastLogIndex >= lastIndex)
+	granted := req.Args.Term == srv.raft.currentTerm && upToDate &&
+		(srv.raft.votedFor == "" || srv.raft.votedFor == req.Args.CandidateId)
+	if granted {
+		srv.raft.votedFor = req.Args.CandidateId
+		srv.raft.dirty = true
+		srv.raft.resetElectionDeadline()
+	}
+	// the vote is only granted once saved, since a restarted server must not vote again in the same term
+	if err := srv.raft.save(); err != nil {
+		errorLogger.Printf("%v", err)
+		granted = false
+	}
+
+	return communication.ServerRaftRequestVoteResponse{
+		Op:          req.Op,
+		Term:        srv.raft.currentTerm,
+		VoteGranted: granted,
+	}
+}
+
+// handleServerRaftAppendEntries handles log replication and heartbeats from the leader
+func (srv *Server) handleServerRaftAppendEntries(req communication.ServerRaftAppendEntriesRequest) interface{} {
+	srv.raft.Lock()
+	defer srv.raft.Unlock()
+
+	makeResp := func(success bool, conflictIndex uint64) interface{} {
+		return communication.ServerRaftAppendEntriesResponse{
+			Op:            req.Op,
+			Term:          srv.raft.currentTerm,
+			Success:       success,
+			ConflictIndex: conflictIndex,
+		}
+	}
+
+	if req.Args.Term < srv.raft.currentTerm {
+		return makeResp(false, 0)
+	}
+	srv.raft.becomeFollower(req.Args.Term)
+	srv.raft.leaderId = req.Args.LeaderId
+
+	if req.Args.PrevLogIndex >= uint64(len(srv.raft.log)) {
+		srv.raft.saveOrLog()
+		return makeResp(false, uint64(len(srv.raft.log)))
+	}
+	if srv.raft.log[req.Args.PrevLogIndex].Term != req.Args.PrevLogTerm {
+		srv.raft.saveOrLog()
+		return makeResp(false, req.Args.PrevLogIndex)
+	}
+
+	for i, entry := range req.Args.Entries {
+		index := req.Args.PrevLogIndex + 1 + uint64(i)
+		if index < uint64(len(srv.raft.log)) {
+			if srv.raft.log[index].Term == entry.Term {
+				continue
+			}
+			srv.raft.log = srv.raft.log[:index]
+		}
+		srv.raft.log = append(srv.raft.log, entry)
+		srv.raft.dirty = true
+	}
+	// the entries are only acknowledged once saved, since the leader counts them as stored by this server
+	if err := srv.raft.save(); err != nil {
+		errorLogger.Printf("%v", err)
+		return makeResp(false, 0)
+	}
+
+	lastNewIndex := req.Args.PrevLogIndex + uint64(len(req.Args.Entries))
+	if req.Args.LeaderCommit > srv.raft.commitIndex {
+		srv.raft.commitIndex = req.Args.LeaderCommit
+		if lastNewIndex < srv.raft.commitIndex {
+			srv.raft.commitIndex = lastNewIndex
+		}
+		srv.raft.signalApply()
+	}
+	return makeResp(true, 0)
+}
+
+// handleServerRaftPropose handles a strong write forwarded by another server
+func (srv *Server) handleServerRaftPropose(req communication.ServerRaftProposeRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	return srv.proposeStrongWrite(req.Args.Entry, true)
+}
+
+func makeRaftProposeFailResp(code communication.ErrorCode, detailedResult string) communication.ServerRaftProposeResponse {
+	return communication.ServerRaftProposeResponse{
+		Op:             communication.RaftPropose,
+		Result:         communication.Fail,
+		DetailedResult: detailedResult,
+		ErrorCode:      code,
+	}
+}
+
+// callPeer sends a request to another server and waits for its response
+func (srv *Server) callPeer(hostPort string, req interface{}, resp interface{}) error {
+	return srv.callPeerWithTimeout(hostPort, req, resp, raftRpcTimeout)
+}
+
+func (srv *Server) callPeerWithTimeout(hostPort string, req interface{}, resp interface{}, timeout time.Duration) error {
+	return srv.callPeerWithFeature(hostPort, communication.FeatureStrongConsistency, req, resp, timeout)
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"Lab2/client"
+	"Lab2/communication"
+)
+
+// freeHostPorts returns n ip:port on the loopback interface that nothing listens to
+func freeHostPorts(t *testing.T, n int) []string {
+	t.Helper()
+	hostPorts := make([]string, n)
+	for i := range hostPorts {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostPorts[i] = l.Addr().String()
+		_ = l.Close()
+	}
+	return hostPorts
+}
+
+// startCluster starts n servers in the process, each with a data file in dir, and stops them at the end of the test
+func startCluster(t *testing.T, n int, dir string, strongKeyPrefixes ...string) []*Server {
+	t.Helper()
+	hostPorts := freeHostPorts(t, n)
+	servers := make([]*Server, n)
+	for i, hp := range hostPorts {
+		var others []string
+		for _, other := range hostPorts {
+			if other != hp {
+				others = append(others, other)
+			}
+		}
+		servers[i] = New(Config{
+			HostPort:          hp,
+			OtherServers:      others,
+			StrongKeyPrefixes: strongKeyPrefixes,
+			DataFile:          filepath.Join(dir, hp),
+			ShutdownTimeout:   time.Second,
+		})
+		if err := servers[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, srv := range servers {
+			srv.Stop()
+		}
+	})
+	return servers
+}
+
+// connect connects a client to srv, and closes it at the end of the test
+func connect(t *testing.T, srv *Server) *client.Client {
+	t.Helper()
+	c := client.New(client.Config{})
+	if err := c.Connect(context.Background(), srv.config.HostPort, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// eventually polls cond until it is true, failing the test after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting until %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// currentValue returns the current value of a key on srv, telling if it is live
+func currentValue(srv *Server, key string) (string, bool) {
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+	v, ok := srv.storage.live(key)
+	return v.value, ok
+}
+
+func requestVote(srv *Server, term uint64, candidate string, lastLogIndex, lastLogTerm uint64) communication.ServerRaftRequestVoteResponse {
+	return srv.handleServerRaftRequestVote(communication.ServerRaftRequestVoteRequest{
+		Op: communication.RaftRequestVote,
+		Args: communication.ServerRaftRequestVoteRequestArgs{
+			Term: term, CandidateId: candidate, LastLogIndex: lastLogIndex, LastLogTerm: lastLogTerm,
+		},
+	}).(communication.ServerRaftRequestVoteResponse)
+}
+
+// restartRaft starts the raft state of a new server from the raft file of config
+func restartRaft(t *testing.T, config Config) *Server {
+	t.Helper()
+	srv := New(config)
+	saved, err := srv.loadRaftState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.startRaft(saved)
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func TestRaftTermVoteAndLogSurviveRestart(t *testing.T) {
+	config := Config{DataFile: filepath.Join(t.TempDir(), "data")}
+	srv := restartRaft(t, config)
+
+	if resp := requestVote(srv, 3, "a:1", 0, 0); !resp.VoteGranted {
+		t.Fatalf("vote of a fresh server not granted: %+v", resp)
+	}
+	entries := []communication.RaftLogEntry{
+		{Term: 3, Key: "k", Value: "v1", OriginalServer: "a:1", Clock: 1},
+		{Term: 3, Key: "k", Value: "v2", OriginalServer: "a:1", Clock: 2},
+	}
+	resp := srv.handleServerRaftAppendEntries(communication.ServerRaftAppendEntriesRequest{
+		Op:   communication.RaftAppendEntries,
+		Args: communication.ServerRaftAppendEntriesRequestArgs{Term: 3, LeaderId: "a:1", Entries: entries},
+	}).(communication.ServerRaftAppendEntriesResponse)
+	if !resp.Success {
+		t.Fatalf("entries not appended: %+v", resp)
+	}
+
+	restarted := restartRaft(t, config)
+	restarted.raft.Lock()
+	term, votedFor, log := restarted.raft.currentTerm, restarted.raft.votedFor, restarted.raft.log
+	restarted.raft.Unlock()
+	if term != 3 || votedFor != "a:1" {
+		t.Errorf("restarted at term %d with a vote for %q, want term 3 with a vote for %q", term, votedFor, "a:1")
+	}
+	if len(log) != 3 || log[1].Value != "v1" || log[2].Value != "v2" {
+		t.Errorf("restarted with log %+v, want the sentinel and the two entries appended", log)
+	}
+	if resp := requestVote(restarted, 3, "b:1", 2, 3); resp.VoteGranted {
+		t.Errorf("restarted server voted twice at term 3")
+	}
+	if resp := requestVote(restarted, 4, "b:1", 1, 3); resp.VoteGranted {
+		t.Errorf("restarted server voted for a candidate missing an entry it acknowledged")
+	}
+	if resp := requestVote(restarted, 4, "c:1", 2, 3); !resp.VoteGranted {
+		t.Errorf("restarted server refused its vote to an up to date candidate of a new term: %+v", resp)
+	}
+}
+
+func TestRaftWithoutDataFileLivesInMemory(t *testing.T) {
+	srv := restartRaft(t, Config{})
+	if resp := requestVote(srv, 1, "a:1", 0, 0); !resp.VoteGranted {
+		t.Fatalf("vote not granted: %+v", resp)
+	}
+	if resp := requestVote(restartRaft(t, Config{}), 1, "b:1", 0, 0); !resp.VoteGranted {
+		t.Errorf("a server without data file remembered a vote of a previous run")
+	}
+}
+
+func TestStrongWriteCommitsOnEveryServerAndSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	servers := startCluster(t, 3, dir, "strong/")
+	c := connect(t, servers[0])
+
+	// the write fails until a leader is elected
+	eventually(t, "a strong write commits", func() bool {
+		err := c.Put(context.Background(), "strong/k", "v")
+		if err != nil && !errors.Is(err, communication.ErrUnavailable) {
+			t.Fatal(err)
+		}
+		return err == nil
+	})
+	for _, srv := range servers {
+		srv := srv
+		eventually(t, "every server applies the strong write", func() bool {
+			v, ok := currentValue(srv, "strong/k")
+			return ok && v == "v"
+		})
+	}
+
+	for _, srv := range servers {
+		srv.Stop()
+	}
+	for _, srv := range servers {
+		restarted := restartRaft(t, Config{DataFile: srv.config.DataFile})
+		restarted.raft.Lock()
+		found := false
+		for _, entry := range restarted.raft.log {
+			found = found || (entry.Key == "strong/k" && entry.Value == "v")
+		}
+		term := restarted.raft.currentTerm
+		restarted.raft.Unlock()
+		if !found || term == 0 {
+			t.Errorf("server %q restarted at term %d, with the strong write in its log: %v", srv.config.HostPort, term, found)
+		}
+	}
+}
+
+func TestRaftEntryWaitsForTheDependenciesOfItsClient(t *testing.T) {
+	entry := communication.RaftLogEntry{
+		Term: 1, Key: "strong/b", Value: "v", OriginalServer: "a:1", Clock: 2,
+		Dependencies: []communication.DependencyData{{Key: "a", OriginalServer: "a:1", LamportsClockTimestamp: 1}},
+	}
+	apply := func(srv *Server) <-chan raftApplyResult {
+		applied := make(chan raftApplyResult, 1)
+		go func() {
+			applied <- srv.applyRaftEntry(1, entry)
+		}()
+		return applied
+	}
+
+	srv := New(Config{})
+	applied := apply(srv)
+	select {
+	case <-applied:
+		t.Fatalf("the entry was applied before the write it depends on")
+	case <-time.After(3 * raftDependencyPollInterval):
+	}
+	srv.storage.Lock()
+	srv.commitReplicatedWrite(communication.ServerReplicatedWriteRequestArgs{Key: "a", Value: "v", OriginalServer: "a:1", Clock: 1})
+	srv.storage.Unlock()
+	select {
+	case result := <-applied:
+		if !result.applied {
+			t.Errorf("the entry was not applied once its dependency was committed: %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the entry was not applied once its dependency was committed")
+	}
+
+	stopping := New(Config{})
+	applied = apply(stopping)
+	stopping.Stop()
+	if result := <-applied; !result.interrupted || result.applied || stopping.storage.raftApplied != 0 {
+		t.Errorf("the entry waiting for its dependency when the server stopped: %+v, applied index %d",
+			result, stopping.storage.raftApplied)
+	}
+}
@@ -2,8 +2,11 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
@@ -17,15 +20,26 @@ import (
 	"Lab2/util"
 )
 
+// genericRequest is decoded first to find the op of a request, then the request is decoded according to the op
 type genericRequest struct {
-	Op   string
-	Args json.RawMessage
+	Op string
 }
 
 type valueOfKey struct {
 	value                  string
 	originalServer         string
 	lamportsClockTimestamp uint64
+	// crdt is the state of a CRDT value, of which value is the rendering. It is nil for a plain value
+	crdt *communication.CrdtState
+	// expiresAt is the unix time in nanoseconds when the key expires, 0 if it never does.
+	// An expired key keeps its version so that dependencies on it remain satisfied
+	expiresAt int64
+	// evicted tells the value was dropped to fit in the memory budget, the version is kept like the one of an expired key
+	evicted bool
+	// spilled tells the value and history were written to disk to fit in the memory budget, and are read from there
+	spilled bool
+	// deleted tells the version is the tombstone of a delete, the key reads as absent until it is written again
+	deleted bool
 }
 
 type causalConsistencyMaintainer struct {
@@ -35,28 +49,201 @@ type causalConsistencyMaintainer struct {
 
 type kvStorage struct {
 	storage map[string]valueOfKey
+	// history keeps the most recent versions of every key, ordered from the oldest to the newest
+	history map[string][]valueOfKey
+	// keys is an ordered index of all the keys in storage
+	keys []string
+
+	// maxMemory is the memory budget in bytes, 0 if there is none, and usedMemory approximates the bytes taken
+	maxMemory   int64
+	usedMemory  int64
+	policy      evictionPolicy
+	accessByKey map[string]keyAccess
+	accessTick  uint64
+	evictions   uint64
+	// spillDir is the directory the values evicted are written to, empty until a server which does not run
+	// as a cache is given a memory budget
+	spillDir string
+
+	// pending are the replicated writes waiting for their dependencies
+	pending map[*communication.ServerReplicatedWriteRequest]struct{}
+	// raftApplied is the index of the last consensus log entry applied to the storage
+	raftApplied uint64
 	sync.Mutex
 }
 
+// expirationSweepInterval is how often the values of expired keys are dropped
+const expirationSweepInterval = 1 * time.Second
+
+const (
+	// defaultScanLimit and maxScanLimit bound the number of keys in a page of scan
+	defaultScanLimit = 10
+	maxScanLimit     = 1000
+)
+
+// maxVersionsPerKey bounds the number of versions kept in the history of a key
+const maxVersionsPerKey = 16
+
 type lamportsClock struct {
 	clock uint64
 	sync.Mutex
 }
 
 var (
+	genericLogger = log.New(os.Stdout, "", 0)
+	infoLogger    = log.New(os.Stdout, "INFO: ", 0)
+	errorLogger   = log.New(os.Stdout, "ERROR: ", 0)
+)
+
+// Config configures a Server
+type Config struct {
+	// HostPort is the ip:port the server listens to
+	HostPort string
+	// OtherServers are the ip:port of the other servers, which the writes are replicated to
+	OtherServers []string
+	// StrongKeyPrefixes marks keys with the prefixes as strongly consistent, all servers must have the same prefixes
+	StrongKeyPrefixes []string
+	// TLSConfig enables TLS, see communication.LoadTLSConfig, nil disables it
+	TLSConfig *tls.Config
+	// SharedSecret signs the messages between servers, empty if they do not share a secret
+	SharedSecret string
+	// DataFile is where the state of the server is saved when it stops, and restored from when it starts.
+	// Empty if the state is not persisted
+	DataFile string
+	// ShutdownTimeout bounds the time Stop waits for the requests in flight and the outbound replicated writes,
+	// 10 seconds if it is 0
+	ShutdownTimeout time.Duration
+	// CacheOnly runs the server as a cache, which drops the values evicted to fit in its memory budget, so they are
+	// lost until their keys are written again. Other servers write them to disk, next to the data file
+	CacheOnly bool
+}
+
+// Server is a server of the store. All of its state is its own, so many servers may run in the same process
+type Server struct {
+	config Config
+
 	selfHostPort          string
 	otherServersHostPorts []string
 	storage               kvStorage
 	maintainer            causalConsistencyMaintainer
 	clock                 lamportsClock
 
-	genericLogger = log.New(os.Stdout, "", 0)
-	infoLogger    = log.New(os.Stdout, "INFO: ", 0)
-	errorLogger   = log.New(os.Stdout, "ERROR: ", 0)
-)
+	strongKeyPrefixes []string
+	raft              raftState
+
+	accounts accountRegistry
+	changes  changeFeed
+	uploads  uploadRegistry
+	indexes  secondaryIndexes
+	limits   connectionLimits
+	peers    peerRegistry
+	watchers watcherRegistry
+
+	// tlsConfig is the TLS configuration of the connections from and to this server, nil if TLS is disabled.
+	// With TLS, the certificate of this server is also presented to the other servers it dials, and the ops only
+	// servers send are only accepted from a peer presenting a certificate valid for one of the other servers
+	tlsConfig *tls.Config
+	// sharedSecret signs the messages between servers, nil if they do not share a secret.
+	// With a secret, a server only accepts replicated writes and consensus messages signed with it
+	sharedSecret []byte
+	// resolver caches the addresses of the hosts of the other servers, which their messages must come from
+	resolver hostResolver
+
+	// outbound holds the replicated writes not sent to the other servers yet
+	outbound outboundQueue
+	// compression counts the messages compressed over the framed connections of this server, in both directions
+	compression communication.CompressionMetrics
+
+	// listener accepts the connections once the server started, and connections are the ones being served,
+	// telling if they are handling a request
+	listener    net.Listener
+	connections map[net.Conn]bool
+	// inFlight counts the requests being handled, including replicated writes committed in the background
+	inFlight int
+	// draining is closed when Stop starts, after which no request is accepted, and stopped once the server
+	// is done with the requests in flight, ending its background work. done is closed once Stop saved the state
+	draining chan struct{}
+	stopped  chan struct{}
+	done     chan struct{}
+	sync.Mutex
+}
+
+// New makes a server, which serves nothing until it starts
+func New(config Config) *Server {
+	srv := &Server{
+		config:    config,
+		storage:   kvStorage{policy: leastRecentlyUsed},
+		tlsConfig: config.TLSConfig,
+		accounts: accountRegistry{
+			accountByUser:  make(map[string]*account),
+			sessionByToken: make(map[string]userSession),
+		},
+		changes: changeFeed{
+			consumerOffsets: make(map[string]uint64),
+			appended:        make(chan struct{}),
+		},
+		uploads: uploadRegistry{
+			uploadById:   make(map[string]*upload),
+			maxSize:      maxUploadsSize,
+			maxPerClient: maxUploadsPerClient,
+		},
+		indexes: secondaryIndexes{
+			keysByField: make(map[string]map[string]map[string]struct{}),
+			fieldByKey:  make(map[string]map[string]string),
+		},
+		limits: connectionLimits{
+			settings:       defaultLimitSettings,
+			bucketByClient: make(map[string]*tokenBucket),
+		},
+		peers:    peerRegistry{linkByHostPort: make(map[string]*peerLink)},
+		resolver: hostResolver{ipsByHost: make(map[string][]net.IP)},
+		watchers: watcherRegistry{watchers: make(map[*watcher]struct{})},
+		outbound: outboundQueue{
+			writes:  make(map[*outboundWrite]struct{}),
+			due:     make(map[string][]*outboundWrite),
+			sending: make(map[string]bool),
+			dropped: make(map[string]map[communication.DependencyData][]communication.DependencyData),
+		},
+		connections: make(map[net.Conn]bool),
+		draining:    make(chan struct{}),
+		stopped:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if srv.config.ShutdownTimeout == 0 {
+		srv.config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	srv.storage.storage = make(map[string]valueOfKey)
+	srv.storage.history = make(map[string][]valueOfKey)
+	srv.storage.accessByKey = make(map[string]keyAccess)
+	srv.storage.pending = make(map[*communication.ServerReplicatedWriteRequest]struct{})
+	srv.maintainer.dependencyByClientId = make(map[string][]communication.DependencyData)
+	srv.strongKeyPrefixes = append(srv.strongKeyPrefixes, config.StrongKeyPrefixes...)
+	if config.SharedSecret != "" {
+		srv.sharedSecret = []byte(config.SharedSecret)
+	}
+	return srv
+}
+
+// Start listens to the ip:port of the config and serves the connections in the background
+func (srv *Server) Start() error {
+	return srv.start(srv.config.HostPort, srv.config.OtherServers)
+}
 
+// Start runs a server configured and started with the server commands read from stdin
 func Start() {
+	repl(New(Config{}))
+}
+
+// repl reads the server commands of srv from stdin, and stops srv gracefully at quit, at the end of stdin,
+// or at SIGINT or SIGTERM
+func repl(srv *Server) {
 	genericLogger.Println(welcomeMessage)
+	go func() {
+		waitForSignal()
+		srv.Stop()
+		genericLogger.Printf("%s!", goodbye)
+		os.Exit(0)
+	}()
 
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -76,7 +263,73 @@ func Start() {
 				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
 				break
 			}
-			err = start(args[1], args[2:])
+			err = srv.start(args[1], args[2:])
+		case tlsCmd:
+			if len(args) != 4 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.enableTLS(args[1], args[2], args[3])
+		case secretCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.setSharedSecret(args[1])
+		case dataCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.setDataFile(args[1])
+		case userCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.addUser(args[1], args[2])
+		case grantCmd:
+			if len(args) != 4 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.grantPermission(args[1], args[2], args[3])
+		case usersCmd:
+			result = srv.reportUsers()
+		case strongCmd:
+			if len(args) < 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.addStrongKeyPrefixes(args[1:])
+		case indexCmd:
+			if len(args) != 2 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.createIndex(args[1])
+		case cacheCmd:
+			result, err = srv.setCacheOnly()
+		case maxMemoryCmd:
+			if len(args) == 2 {
+				result, err = srv.setMemoryBudget(args[1], string(leastRecentlyUsed))
+			} else if len(args) == 3 {
+				result, err = srv.setMemoryBudget(args[1], args[2])
+			} else {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+			}
+		case limitCmd:
+			if len(args) != 3 {
+				err = fmt.Errorf("%s. %s", badArguments, helpPrompt)
+				break
+			}
+			result, err = srv.setLimit(args[1], args[2])
+		case limitsCmd:
+			result = srv.reportLimits()
+		case memoryCmd:
+			result = srv.reportMemoryUsage()
+		case statsCmd:
+			result = srv.reportStats()
 		case hCmd:
 			fallthrough
 		case helpCmd:
@@ -84,6 +337,7 @@ func Start() {
 		case qCmd:
 			fallthrough
 		case quitCmd:
+			srv.Stop()
 			genericLogger.Printf("%s!", goodbye)
 			return
 		default:
@@ -100,12 +354,23 @@ func Start() {
 	if err := scanner.Err(); err != nil {
 		log.Fatal(err)
 	}
+	srv.Stop()
 	genericLogger.Printf("%s!", goodbye)
 }
 
-func start(hostPort string, otherServers []string) error {
-	if selfHostPort != "" {
-		return fmt.Errorf("already listening on %q", selfHostPort)
+// addStrongKeyPrefixes marks keys with the prefixes as strongly consistent.
+// All servers must be configured with the same prefixes before they start
+func (srv *Server) addStrongKeyPrefixes(prefixes []string) (string, error) {
+	if srv.selfHostPort != "" {
+		return "", fmt.Errorf("strongly consistent prefixes must be set before %q", startCmd)
+	}
+	srv.strongKeyPrefixes = append(srv.strongKeyPrefixes, prefixes...)
+	return fmt.Sprintf("keys with prefixes %q will be strongly consistent", srv.strongKeyPrefixes), nil
+}
+
+func (srv *Server) start(hostPort string, otherServers []string) error {
+	if srv.selfHostPort != "" {
+		return fmt.Errorf("already listening on %q", srv.selfHostPort)
 	}
 
 	for _, hp := range append([]string{hostPort}, otherServers...) {
@@ -114,303 +379,1525 @@ func start(hostPort string, otherServers []string) error {
 		}
 	}
 
-	selfHostPort = hostPort
-	otherServersHostPorts = make([]string, len(otherServers))
-	copy(otherServersHostPorts, otherServers)
-	storage.storage = make(map[string]valueOfKey)
-	maintainer.dependencyByClientId = make(map[string][]communication.DependencyData)
+	if srv.isDraining() {
+		return errors.New("the server is stopped")
+	}
+	saved, err := srv.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	savedRaft, err := srv.loadRaftState()
+	if err != nil {
+		return err
+	}
 
 	// start to listen
 	l, err := net.Listen("tcp", hostPort)
 	if err != nil {
 		return err
 	}
-	infoLogger.Printf("server listening on %q", selfHostPort)
+	if srv.tlsConfig != nil {
+		l = tls.NewListener(l, srv.tlsConfig)
+	}
+	srv.Lock()
+	srv.listener = l
+	srv.Unlock()
+
+	srv.selfHostPort = hostPort
+	srv.otherServersHostPorts = make([]string, len(otherServers))
+	copy(srv.otherServersHostPorts, otherServers)
+	srv.startRaft(savedRaft)
+	go srv.sweepExpiredKeys()
+	go srv.sweepAbandonedUploads()
+	if saved != nil {
+		srv.resume(saved)
+	}
+
+	infoLogger.Printf("server listening on %q", srv.selfHostPort)
 	go func() {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
+				if srv.isDraining() {
+					return
+				}
 				errorLogger.Printf("%v", err)
 				continue
 			}
 
+			if !srv.limits.acquireConnection() {
+				errorLogger.Printf("rejecting connection from %q: too many connections", conn.RemoteAddr())
+				go srv.rejectConnection(conn)
+				continue
+			}
+			if !srv.trackConnection(conn) {
+				srv.limits.releaseConnection()
+				_ = conn.Close()
+				return
+			}
 			go func() {
-				defer func() {
-					_ = conn.Close()
-				}()
-
-				var resp []byte
-				var genericReq genericRequest
-				failToUnmarshalResp := makeFailResp("fail to unmarshal")
-				d := json.NewDecoder(conn)
-				err := d.Decode(&genericReq)
-				if err != nil {
-					resp = failToUnmarshalResp
-				} else {
-					switch genericReq.Op {
-					case communication.Connect:
-						var temp communication.ClientConnectRequestArgs
-						if err := json.Unmarshal(genericReq.Args, &temp); err != nil {
-							resp = failToUnmarshalResp
-							break
-						}
-						resp = handleClientConnect(communication.ClientConnectRequest{
-							Op:   genericReq.Op,
-							Args: temp,
-						})
-					case communication.Read:
-						var temp communication.ClientReadRequestArgs
-						if err := json.Unmarshal(genericReq.Args, &temp); err != nil {
-							resp = failToUnmarshalResp
-							break
-						}
-						resp = handleClientRead(communication.ClientReadRequest{
-							Op:   genericReq.Op,
-							Args: temp,
-						})
-					case communication.Write:
-						var temp communication.ClientWriteRequestArgs
-						if err := json.Unmarshal(genericReq.Args, &temp); err != nil {
-							resp = failToUnmarshalResp
-							break
-						}
-						resp = handleClientWrite(communication.ClientWriteRequest{
-							Op:   genericReq.Op,
-							Args: temp,
-						})
-					case communication.ReplicatedWrite:
-						var temp communication.ServerReplicatedWriteRequestArgs
-						if err := json.Unmarshal(genericReq.Args, &temp); err != nil {
-							resp = failToUnmarshalResp
-							break
-						}
-						handleServerReplicatedWrite(communication.ServerReplicatedWriteRequest{
-							Op:   genericReq.Op,
-							Args: temp,
-						})
-					default:
-						resp = makeFailResp(fmt.Sprintf("unknown operation %q", genericReq.Op))
-					}
-				}
-				if _, err := conn.Write(resp); err != nil {
-					errorLogger.Printf("%v", err)
-				}
+				defer srv.limits.releaseConnection()
+				defer srv.untrackConnection(conn)
+				srv.serveConnection(conn)
 			}()
 		}
 	}()
 	return nil
 }
 
+// serveConnection serves a single json request delimited by the connection close,
+// or many framed requests if the connection starts with the framed preamble
+func (srv *Server) serveConnection(c net.Conn) {
+	defer func() {
+		_ = c.Close()
+	}()
+	conn := deadlineConn{c, &srv.limits}
+	settings := srv.limits.get()
+	setReadDeadline(conn, settings.readTimeout)
+
+	r := bufio.NewReader(conn)
+	if b, err := r.Peek(1); err == nil && b[0] == communication.FramedPreamble[0] {
+		if p, err := r.Peek(len(communication.FramedPreamble)); err == nil && string(p) == communication.FramedPreamble {
+			_, _ = r.Discard(len(p))
+			srv.serveFramedConnection(conn, r)
+			return
+		}
+	}
+
+	var resp interface{}
+	var message json.RawMessage
+	var genericReq genericRequest
+	decode := func(req interface{}) error {
+		return json.Unmarshal(message, req)
+	}
+	limited := &io.LimitedReader{R: r, N: int64(settings.maxMessageSize) + 1}
+	d := json.NewDecoder(limited)
+	if err := d.Decode(&message); err != nil {
+		resp = makeReadFailResp(err, limited.N <= 0, settings.maxMessageSize)
+	} else if err := json.Unmarshal(message, &genericReq); err != nil {
+		resp = makeFailResp(communication.BadRequest, "fail to unmarshal")
+	} else if denied := authorizeOp(genericReq.Op, srv.isOtherServer(conn)); denied != nil {
+		resp = denied
+	} else if rejected := srv.limitRequest(conn, genericReq.Op, decode); rejected != nil {
+		resp = rejected
+	} else if !isStreamingOp(genericReq.Op) && !srv.beginRequest(c, srv.isOtherServer(conn)) {
+		resp = makeShuttingDownResp()
+	} else {
+		if !isStreamingOp(genericReq.Op) {
+			defer srv.endRequest(c)
+		}
+		// streaming ops read the connection to tell when the client disconnects, which may take any time
+		setReadDeadline(conn, 0)
+		var streamed bool
+		resp, streamed = srv.dispatch(conn, conn.RemoteAddr(), genericReq.Op, decode)
+		if streamed {
+			return
+		}
+	}
+	if resp == nil {
+		return
+	}
+	m, _ := json.Marshal(resp)
+	if _, err := conn.Write(m); err != nil {
+		errorLogger.Printf("%v", err)
+	}
+}
+
+// makeReadFailResp tells why a request could not be read
+func makeReadFailResp(err error, tooLarge bool, maxMessageSize int) interface{} {
+	var netErr net.Error
+	switch {
+	case tooLarge:
+		return makeFailResp(communication.TooLarge, fmt.Sprintf("message is larger than the maximum of %d bytes", maxMessageSize))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return makeFailResp(communication.Timeout, "timeout receiving the request")
+	default:
+		return makeFailResp(communication.BadRequest, "fail to unmarshal")
+	}
+}
+
+// session is what the two ends of a framed connection agreed on in the handshake
+type session struct {
+	protocolVersion int
+	features        map[string]bool
+	codec           communication.Codec
+}
+
+// serveFramedConnection serves the framed requests of a connection until it is closed.
+// The first request must be a hello, and the connection is closed if the handshake fails.
+// Requests are handled one at a time in the order they arrive, so the requests a client pipelines keep
+// their causal order, and responses are sent in the same order
+func (srv *Server) serveFramedConnection(conn deadlineConn, r *bufio.Reader) {
+	var sess *session
+	fromOtherServer := srv.isOtherServer(conn)
+	// another server authenticated by its certificate sends replicated writes of values as large as a client may
+	// write, which take more than the request of the client once replicated, so its messages are only bounded
+	// by the frame size
+	verifiedServer := fromOtherServer && srv.tlsConfig != nil
+	for {
+		// the connection may wait for its next request for the idle timeout,
+		// then the request must be received within the read timeout
+		settings := srv.limits.get()
+		setReadDeadline(conn, settings.idleTimeout)
+		if _, err := r.Peek(1); err != nil {
+			if err != io.EOF {
+				infoLogger.Printf("closing framed connection from %q: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		setReadDeadline(conn, settings.readTimeout)
+		maxSize := settings.maxMessageSize
+		if verifiedServer {
+			maxSize = communication.MaxFrameSize
+		}
+		requestId, message, err := communication.ReadFrameLimited(r, maxSize)
+		if err != nil {
+			errorLogger.Printf("framed connection from %q: %v", conn.RemoteAddr(), err)
+			var tooLarge *communication.FrameTooLargeError
+			if errors.As(err, &tooLarge) {
+				// the message is not read, so the connection is closed after telling the client
+				codec := communication.JsonCodec
+				if sess != nil {
+					codec = sess.codec
+				}
+				m, _ := codec.Marshal(makeFailResp(communication.TooLarge, err.Error()))
+				_ = communication.WriteFrame(conn, requestId, m)
+			}
+			return
+		}
+
+		// the hello is always in json, the requests after it in the codec agreed on
+		codec := communication.JsonCodec
+		if sess != nil {
+			codec = sess.codec
+		}
+		if !srv.beginRequest(conn.Conn, fromOtherServer) {
+			m, _ := codec.Marshal(makeShuttingDownResp())
+			_ = communication.WriteFrame(conn, requestId, m)
+			return
+		}
+		// a compressed request is bounded once decompressed as well, and decompressed once however many times
+		// it is decoded
+		decode := communication.NewDecoder(codec, message, maxSize)
+
+		var resp interface{}
+		var genericReq genericRequest
+		closing := false
+		if err := decode(&genericReq); errors.Is(err, communication.ErrTooLarge) {
+			resp = makeErrorResp(err)
+		} else if err != nil {
+			resp = makeFailResp(communication.BadRequest, "fail to unmarshal")
+		} else if denied := authorizeOp(genericReq.Op, fromOtherServer); denied != nil {
+			resp = denied
+		} else if genericReq.Op == communication.Hello {
+			sess, resp = shakeHands(decode, &srv.compression)
+			closing = sess == nil
+		} else if sess == nil {
+			resp = makeFailResp(communication.BadRequest, fmt.Sprintf("a framed connection must start with %s", communication.Hello))
+			closing = true
+		} else if rejected := srv.limitRequest(conn, genericReq.Op, decode); rejected != nil {
+			resp = rejected
+		} else if genericReq.Op == communication.ReplicatedWrite || genericReq.Op == communication.ReplicatedWriteBatch {
+			// a replicated write waits for its dependencies, which may come after it on the same connection,
+			// so it is accepted once verified, then committed in the background.
+			// It is in flight until committed, so that Stop waits for it or saves it as pending
+			writes, rejected := srv.acceptReplicatedWrites(genericReq.Op, conn.RemoteAddr(), decode)
+			switch {
+			case rejected != nil:
+				resp = rejected
+			case srv.beginRequest(nil, true):
+				go func() {
+					defer srv.endRequest(nil)
+					srv.handleServerReplicatedWrites(writes)
+				}()
+				resp = communication.GenericClientResponse{
+					Result:         communication.Success,
+					DetailedResult: fmt.Sprintf("%d replicated writes are accepted", len(writes)),
+				}
+			default:
+				resp = makeShuttingDownResp()
+			}
+		} else {
+			// streaming ops need a connection of their own, which a nil conn tells
+			resp, _ = srv.dispatch(nil, conn.RemoteAddr(), genericReq.Op, decode)
+		}
+
+		var m []byte
+		if resp != nil {
+			if m, err = codec.Marshal(resp); err != nil {
+				errorLogger.Printf("%v", err)
+				m = nil
+			}
+		}
+		err = communication.WriteFrame(conn, requestId, m)
+		srv.endRequest(conn.Conn)
+		if err != nil {
+			errorLogger.Printf("%v", err)
+			return
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// shakeHands handles the hello starting a framed connection, returning the session agreed on if it succeeds.
+// The messages compressed over the connection are counted in metrics
+func shakeHands(decode func(req interface{}) error, metrics *communication.CompressionMetrics) (*session, interface{}) {
+	var req communication.HelloRequest
+	if err := decode(&req); err != nil {
+		return nil, makeFailResp(communication.BadRequest, "fail to unmarshal")
+	}
+	r := hello(req)
+	if r.Result != communication.Success {
+		return nil, r
+	}
+	sess := &session{
+		protocolVersion: r.ProtocolVersion,
+		features:        make(map[string]bool),
+		codec:           communication.CodecOf(r.Features, metrics),
+	}
+	for _, f := range r.Features {
+		sess.features[f] = true
+	}
+	return sess, r
+}
+
+// dispatch handles a request according to its op, decoding the request with decode. from is the address of the peer
+// the request came from, and conn its connection if the op may take it over, nil on a framed connection.
+// It tells if the op took over conn to stream its responses, in which case there is no response to send
+func (srv *Server) dispatch(conn net.Conn, from net.Addr, op string, decode func(req interface{}) error) (resp interface{}, streamed bool) {
+	failToUnmarshalResp := makeFailResp(communication.BadRequest, "fail to unmarshal")
+	switch op {
+	case communication.Hello:
+		var req communication.HelloRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = handleHello(req)
+	case communication.Connect:
+		var req communication.ClientConnectRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientConnect(req)
+	case communication.Read:
+		var req communication.ClientReadRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientRead(req)
+	case communication.Write:
+		var req communication.ClientWriteRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientWrite(req)
+	case communication.Delete:
+		var req communication.ClientDeleteRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientDelete(req)
+	case communication.ReadAt:
+		var req communication.ClientReadAtRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientReadAt(req)
+	case communication.History:
+		var req communication.ClientHistoryRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientHistory(req)
+	case communication.Increment:
+		var req communication.ClientIncrementRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientIncrement(req)
+	case communication.SetAdd, communication.SetRemove:
+		var req communication.ClientSetElementRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		if req.Op == communication.SetAdd {
+			resp = srv.handleClientSetAdd(req)
+		} else {
+			resp = srv.handleClientSetRemove(req)
+		}
+	case communication.SetMembers:
+		var req communication.ClientSetMembersRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientSetMembers(req)
+	case communication.RegisterSet:
+		var req communication.ClientRegisterSetRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientRegisterSet(req)
+	case communication.Watch:
+		var req communication.ClientWatchRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		if conn == nil {
+			resp = makeFailResp(communication.Unsupported, fmt.Sprintf("%s needs a connection of its own", op))
+			break
+		}
+		// the connection is kept open to stream the changes
+		srv.handleClientWatch(conn, req)
+		return nil, true
+	case communication.ChangeFeed:
+		var req communication.ChangeFeedRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		if conn == nil {
+			resp = makeFailResp(communication.Unsupported, fmt.Sprintf("%s needs a connection of its own", op))
+			break
+		}
+		// the connection is kept open to stream the change records
+		srv.handleChangeFeed(conn, req)
+		return nil, true
+	case communication.CommitChangeFeedOffset:
+		var req communication.CommitChangeFeedOffsetRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleCommitChangeFeedOffset(req)
+	case communication.Query:
+		var req communication.ClientQueryRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientQuery(req)
+	case communication.WriteChunk:
+		var req communication.ClientWriteChunkRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientWriteChunk(req)
+	case communication.MultiRead:
+		var req communication.ClientMultiReadRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientMultiRead(req)
+	case communication.MultiWrite:
+		var req communication.ClientMultiWriteRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientMultiWrite(req)
+	case communication.Scan, communication.Prefix:
+		var req communication.ClientScanRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientScan(req)
+	case communication.CompareAndSet:
+		var req communication.ClientCompareAndSetRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientCompareAndSet(req)
+	case communication.SetIfAbsent:
+		var req communication.ClientSetIfAbsentRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		resp = srv.handleClientSetIfAbsent(req)
+	case communication.RaftRequestVote:
+		var req communication.ServerRaftRequestVoteRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		if err := srv.verifyServerMessage(req.Op, req.Args, req.Signature, req.Args.CandidateId, from); err != nil {
+			errorLogger.Printf("rejecting: %v", err)
+			resp = makeErrorResp(err)
+			break
+		}
+		resp = srv.handleServerRaftRequestVote(req)
+	case communication.RaftAppendEntries:
+		var req communication.ServerRaftAppendEntriesRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		if err := srv.verifyServerMessage(req.Op, req.Args, req.Signature, req.Args.LeaderId, from); err != nil {
+			errorLogger.Printf("rejecting: %v", err)
+			resp = makeErrorResp(err)
+			break
+		}
+		resp = srv.handleServerRaftAppendEntries(req)
+	case communication.RaftPropose:
+		var req communication.ServerRaftProposeRequest
+		if err := decode(&req); err != nil {
+			resp = failToUnmarshalResp
+			break
+		}
+		if err := srv.verifyServerMessage(req.Op, req.Args, req.Signature, req.Args.Sender, from); err != nil {
+			errorLogger.Printf("rejecting: %v", err)
+			resp = makeErrorResp(err)
+			break
+		}
+		resp = srv.handleServerRaftPropose(req)
+	case communication.ReplicatedWrite, communication.ReplicatedWriteBatch:
+		writes, rejected := srv.acceptReplicatedWrites(op, from, decode)
+		if rejected != nil {
+			resp = rejected
+			break
+		}
+		srv.handleServerReplicatedWrites(writes)
+	default:
+		resp = makeFailResp(communication.Unsupported, fmt.Sprintf("unknown operation %q", op))
+	}
+	return resp, false
+}
+
 // handleClientConnect handles the connection of a new client
-func handleClientConnect(req communication.ClientConnectRequest) []byte {
+func (srv *Server) handleClientConnect(req communication.ClientConnectRequest) interface{} {
+	password := req.Args.Password
+	if password != "" {
+		req.Args.Password = "<redacted>"
+	}
 	infoLogger.Printf("handling:")
 	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
 
+	token, err := srv.authenticate(req.Args.User, password)
+	if err != nil {
+		return makeErrorResp(err)
+	}
+
 	// add an empty dependency list for the new client
-	maintainer.Lock()
-	if _, ok := maintainer.dependencyByClientId[req.Args.ClientId]; !ok {
-		maintainer.dependencyByClientId[req.Args.ClientId] = make([]communication.DependencyData, 0)
+	srv.maintainer.Lock()
+	if _, ok := srv.maintainer.dependencyByClientId[req.Args.ClientId]; !ok {
+		srv.maintainer.dependencyByClientId[req.Args.ClientId] = make([]communication.DependencyData, 0)
 	}
-	maintainer.Unlock()
+	srv.maintainer.Unlock()
 
-	resp, _ := json.Marshal(communication.ClientConnectResponse{
+	return communication.ClientConnectResponse{
 		Op:             req.Op,
 		Result:         communication.Success,
 		DetailedResult: "connect is successful",
-	})
-	return resp
+		SessionToken:   token,
+	}
 }
 
 // handleClientRead handles client read while updating dependency data
-func handleClientRead(req communication.ClientReadRequest) []byte {
+func (srv *Server) handleClientRead(req communication.ClientReadRequest) interface{} {
 	infoLogger.Printf("handling:")
 	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
 
-	storage.Lock()
-	maintainer.Lock()
+	if err := srv.authorize(req.Args.SessionToken, readPermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
 	defer func() {
-		maintainer.Unlock()
-		storage.Unlock()
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
 	}()
 
-	v, ok := storage.storage[req.Args.Key]
+	v, ok := srv.storage.live(req.Args.Key)
 	if !ok {
-		return makeFailResp(fmt.Sprintf("key %q does not exist", req.Args.Key))
+		return makeErrorResp(srv.storage.missing(req.Args.Key))
 	}
 
 	// update dependency data
-	d := maintainer.dependencyByClientId[req.Args.ClientId]
-	maintainer.dependencyByClientId[req.Args.ClientId] = append(d, communication.DependencyData{
+	d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+	srv.maintainer.dependencyByClientId[req.Args.ClientId] = append(d, communication.DependencyData{
 		Key:                    req.Args.Key,
 		OriginalServer:         v.originalServer,
 		LamportsClockTimestamp: v.lamportsClockTimestamp,
 	})
 
-	resp, _ := json.Marshal(communication.ClientReadResponse{
+	value, encoding := communication.EncodeValue(v.value)
+	return communication.ClientReadResponse{
+		Op:                     req.Op,
+		Result:                 communication.Success,
+		DetailedResult:         "read is successful",
+		Key:                    req.Args.Key,
+		Value:                  value,
+		ValueEncoding:          encoding,
+		OriginalServer:         v.originalServer,
+		LamportsClockTimestamp: v.lamportsClockTimestamp,
+	}
+}
+
+// handleClientReadAt handles client read of the version of a key that was current at a given timestamp
+func (srv *Server) handleClientReadAt(req communication.ClientReadAtRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, readPermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
+
+	versions, ok := srv.storage.versionsOf(req.Args.Key)
+	if !ok {
+		return makeFailResp(communication.NotFound, fmt.Sprintf("key %q does not exist", req.Args.Key))
+	}
+
+	// find the first version written after the timestamp, the one before it is the answer
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].lamportsClockTimestamp > req.Args.LamportsClockTimestamp
+	})
+	if i == 0 {
+		return makeFailResp(communication.NotFound, fmt.Sprintf("no retained version of key %q at or before timestamp %d", req.Args.Key, req.Args.LamportsClockTimestamp))
+	}
+	if versions[i-1].deleted {
+		return makeFailResp(communication.NotFound, fmt.Sprintf("key %q was deleted at timestamp %d", req.Args.Key, versions[i-1].lamportsClockTimestamp))
+	}
+
+	return communication.ClientReadAtResponse{
 		Op:             req.Op,
 		Result:         communication.Success,
 		DetailedResult: "read is successful",
 		Key:            req.Args.Key,
-		Value:          v.value,
-	})
-	return resp
+		Version:        versions[i-1].toVersionData(),
+	}
 }
 
-// handleClientWrite handles client write and send replicated write to other servers
-func handleClientWrite(req communication.ClientWriteRequest) []byte {
+// handleClientHistory handles client request for the retained versions of a key
+func (srv *Server) handleClientHistory(req communication.ClientHistoryRequest) interface{} {
 	infoLogger.Printf("handling:")
 	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
 
-	k := req.Args.Key
-	v := req.Args.Value
+	if err := srv.authorize(req.Args.SessionToken, readPermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
 
-	storage.Lock()
-	maintainer.Lock()
-	clock.Lock()
+	srv.storage.Lock()
+	defer srv.storage.Unlock()
 
-	// increase the local lamport's clock
-	clock.clock++
-	storage.storage[k] = valueOfKey{
-		value:                  v,
-		originalServer:         selfHostPort,
-		lamportsClockTimestamp: clock.clock,
+	versions, ok := srv.storage.versionsOf(req.Args.Key)
+	if !ok {
+		return makeFailResp(communication.NotFound, fmt.Sprintf("key %q does not exist", req.Args.Key))
+	}
+
+	data := make([]communication.VersionData, 0, len(versions))
+	for _, v := range versions {
+		data = append(data, v.toVersionData())
 	}
 
-	resp, _ := json.Marshal(communication.ClientWriteResponse{
+	return communication.ClientHistoryResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "history is successful",
+		Key:            req.Args.Key,
+		Versions:       data,
+	}
+}
+
+// handleClientScan handles client listing of a range or a prefix of keys, a page at a time,
+// while updating dependency data with every key listed
+func (srv *Server) handleClientScan(req communication.ClientScanRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	limit := req.Args.Limit
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	from := req.Args.Start
+	inRange := func(k string) bool {
+		return req.Args.End == "" || k < req.Args.End
+	}
+	if req.Op == communication.Prefix {
+		from = req.Args.Prefix
+		inRange = func(k string) bool {
+			return strings.HasPrefix(k, req.Args.Prefix)
+		}
+	}
+	if _, err := srv.sessionUser(req.Args.SessionToken); err != nil {
+		return makeErrorResp(err)
+	}
+	if req.Args.Cursor != "" {
+		if req.Args.Cursor < from {
+			return makeFailResp(communication.BadRequest, fmt.Sprintf("cursor %q is out of range", req.Args.Cursor))
+		}
+		from = req.Args.Cursor
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	defer func() {
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+	}()
+
+	entries := make([]communication.KeyValue, 0, limit)
+	nextCursor := ""
+	d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+	for i := sort.SearchStrings(srv.storage.keys, from); i < len(srv.storage.keys) && inRange(srv.storage.keys[i]); i++ {
+		k := srv.storage.keys[i]
+		v, ok := srv.storage.live(k)
+		// keys the user may not read are left out
+		if !ok || srv.authorize(req.Args.SessionToken, readPermission, k) != nil {
+			continue
+		}
+		if len(entries) == limit {
+			nextCursor = k
+			break
+		}
+		entries = append(entries, makeKeyValue(k, v))
+		d = append(d, communication.DependencyData{
+			Key:                    k,
+			OriginalServer:         v.originalServer,
+			LamportsClockTimestamp: v.lamportsClockTimestamp,
+		})
+	}
+	srv.maintainer.dependencyByClientId[req.Args.ClientId] = d
+
+	return communication.ClientScanResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: fmt.Sprintf("%s is successful", req.Op),
+		Entries:        entries,
+		NextCursor:     nextCursor,
+	}
+}
+
+// handleClientWrite handles client write and send replicated write to other servers
+func (srv *Server) handleClientWrite(req communication.ClientWriteRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.clientWrite(req.Args); err != nil {
+		return makeErrorResp(err)
+	}
+
+	return communication.ClientWriteResponse{
 		Op:             req.Op,
 		Result:         communication.Success,
 		DetailedResult: "write is successful",
-		Key:            k,
-		Value:          v,
+		Key:            req.Args.Key,
+		Value:          req.Args.Value,
+		ValueEncoding:  req.Args.ValueEncoding,
+	}
+}
+
+// handleClientDelete handles client delete and sends the tombstone to other servers as a replicated write
+func (srv *Server) handleClientDelete(req communication.ClientDeleteRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	if srv.isStrongKey(req.Args.Key) {
+		r := srv.writeStrongly(communication.RaftLogEntry{
+			Key:      req.Args.Key,
+			ClientId: req.Args.ClientId,
+			Deleted:  true,
+		})
+		if r.Result != communication.Success {
+			return makeFailResp(r.ErrorCode, r.DetailedResult)
+		}
+	} else {
+		srv.storage.Lock()
+		srv.maintainer.Lock()
+		srv.clock.Lock()
+		// an evicted key still exists, so it can be deleted
+		current, ok := srv.storage.present(req.Args.Key)
+		if !ok {
+			srv.clock.Unlock()
+			srv.maintainer.Unlock()
+			srv.storage.Unlock()
+			return makeFailResp(communication.NotFound, fmt.Sprintf("key %q does not exist", req.Args.Key))
+		}
+		// the delete causally follows the version it removes
+		d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+		srv.maintainer.dependencyByClientId[req.Args.ClientId] = append(d, communication.DependencyData{
+			Key:                    req.Args.Key,
+			OriginalServer:         current.originalServer,
+			LamportsClockTimestamp: current.lamportsClockTimestamp,
+		})
+		srv.writeLocally(communication.ClientWriteRequestArgs{
+			ClientId: req.Args.ClientId,
+			Key:      req.Args.Key,
+		}, nil, true)
+	}
+
+	return communication.ClientDeleteResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "delete is successful",
+		Key:            req.Args.Key,
+	}
+}
+
+// handleClientMultiRead handles client read of many keys at once while updating dependency data
+func (srv *Server) handleClientMultiRead(req communication.ClientMultiReadRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	defer func() {
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+	}()
+
+	results := make([]communication.KeyResult, 0, len(req.Args.Keys))
+	d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+	for _, k := range req.Args.Keys {
+		if err := srv.authorize(req.Args.SessionToken, readPermission, k); err != nil {
+			results = append(results, communication.KeyResult{
+				Key:            k,
+				Result:         communication.Fail,
+				DetailedResult: err.Error(),
+				ErrorCode:      communication.CodeOf(err),
+			})
+			continue
+		}
+		v, ok := srv.storage.live(k)
+		if !ok {
+			err := srv.storage.missing(k)
+			results = append(results, communication.KeyResult{
+				Key:            k,
+				Result:         communication.Fail,
+				DetailedResult: err.Error(),
+				ErrorCode:      communication.CodeOf(err),
+			})
+			continue
+		}
+		kv := makeKeyValue(k, v)
+		results = append(results, communication.KeyResult{
+			Key:            k,
+			Value:          kv.Value,
+			ValueEncoding:  kv.ValueEncoding,
+			Result:         communication.Success,
+			DetailedResult: "read is successful",
+		})
+		d = append(d, communication.DependencyData{
+			Key:                    k,
+			OriginalServer:         v.originalServer,
+			LamportsClockTimestamp: v.lamportsClockTimestamp,
+		})
+	}
+	srv.maintainer.dependencyByClientId[req.Args.ClientId] = d
+
+	return communication.ClientMultiResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "multi-read is successful",
+		Results:        results,
+	}
+}
+
+// handleClientMultiWrite handles client write of many keys at once. The writes are committed in order,
+// each one causally following the previous ones
+func (srv *Server) handleClientMultiWrite(req communication.ClientMultiWriteRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	results := make([]communication.KeyResult, 0, len(req.Args.Entries))
+	for _, e := range req.Args.Entries {
+		err := srv.clientWrite(communication.ClientWriteRequestArgs{
+			ClientId:            req.Args.ClientId,
+			SessionToken:        req.Args.SessionToken,
+			Key:                 e.Key,
+			Value:               e.Value,
+			ValueEncoding:       e.ValueEncoding,
+			TimeToLiveInSeconds: req.Args.TimeToLiveInSeconds,
+		})
+		r := communication.KeyResult{
+			Key:            e.Key,
+			Value:          e.Value,
+			ValueEncoding:  e.ValueEncoding,
+			Result:         communication.Success,
+			DetailedResult: "write is successful",
+		}
+		if err != nil {
+			r.Result = communication.Fail
+			r.DetailedResult = err.Error()
+			r.ErrorCode = communication.CodeOf(err)
+		}
+		results = append(results, r)
+	}
+
+	return communication.ClientMultiResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "multi-write is successful",
+		Results:        results,
+	}
+}
+
+// clientWrite commits a client write, through the consensus group if the key is strongly consistent
+func (srv *Server) clientWrite(args communication.ClientWriteRequestArgs) error {
+	if err := srv.authorize(args.SessionToken, writePermission, args.Key); err != nil {
+		return err
+	}
+	if args.TimeToLiveInSeconds < 0 {
+		return communication.Errorf(communication.BadRequest, "negative time to live %d", args.TimeToLiveInSeconds)
+	}
+	value, err := communication.DecodeValue(args.Value, args.ValueEncoding)
+	if err != nil {
+		return err
+	}
+	args.Value, args.ValueEncoding = value, ""
+
+	if srv.isStrongKey(args.Key) {
+		entry := communication.RaftLogEntry{
+			Key:      args.Key,
+			Value:    args.Value,
+			ClientId: args.ClientId,
+		}
+		if args.TimeToLiveInSeconds > 0 {
+			entry.ExpiresAtUnixNano = time.Now().Add(time.Duration(args.TimeToLiveInSeconds) * time.Second).UnixNano()
+		}
+		r := srv.writeStrongly(entry)
+		if r.Result != communication.Success {
+			return communication.ErrorOf(r.ErrorCode, r.DetailedResult)
+		}
+		return nil
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.clock.Lock()
+	if current, ok := srv.storage.live(args.Key); ok && current.crdt != nil {
+		srv.clock.Unlock()
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+		return communication.Errorf(communication.Conflict, "key %q holds a %s", args.Key, current.crdt.Type)
+	}
+	srv.writeLocally(args, nil, false)
+	return nil
+}
+
+// handleClientCompareAndSet handles client write that only takes effect if the key's current version matches
+// the expected one. The check is made against this server's replica only, see communication.CompareAndSet
+func (srv *Server) handleClientCompareAndSet(req communication.ClientCompareAndSetRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	value, err := communication.DecodeValue(req.Args.Value, req.Args.ValueEncoding)
+	if err != nil {
+		return makeErrorResp(err)
+	}
+
+	if srv.isStrongKey(req.Args.Key) {
+		return makeStrongConditionalWriteResp(req.Op, req.Args.Key, value, srv.writeStrongly(communication.RaftLogEntry{
+			Key:                            req.Args.Key,
+			Value:                          value,
+			ClientId:                       req.Args.ClientId,
+			Condition:                      communication.CompareAndSet,
+			ExpectedOriginalServer:         req.Args.ExpectedOriginalServer,
+			ExpectedLamportsClockTimestamp: req.Args.ExpectedLamportsClockTimestamp,
+		}))
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.clock.Lock()
+
+	// an evicted key still exists at its version, which the condition is checked against
+	current, ok := srv.storage.present(req.Args.Key)
+	if ok && current.crdt != nil {
+		srv.clock.Unlock()
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+		return makeFailResp(communication.Conflict, fmt.Sprintf("key %q holds a %s", req.Args.Key, current.crdt.Type))
+	}
+	if !ok || current.originalServer != req.Args.ExpectedOriginalServer ||
+		current.lamportsClockTimestamp != req.Args.ExpectedLamportsClockTimestamp {
+		srv.clock.Unlock()
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+		return makeConditionalWriteMismatchResp(req.Op, req.Args.Key, current, ok)
+	}
+
+	// the write causally follows the version it was compared against
+	d := srv.maintainer.dependencyByClientId[req.Args.ClientId]
+	srv.maintainer.dependencyByClientId[req.Args.ClientId] = append(d, communication.DependencyData{
+		Key:                    req.Args.Key,
+		OriginalServer:         current.originalServer,
+		LamportsClockTimestamp: current.lamportsClockTimestamp,
 	})
+	srv.writeLocally(communication.ClientWriteRequestArgs{
+		ClientId: req.Args.ClientId,
+		Key:      req.Args.Key,
+		Value:    value,
+	}, nil, false)
+
+	return communication.ClientConditionalWriteResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "compare-and-set is successful",
+		Key:            req.Args.Key,
+		Value:          req.Args.Value,
+		ValueEncoding:  req.Args.ValueEncoding,
+	}
+}
+
+// handleClientSetIfAbsent handles client write that only takes effect if this server has never seen the key
+func (srv *Server) handleClientSetIfAbsent(req communication.ClientSetIfAbsentRequest) interface{} {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	if err := srv.authorize(req.Args.SessionToken, writePermission, req.Args.Key); err != nil {
+		return makeErrorResp(err)
+	}
+
+	value, err := communication.DecodeValue(req.Args.Value, req.Args.ValueEncoding)
+	if err != nil {
+		return makeErrorResp(err)
+	}
+
+	if srv.isStrongKey(req.Args.Key) {
+		return makeStrongConditionalWriteResp(req.Op, req.Args.Key, value, srv.writeStrongly(communication.RaftLogEntry{
+			Key:       req.Args.Key,
+			Value:     value,
+			ClientId:  req.Args.ClientId,
+			Condition: communication.SetIfAbsent,
+		}))
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.clock.Lock()
+
+	// an evicted key still exists, so it is not overwritten
+	if current, ok := srv.storage.present(req.Args.Key); ok {
+		srv.clock.Unlock()
+		srv.maintainer.Unlock()
+		srv.storage.Unlock()
+		return makeConditionalWriteMismatchResp(req.Op, req.Args.Key, current, ok)
+	}
+	srv.writeLocally(communication.ClientWriteRequestArgs{
+		ClientId: req.Args.ClientId,
+		Key:      req.Args.Key,
+		Value:    value,
+	}, nil, false)
+
+	return communication.ClientConditionalWriteResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "set-if-absent is successful",
+		Key:            req.Args.Key,
+		Value:          req.Args.Value,
+		ValueEncoding:  req.Args.ValueEncoding,
+	}
+}
+
+// writeStrongly orders a client write of a strongly consistent key through the consensus group,
+// then makes it a dependency of the client's subsequent writes
+func (srv *Server) writeStrongly(entry communication.RaftLogEntry) communication.ServerRaftProposeResponse {
+	entry.Value, entry.ValueEncoding = communication.EncodeValue(entry.Value)
+	srv.maintainer.Lock()
+	entry.Dependencies = srv.maintainer.dependencyByClientId[entry.ClientId]
+	srv.maintainer.Unlock()
+	r := srv.proposeStrongWrite(entry, false)
+	if r.Result == communication.Success {
+		// the entry is applied after the dependencies it carries, so it is the only one left
+		srv.maintainer.Lock()
+		srv.maintainer.dependencyByClientId[entry.ClientId] = []communication.DependencyData{
+			{
+				Key:                    r.Entry.Key,
+				OriginalServer:         r.Entry.OriginalServer,
+				LamportsClockTimestamp: r.Entry.Clock,
+			},
+		}
+		srv.maintainer.Unlock()
+	}
+	return r
+}
+
+// writeLocally commits a client write at this server and sends replicated write to other servers.
+// crdt is the state of a CRDT value, or nil for a plain value, and deleted tells the write is the tombstone of a delete.
+// The caller must hold the locks of storage, maintainer and clock,
+// they are released once the replicated write has been prepared
+func (srv *Server) writeLocally(args communication.ClientWriteRequestArgs, crdt *communication.CrdtState, deleted bool) {
+	k := args.Key
+	v := args.Value
+	var expiresAt int64
+	if args.TimeToLiveInSeconds > 0 {
+		expiresAt = time.Now().Add(time.Duration(args.TimeToLiveInSeconds) * time.Second).UnixNano()
+	}
+
+	// increase the local lamport's clock
+	srv.clock.clock++
+	srv.commit(k, valueOfKey{
+		value:                  v,
+		originalServer:         srv.selfHostPort,
+		lamportsClockTimestamp: srv.clock.clock,
+		crdt:                   crdt,
+		expiresAt:              expiresAt,
+		deleted:                deleted,
+	}, srv.maintainer.dependencyByClientId[args.ClientId])
 
 	// perform replicated write
 	go func() {
 		defer func() {
-			clock.Unlock()
-			maintainer.Unlock()
-			storage.Unlock()
+			srv.clock.Unlock()
+			srv.maintainer.Unlock()
+			srv.storage.Unlock()
 		}()
 
-		r, _ := json.Marshal(communication.ServerReplicatedWriteRequest{
+		value, encoding := communication.EncodeValue(v)
+		r := communication.ServerReplicatedWriteRequest{
 			Op: communication.ReplicatedWrite,
 			Args: communication.ServerReplicatedWriteRequestArgs{
-				Key:      k,
-				Value:    v,
-				ClientId: req.Args.ClientId,
+				Key:           k,
+				Value:         value,
+				ValueEncoding: encoding,
+				ClientId:      args.ClientId,
 				// local dependencies are given to other servers
-				Dependencies:   maintainer.dependencyByClientId[req.Args.ClientId],
-				OriginalServer: selfHostPort,
-				Clock:          clock.clock,
+				Dependencies:      srv.maintainer.dependencyByClientId[args.ClientId],
+				OriginalServer:    srv.selfHostPort,
+				Clock:             srv.clock.clock,
+				Crdt:              crdt,
+				ExpiresAtUnixNano: expiresAt,
+				Deleted:           deleted,
 			},
-		})
+		}
+		r.Signature = srv.signMessage(r.Op, r.Args)
 
 		// update local dependencies
-		maintainer.dependencyByClientId[req.Args.ClientId] = []communication.DependencyData{
+		srv.maintainer.dependencyByClientId[args.ClientId] = []communication.DependencyData{
 			{
 				Key:                    k,
-				OriginalServer:         selfHostPort,
-				LamportsClockTimestamp: clock.clock,
+				OriginalServer:         srv.selfHostPort,
+				LamportsClockTimestamp: srv.clock.clock,
 			},
 		}
 
 		// send replicated write to other servers
-		for _, hp := range otherServersHostPorts {
-			go func(hp string) {
-				// simulate network delay for the particular server
-				if req.Args.ReplicatedWriteDelayServer == hp {
-					time.Sleep(time.Duration(req.Args.ReplicatedWriteDelayInSeconds) * time.Second)
-				}
-
-				dialer := net.Dialer{Timeout: 3 * time.Second}
-				conn, err := dialer.Dial("tcp", hp)
-				if err != nil {
-					errorLogger.Printf("%v", err)
-				}
-				if _, err := conn.Write(r); err != nil {
-					errorLogger.Printf("%v", err)
-				}
-				_ = conn.Close()
-			}(hp)
+		for _, hp := range srv.otherServersHostPorts {
+			var delay time.Duration
+			// simulate network delay for the particular server
+			if args.ReplicatedWriteDelayServer == hp {
+				delay = time.Duration(args.ReplicatedWriteDelayInSeconds) * time.Second
+			}
+			srv.sendReplicatedWrite(srv.outbound.add(hp, r), delay)
 		}
 	}()
 
+	if deleted {
+		genericLogger.Printf(">>>>> committed delete of %q", k)
+		return
+	}
 	genericLogger.Printf(">>>>> committed %q->%q", k, v)
-	return resp
 }
 
-// handleServerReplicatedWrite handles replicated write from another server, ensuring causal consistency
-func handleServerReplicatedWrite(req communication.ServerReplicatedWriteRequest) {
+// handleServerReplicatedWrite handles replicated write from another server, ensuring causal consistency.
+// A write still waiting for its dependencies when the server stops is left pending, and saved with its state
+func (srv *Server) handleServerReplicatedWrite(req communication.ServerReplicatedWriteRequest) {
 	infoLogger.Printf("handling:")
 	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
 
 	k := req.Args.Key
 	v := req.Args.Value
-	defer func() {
-		// increase local lamport's clock after committing
-		clock.Lock()
-		clock.clock = nextLamportsClock(clock.clock, req.Args.Clock)
-		clock.Unlock()
-		genericLogger.Printf(">>>>> committed %q->%q", k, v)
-	}()
 
+	// sort the dependencies by LamportsClockTimestamp from small to large
 	dependencies := req.Args.Dependencies
-	// if there are no dependencies, commit directly
-	if len(dependencies) == 0 {
-		storage.Lock()
-		defer storage.Unlock()
-		storage.storage[k] = valueOfKey{
-			value:                  v,
-			originalServer:         req.Args.OriginalServer,
-			lamportsClockTimestamp: req.Args.Clock,
-		}
-		return
-	}
-
-	// else there are dependencies, first sort them by LamportsClockTimestamp from small to large
 	sort.Slice(dependencies, func(i, j int) bool {
 		return dependencies[i].LamportsClockTimestamp < dependencies[j].LamportsClockTimestamp
 	})
 
 	// ensure causal consistency
-	storage.Lock()
-	defer storage.Unlock()
+	srv.storage.Lock()
+	srv.storage.pending[&req] = struct{}{}
 	// look at dependencies from small LamportsClockTimestamp to large
 	for _, dependency := range dependencies {
 		// keep checking the dependency until satisfied
 		for {
-			// if the dependency's key value pair has been recorded
-			if storedValue, ok := storage.storage[dependency.Key]; ok {
-				// if the last write of the key value pair is at a clock same as or later than the dependency,
-				// it means the local state of the key value pair is newer than the dependency,
-				// which means the dependency has been satisfied,
-				// so break the checking loop and move on to the next dependency
-				if storedValue.lamportsClockTimestamp >= dependency.LamportsClockTimestamp {
-					break
-				}
+			// if the dependency has been satisfied, break the checking loop and move on to the next dependency
+			if srv.storage.satisfies(dependency) {
+				break
 			}
-			// else go to sleep
-			storage.Unlock()
+			// else go to sleep, unless the server is stopping: the write is then left pending,
+			// so that Stop does not wait for it, and saved with the state of the server
+			if srv.isDraining() {
+				srv.storage.Unlock()
+				infoLogger.Printf("the write of %q->%q is left pending", k, v)
+				return
+			}
+			srv.storage.Unlock()
 			infoLogger.Printf("delaying the write of %q->%q", k, v)
-			time.Sleep(1 * time.Second)
-			storage.Lock()
+			select {
+			case <-time.After(1 * time.Second):
+			case <-srv.draining:
+			}
+			srv.storage.Lock()
 		}
 	}
 
 	// all dependencies have been received, can commit
-	storage.storage[k] = valueOfKey{
-		value:                  v,
-		originalServer:         req.Args.OriginalServer,
-		lamportsClockTimestamp: req.Args.Clock,
+	delete(srv.storage.pending, &req)
+	srv.commitReplicatedWrite(req.Args)
+	// increase local lamport's clock after committing, before a local write may follow,
+	// so that local writes are newer than the versions committed
+	srv.clock.Lock()
+	srv.clock.clock = nextLamportsClock(srv.clock.clock, req.Args.Clock)
+	srv.clock.Unlock()
+	srv.storage.Unlock()
+	genericLogger.Printf(">>>>> committed %q->%q", k, v)
+}
+
+// acceptReplicatedWrites decodes a replicated write or a batch of them, and verifies each comes from its original
+// server. It returns the writes to commit, or the fail response rejecting them all
+func (srv *Server) acceptReplicatedWrites(op string, from net.Addr, decode func(req interface{}) error) ([]communication.ServerReplicatedWriteRequest, interface{}) {
+	var writes []communication.ServerReplicatedWriteRequest
+	if op == communication.ReplicatedWriteBatch {
+		var req communication.ServerReplicatedWriteBatchRequest
+		if err := decode(&req); err != nil {
+			return nil, makeFailResp(communication.BadRequest, "fail to unmarshal")
+		}
+		writes = req.Args.Writes
+	} else {
+		var req communication.ServerReplicatedWriteRequest
+		if err := decode(&req); err != nil {
+			return nil, makeFailResp(communication.BadRequest, "fail to unmarshal")
+		}
+		writes = []communication.ServerReplicatedWriteRequest{req}
+	}
+	for _, w := range writes {
+		if err := srv.verifyServerMessage(communication.ReplicatedWrite, w.Args, w.Signature, w.Args.OriginalServer, from); err != nil {
+			errorLogger.Printf("rejecting: %v", err)
+			return nil, makeErrorResp(err)
+		}
+	}
+	return writes, nil
+}
+
+// handleServerReplicatedWrites handles replicated writes in the order they were sent. A write whose dependencies
+// are not satisfied yet waits for them in the background, as if it came on its own, so that it does not hold
+// the writes after it
+func (srv *Server) handleServerReplicatedWrites(writes []communication.ServerReplicatedWriteRequest) {
+	var wg sync.WaitGroup
+	for _, w := range writes {
+		srv.storage.Lock()
+		satisfied := srv.storage.satisfiesAll(w.Args.Dependencies)
+		srv.storage.Unlock()
+		if satisfied {
+			srv.handleServerReplicatedWrite(w)
+			continue
+		}
+		wg.Add(1)
+		go func(w communication.ServerReplicatedWriteRequest) {
+			defer wg.Done()
+			srv.handleServerReplicatedWrite(w)
+		}(w)
 	}
+	wg.Wait()
 }
 
-func makeFailResp(detailedResult string) []byte {
-	resp, _ := json.Marshal(communication.GenericClientResponse{
+// satisfies tells if a dependency has been satisfied: the last write of its key is at a clock same as or later
+// than the dependency, which means the local state of the key is newer than the dependency.
+// The caller must hold the lock of s
+func (s *kvStorage) satisfies(dependency communication.DependencyData) bool {
+	storedValue, ok := s.storage[dependency.Key]
+	return ok && storedValue.lamportsClockTimestamp >= dependency.LamportsClockTimestamp
+}
+
+// satisfiesAll tells if all the dependencies have been satisfied. The caller must hold the lock of s
+func (s *kvStorage) satisfiesAll(dependencies []communication.DependencyData) bool {
+	for _, dependency := range dependencies {
+		if !s.satisfies(dependency) {
+			return false
+		}
+	}
+	return true
+}
+
+// commitReplicatedWrite commits a replicated write whose dependencies are satisfied,
+// merging a CRDT value with the local state of the key. The caller must hold the lock of storage
+func (srv *Server) commitReplicatedWrite(args communication.ServerReplicatedWriteRequestArgs) {
+	// a write sent again after its server restarted may already be committed
+	if srv.storage.hasVersion(args.Key, args.OriginalServer, args.Clock) {
+		return
+	}
+	value, err := communication.DecodeValue(args.Value, args.ValueEncoding)
+	if err != nil {
+		errorLogger.Printf("%v", err)
+		return
+	}
+	v := valueOfKey{
+		value:                  value,
+		originalServer:         args.OriginalServer,
+		lamportsClockTimestamp: args.Clock,
+		crdt:                   args.Crdt,
+		expiresAt:              args.ExpiresAtUnixNano,
+		deleted:                args.Deleted,
+	}
+
+	srv.commit(args.Key, v, args.Dependencies)
+}
+
+// commit stores a new version of a key and records it in the key's bounded history and in the change feed.
+// The version only becomes the current value of the key if it is not older than the current one, since replicated
+// writes may arrive out of order: the last writer wins, so replicas converge whatever the order writes arrive in.
+// CRDT values merge instead, as mergeVersion tells.
+// dependencies are the ones the write was committed after.
+// The caller must hold the lock of the storage
+func (srv *Server) commit(key string, v valueOfKey, dependencies []communication.DependencyData) {
+	s := &srv.storage
+	s.unspill(key)
+	current, ok := s.storage[key]
+	if !ok {
+		i := sort.SearchStrings(s.keys, key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = key
+	}
+	before := s.footprint(key)
+	newest := !ok || !v.before(current)
+
+	// keep the history ordered by timestamp, since replicated writes may arrive out of order
+	versions := s.history[key]
+	i := sort.Search(len(versions), func(i int) bool {
+		return v.before(versions[i])
+	})
+	versions = append(versions, valueOfKey{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = v
+
+	now := time.Now().UnixNano()
+	if newest {
+		s.storage[key] = mergeVersion(current, ok, v, now)
+	} else {
+		s.storage[key] = mergeOlderVersion(current, versions[i:], now)
+	}
+
+	if len(versions) > maxVersionsPerKey {
+		versions = versions[len(versions)-maxVersionsPerKey:]
+	}
+	s.history[key] = versions
+	s.usedMemory += s.footprint(key) - before
+	s.touch(key)
+	srv.evictIfNeeded(key)
+
+	if newest {
+		v = s.storage[key]
+	}
+	srv.indexes.update(key, s.storage[key].value)
+	srv.watchers.notify(key, v)
+	srv.changes.append(key, v, dependencies)
+}
+
+// hasVersion tells if a version of a key is its current one or in its history.
+// The caller must hold the lock of the storage
+func (s *kvStorage) hasVersion(key, originalServer string, lamportsClockTimestamp uint64) bool {
+	same := func(v valueOfKey) bool {
+		return v.originalServer == originalServer && v.lamportsClockTimestamp == lamportsClockTimestamp
+	}
+	if v, ok := s.storage[key]; ok && same(v) {
+		return true
+	}
+	versions, _ := s.versionsOf(key)
+	for _, v := range versions {
+		if same(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// live returns the value of a key if it exists and has not expired.
+// The caller must hold the lock of the storage
+func (s *kvStorage) live(key string) (valueOfKey, bool) {
+	return s.liveAt(key, time.Now().UnixNano())
+}
+
+// liveAt returns the value of a key if it exists, has not expired at the given unix time in nanoseconds
+// and was not evicted. The caller must hold the lock of the storage
+func (s *kvStorage) liveAt(key string, now int64) (valueOfKey, bool) {
+	v, ok := s.presentAt(key, now)
+	if !ok || v.evicted {
+		return valueOfKey{}, false
+	}
+	s.touch(key)
+	return v, true
+}
+
+// present returns the version of a key if it exists and has not expired, even if its value was evicted,
+// which conditional writes check their condition against. The caller must hold the lock of the storage
+func (s *kvStorage) present(key string) (valueOfKey, bool) {
+	return s.presentAt(key, time.Now().UnixNano())
+}
+
+// the caller must hold the lock of the storage
+func (s *kvStorage) presentAt(key string, now int64) (valueOfKey, bool) {
+	v, ok := s.storage[key]
+	if !ok || v.deleted || v.expiredAt(now) {
+		return valueOfKey{}, false
+	}
+	if v.spilled {
+		spilled, _, err := s.readSpilled(key)
+		if err != nil {
+			errorLogger.Printf("failed to read the value of %q from disk: %v", key, err)
+			v.spilled, v.evicted = false, true
+			return v, true
+		}
+		return spilled, true
+	}
+	return v, true
+}
+
+// missing tells why a key has no live value: it was evicted, or it does not exist.
+// The caller must hold the lock of the storage
+func (s *kvStorage) missing(key string) error {
+	if v, ok := s.present(key); ok && v.evicted {
+		return communication.Errorf(communication.Evicted, "the value of key %q at version (%q, %d) was evicted",
+			key, v.originalServer, v.lamportsClockTimestamp)
+	}
+	return communication.Errorf(communication.NotFound, "key %q does not exist", key)
+}
+
+// sweepExpiredKeys periodically drops the values and history of expired keys.
+// Their latest version is retained, so that replicated writes depending on them can still be committed
+func (srv *Server) sweepExpiredKeys() {
+	ticker := time.NewTicker(expirationSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.stopped:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now().UnixNano()
+		srv.storage.Lock()
+		for k, v := range srv.storage.storage {
+			if v.expiresAt == 0 || v.expiresAt > now || (v.value == "" && v.crdt == nil && !v.spilled) {
+				continue
+			}
+			if v.spilled {
+				srv.storage.removeSpilled(k)
+			}
+			before := srv.storage.footprint(k)
+			srv.storage.storage[k] = valueOfKey{
+				originalServer:         v.originalServer,
+				lamportsClockTimestamp: v.lamportsClockTimestamp,
+				expiresAt:              v.expiresAt,
+			}
+			delete(srv.storage.history, k)
+			delete(srv.storage.accessByKey, k)
+			srv.storage.usedMemory += srv.storage.footprint(k) - before
+			srv.indexes.update(k, "")
+		}
+		srv.storage.Unlock()
+	}
+}
+
+// expiredAt tells if the value has expired at the given unix time in nanoseconds
+func (v valueOfKey) expiredAt(now int64) bool {
+	return v.expiresAt != 0 && v.expiresAt <= now
+}
+
+// before orders versions by timestamp, breaking ties by the original server
+func (v valueOfKey) before(other valueOfKey) bool {
+	if v.lamportsClockTimestamp != other.lamportsClockTimestamp {
+		return v.lamportsClockTimestamp < other.lamportsClockTimestamp
+	}
+	return v.originalServer < other.originalServer
+}
+
+func (v valueOfKey) toVersionData() communication.VersionData {
+	value, encoding := communication.EncodeValue(v.value)
+	return communication.VersionData{
+		Value:                  value,
+		ValueEncoding:          encoding,
+		OriginalServer:         v.originalServer,
+		LamportsClockTimestamp: v.lamportsClockTimestamp,
+		Deleted:                v.deleted,
+	}
+}
+
+// makeConditionalWriteMismatchResp reports a failed conditional write together with the key's current version
+func makeConditionalWriteMismatchResp(op, key string, current valueOfKey, exists bool) interface{} {
+	r := communication.ClientConditionalWriteResponse{
+		Op:             op,
+		Result:         communication.Fail,
+		DetailedResult: fmt.Sprintf("key %q does not exist", key),
+		ErrorCode:      communication.NotFound,
+		Key:            key,
+	}
+	if exists {
+		r.ErrorCode = communication.Conflict
+		version := current.toVersionData()
+		r.DetailedResult = fmt.Sprintf("key %q is at version (%q, %d)", key, current.originalServer, current.lamportsClockTimestamp)
+		r.CurrentVersion = &version
+	}
+	return r
+}
+
+// makeStrongConditionalWriteResp turns the outcome of a conditional write through the consensus group
+// into a client response
+func makeStrongConditionalWriteResp(op, key, value string, r communication.ServerRaftProposeResponse) interface{} {
+	value, encoding := communication.EncodeValue(value)
+	return communication.ClientConditionalWriteResponse{
+		Op:             op,
+		Result:         r.Result,
+		DetailedResult: r.DetailedResult,
+		ErrorCode:      r.ErrorCode,
+		Key:            key,
+		Value:          value,
+		ValueEncoding:  encoding,
+		CurrentVersion: r.CurrentVersion,
+	}
+}
+
+// makeKeyValue makes the KeyValue of a key, encoded to be carried in json
+func makeKeyValue(k string, v valueOfKey) communication.KeyValue {
+	value, encoding := communication.EncodeValue(v.value)
+	return communication.KeyValue{Key: k, Value: value, ValueEncoding: encoding}
+}
+
+func makeFailResp(code communication.ErrorCode, detailedResult string) interface{} {
+	return communication.GenericClientResponse{
 		Result:         communication.Fail,
 		DetailedResult: detailedResult,
-	})
-	return resp
+		ErrorCode:      code,
+	}
+}
+
+// makeErrorResp makes the fail response of an error, with its code if it is a communication.Error
+func makeErrorResp(err error) interface{} {
+	return makeFailResp(communication.CodeOf(err), err.Error())
 }
 
 func nextLamportsClock(local, message uint64) uint64 {
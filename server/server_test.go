@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"Lab2/communication"
+)
+
+func TestServersInOneProcessReplicateAndSaveTheirState(t *testing.T) {
+	servers := startCluster(t, 3, t.TempDir(), "strong/")
+	ctx := context.Background()
+
+	c := connect(t, servers[0])
+	for _, key := range []string{"k", "kept"} {
+		if err := c.Put(ctx, key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, srv := range servers {
+		srv := srv
+		eventually(t, "every server commits the writes", func() bool {
+			k, okK := currentValue(srv, "k")
+			kept, okKept := currentValue(srv, "kept")
+			return okK && k == "v" && okKept && kept == "v"
+		})
+	}
+
+	// the key is deleted at another server than the one it was written at
+	if err := connect(t, servers[1]).Delete(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range servers {
+		srv := srv
+		eventually(t, "every server commits the delete", func() bool {
+			_, ok := currentValue(srv, "k")
+			return !ok
+		})
+	}
+
+	// the write fails until a leader is elected
+	c = connect(t, servers[2])
+	eventually(t, "a strong write commits", func() bool {
+		err := c.Put(ctx, "strong/k", "v")
+		if err != nil && !errors.Is(err, communication.ErrUnavailable) {
+			t.Fatal(err)
+		}
+		return err == nil
+	})
+	for _, srv := range servers {
+		srv := srv
+		eventually(t, "every server applies the strong write", func() bool {
+			v, ok := currentValue(srv, "strong/k")
+			return ok && v == "v"
+		})
+	}
+
+	for _, srv := range servers {
+		srv.Stop()
+	}
+	for _, srv := range servers {
+		saved := readSnapshot(t, srv.config.DataFile)
+		if k, ok := saved.Keys["k"]; !ok || !k.Current.Deleted {
+			t.Errorf("server %q saved %q as %+v, want its tombstone", srv.config.HostPort, "k", k)
+		}
+		for _, key := range []string{"kept", "strong/k"} {
+			if v, ok := saved.Keys[key]; !ok || v.Current.Value != "v" {
+				t.Errorf("server %q saved %q as %+v, want %q", srv.config.HostPort, key, v, "v")
+			}
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"Lab2/communication"
+)
+
+const (
+	// defaultShutdownTimeout bounds the time Stop waits for the requests in flight and the outbound replicated writes
+	defaultShutdownTimeout = 10 * time.Second
+	// shutdownPollInterval is how often Stop checks whether the requests in flight and the outbound replicated
+	// writes are done
+	shutdownPollInterval = 50 * time.Millisecond
+	// minSendRetryInterval and maxSendRetryInterval bound the time between the attempts to send a replicated write
+	minSendRetryInterval = 100 * time.Millisecond
+	maxSendRetryInterval = 5 * time.Second
+	// maxReplicatedWriteBatch and maxReplicatedWriteBatchSize bound the number of replicated writes sent to another
+	// server in one message, and the size of their keys, values and dependencies, well below the maximum message size
+	maxReplicatedWriteBatch     = 100
+	maxReplicatedWriteBatchSize = 1 << 20
+)
+
+// outboundWrite is a replicated write to send to another server
+type outboundWrite struct {
+	HostPort string
+	Request  communication.ServerReplicatedWriteRequest
+}
+
+type outboundQueue struct {
+	writes map[*outboundWrite]struct{}
+	// due holds the writes of each other server which are due to be sent, in the order they became due,
+	// and sending tells the other servers a sender is running for
+	due     map[string][]*outboundWrite
+	sending map[string]bool
+	// dropped holds the dependencies of the writes each other server rejected as too large, by the dependency
+	// on the write
+	dropped map[string]map[communication.DependencyData][]communication.DependencyData
+	// sentWrites and sentMessages count the writes sent and the messages they were sent in, and droppedWrites
+	// the writes the other servers rejected as too large
+	sentWrites, sentMessages, droppedWrites int
+	sync.Mutex
+}
+
+// droppedWrite is a replicated write another server rejected as too large. It never commits at the server, so the
+// writes sent to the server after it depend on the dependencies of the dropped write instead
+type droppedWrite struct {
+	HostPort     string
+	Write        communication.DependencyData
+	Dependencies []communication.DependencyData
+}
+
+func (q *outboundQueue) add(hostPort string, req communication.ServerReplicatedWriteRequest) *outboundWrite {
+	q.Lock()
+	defer q.Unlock()
+	w := &outboundWrite{HostPort: hostPort, Request: req}
+	q.writes[w] = struct{}{}
+	return w
+}
+
+// makeDue adds a write to the ones due to be sent to its server, telling if a sender must be started for it
+func (q *outboundQueue) makeDue(w *outboundWrite) bool {
+	q.Lock()
+	defer q.Unlock()
+	q.due[w.HostPort] = append(q.due[w.HostPort], w)
+	if q.sending[w.HostPort] {
+		return false
+	}
+	q.sending[w.HostPort] = true
+	return true
+}
+
+// nextBatch returns the first writes due to be sent to another server, as many as fit in a batch.
+// With none due, the sender of the server is done and nextBatch returns nil
+func (q *outboundQueue) nextBatch(hostPort string) []*outboundWrite {
+	q.Lock()
+	defer q.Unlock()
+	due := q.due[hostPort]
+	if len(due) == 0 {
+		delete(q.due, hostPort)
+		delete(q.sending, hostPort)
+		return nil
+	}
+	n, size := 1, batchSizeOf(due[0])
+	for n < len(due) && n < maxReplicatedWriteBatch {
+		if size += batchSizeOf(due[n]); size > maxReplicatedWriteBatchSize {
+			break
+		}
+		n++
+	}
+	return due[:n]
+}
+
+// batchSizeOf estimates the size a write takes in a batch from its key, value and dependencies
+func batchSizeOf(w *outboundWrite) int {
+	size := len(w.Request.Args.Key) + len(w.Request.Args.Value)
+	for _, d := range w.Request.Args.Dependencies {
+		size += len(d.Key) + len(d.OriginalServer)
+	}
+	return size
+}
+
+// sent removes the first writes due to be sent to another server which are done with
+func (q *outboundQueue) sent(hostPort string, r sendResult) {
+	q.Lock()
+	defer q.Unlock()
+	for _, w := range q.due[hostPort][:r.done] {
+		delete(q.writes, w)
+	}
+	q.due[hostPort] = q.due[hostPort][r.done:]
+	q.sentWrites += r.done - r.dropped
+	q.sentMessages += r.messages
+	q.droppedWrites += r.dropped
+}
+
+// drop records a write another server rejected as too large
+func (q *outboundQueue) drop(d droppedWrite) {
+	q.Lock()
+	defer q.Unlock()
+	if q.dropped[d.HostPort] == nil {
+		q.dropped[d.HostPort] = make(map[communication.DependencyData][]communication.DependencyData)
+	}
+	q.dropped[d.HostPort][d.Write] = d.Dependencies
+}
+
+// replaceDropped returns the dependencies with each dependency on a write dropped for another server replaced by
+// the dependencies of the write, telling if any was
+func (q *outboundQueue) replaceDropped(hostPort string, dependencies []communication.DependencyData) ([]communication.DependencyData, bool) {
+	q.Lock()
+	defer q.Unlock()
+	dropped := q.dropped[hostPort]
+	if len(dropped) == 0 {
+		return dependencies, false
+	}
+	var replaced []communication.DependencyData
+	changed := false
+	for _, d := range dependencies {
+		if deps, ok := dropped[d]; ok {
+			// the dependencies of a dropped write were replaced already when it was sent
+			replaced = append(replaced, deps...)
+			changed = true
+		} else {
+			replaced = append(replaced, d)
+		}
+	}
+	return replaced, changed
+}
+
+// stopSending tells the sender of another server ended before sending all its writes, which stay queued
+func (q *outboundQueue) stopSending(hostPort string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.sending, hostPort)
+}
+
+func (q *outboundQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.writes)
+}
+
+// sendReplicatedWrite makes a queued replicated write due to be sent after delay, and removes it from the queue
+// once sent. A write not sent when the server stops stays queued, and is saved with the state of the server
+func (srv *Server) sendReplicatedWrite(w *outboundWrite, delay time.Duration) {
+	if delay <= 0 {
+		srv.makeDue(w)
+		return
+	}
+	go func() {
+		select {
+		case <-time.After(delay):
+			srv.makeDue(w)
+		case <-srv.stopped:
+		}
+	}()
+}
+
+func (srv *Server) makeDue(w *outboundWrite) {
+	if srv.outbound.makeDue(w) {
+		go srv.sendDueWrites(w.HostPort)
+	}
+}
+
+// sendDueWrites sends the writes due to be sent to another server in batches until none is left. The writes becoming
+// due while a batch is being sent go in the next one, so that batches grow with the rate of writes without delaying
+// any. A failed send is retried with a growing interval until the server stops
+func (srv *Server) sendDueWrites(hostPort string) {
+	retryInterval := minSendRetryInterval
+	for {
+		if srv.isStopped() {
+			srv.outbound.stopSending(hostPort)
+			return
+		}
+		batch := srv.outbound.nextBatch(hostPort)
+		if batch == nil {
+			return
+		}
+		result, err := srv.sendReplicatedWrites(hostPort, batch)
+		srv.outbound.sent(hostPort, result)
+		if err == nil {
+			retryInterval = minSendRetryInterval
+			continue
+		}
+		errorLogger.Printf("%v, retrying in %v", err, retryInterval)
+		select {
+		case <-time.After(retryInterval):
+		case <-srv.stopped:
+		}
+		if retryInterval *= 2; retryInterval > maxSendRetryInterval {
+			retryInterval = maxSendRetryInterval
+		}
+	}
+}
+
+// sendResult tells how many of the first writes of a batch are done with, either sent, in how many messages,
+// or dropped
+type sendResult struct {
+	done, messages, dropped int
+}
+
+// requestTo returns the request of a replicated write to another server, signed again if it depended on writes
+// dropped for the server
+func (srv *Server) requestTo(hostPort string, w *outboundWrite) communication.ServerReplicatedWriteRequest {
+	req := w.Request
+	if deps, changed := srv.outbound.replaceDropped(hostPort, req.Args.Dependencies); changed {
+		req.Args.Dependencies = deps
+		req.Signature = srv.signMessage(req.Op, req.Args)
+	}
+	return req
+}
+
+// sendReplicatedWrites sends replicated writes to another server, in a single batch if it supports them, else one
+// at a time. A write the other server rejects as too large would be rejected again, so it is dropped, and a batch
+// rejected as too large is sent again one write at a time
+func (srv *Server) sendReplicatedWrites(hostPort string, writes []*outboundWrite) (sendResult, error) {
+	var result sendResult
+	link, err := srv.connectPeer(hostPort, peerDialTimeout)
+	if err != nil {
+		return result, err
+	}
+	if len(writes) > 1 && link.features[communication.FeatureReplicationBatching] {
+		req := communication.ServerReplicatedWriteBatchRequest{
+			Op:   communication.ReplicatedWriteBatch,
+			Args: communication.ServerReplicatedWriteBatchRequestArgs{Writes: make([]communication.ServerReplicatedWriteRequest, len(writes))},
+		}
+		for i, w := range writes {
+			req.Args.Writes[i] = srv.requestTo(hostPort, w)
+		}
+		err := srv.sendToPeer(hostPort, req)
+		if err == nil {
+			return sendResult{done: len(writes), messages: 1}, nil
+		}
+		if !errors.Is(err, communication.ErrTooLarge) {
+			return result, err
+		}
+		errorLogger.Printf("%v, sending the writes of the batch one at a time", err)
+	}
+
+	for _, w := range writes {
+		req := srv.requestTo(hostPort, w)
+		err := srv.sendToPeer(hostPort, req)
+		switch {
+		case err == nil:
+			result.messages++
+		case errors.Is(err, communication.ErrTooLarge):
+			errorLogger.Printf("dropping the replicated write of %q: %v", req.Args.Key, err)
+			srv.outbound.drop(droppedWrite{
+				HostPort:     hostPort,
+				Write:        communication.DependencyData{Key: req.Args.Key, OriginalServer: req.Args.OriginalServer, LamportsClockTimestamp: req.Args.Clock},
+				Dependencies: req.Args.Dependencies,
+			})
+			result.dropped++
+		default:
+			return result, err
+		}
+		result.done++
+	}
+	return result, nil
+}
+
+// reportStats tells the compression of the messages of the server and the batching of its replicated writes
+func (srv *Server) reportStats() string {
+	srv.outbound.Lock()
+	writes, messages, dropped := srv.outbound.sentWrites, srv.outbound.sentMessages, srv.outbound.droppedWrites
+	srv.outbound.Unlock()
+	return fmt.Sprintf("%s\nreplicated %d writes in %d messages, dropped %d writes too large for the other servers",
+		srv.compression.Report(), writes, messages, dropped)
+}
+
+// Stop shuts the server down gracefully. It stops accepting connections and client requests, waits for the
+// requests in flight and the outbound replicated writes for up to the shutdown timeout, then closes the connections,
+// ends the background work and saves the state of the server. A stopped server cannot start again.
+// Stop may be called many times and concurrently, every call returns once the server stopped
+func (srv *Server) Stop() {
+	srv.Lock()
+	if srv.isDraining() {
+		srv.Unlock()
+		<-srv.done
+		return
+	}
+	defer close(srv.done)
+	close(srv.draining)
+	started := srv.listener != nil
+	if started {
+		_ = srv.listener.Close()
+	}
+	// idle connections have no request to finish
+	for c, busy := range srv.connections {
+		if !busy {
+			_ = c.Close()
+		}
+	}
+	srv.Unlock()
+	if !started {
+		close(srv.stopped)
+		return
+	}
+
+	infoLogger.Printf("server %q is shutting down", srv.selfHostPort)
+	deadline := time.Now().Add(srv.config.ShutdownTimeout)
+	if !waitUntil(deadline, func() bool {
+		srv.Lock()
+		defer srv.Unlock()
+		return srv.inFlight == 0
+	}) {
+		errorLogger.Printf("stopping with requests still in flight after %v", srv.config.ShutdownTimeout)
+	}
+	if !waitUntil(deadline, func() bool { return srv.outbound.len() == 0 }) {
+		errorLogger.Printf("stopping with %d replicated writes not sent after %v", srv.outbound.len(), srv.config.ShutdownTimeout)
+	}
+
+	srv.Lock()
+	close(srv.stopped)
+	for c := range srv.connections {
+		_ = c.Close()
+	}
+	srv.Unlock()
+
+	srv.peers.Lock()
+	for hostPort, l := range srv.peers.linkByHostPort {
+		l.close()
+		delete(srv.peers.linkByHostPort, hostPort)
+	}
+	srv.peers.Unlock()
+
+	if err := srv.saveSnapshot(); err != nil {
+		errorLogger.Printf("failed to save the state of the server: %v", err)
+	} else {
+		srv.storage.Lock()
+		srv.storage.removeSpillDir()
+		srv.storage.Unlock()
+	}
+	infoLogger.Printf("server %q stopped", srv.selfHostPort)
+}
+
+// waitUntil polls done until it is true or the deadline passes, telling if it is true
+func waitUntil(deadline time.Time, done func() bool) bool {
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	return true
+}
+
+// isDraining tells if Stop was called
+func (srv *Server) isDraining() bool {
+	select {
+	case <-srv.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// isStopped tells if Stop is done with the requests in flight
+func (srv *Server) isStopped() bool {
+	select {
+	case <-srv.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackConnection records a connection being served, so that Stop closes it. It fails if the server is stopping
+func (srv *Server) trackConnection(c net.Conn) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.isDraining() {
+		return false
+	}
+	srv.connections[c] = false
+	return true
+}
+
+func (srv *Server) untrackConnection(c net.Conn) {
+	srv.Lock()
+	defer srv.Unlock()
+	delete(srv.connections, c)
+}
+
+// beginRequest records a request of a connection in flight, or of no connection if c is nil.
+// It fails if the server is stopping, unless the request comes from another server, whose replicated writes
+// and consensus messages are taken until the server stopped
+func (srv *Server) beginRequest(c net.Conn, fromOtherServer bool) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	if srv.isStopped() || (srv.isDraining() && !fromOtherServer) {
+		return false
+	}
+	if c != nil {
+		srv.connections[c] = true
+	}
+	srv.inFlight++
+	return true
+}
+
+// endRequest records the request of a connection is handled, closing the connection if the server is stopping
+func (srv *Server) endRequest(c net.Conn) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.inFlight--
+	if c == nil {
+		return
+	}
+	if srv.isDraining() {
+		_ = c.Close()
+		return
+	}
+	srv.connections[c] = false
+}
+
+// isStreamingOp tells if an op keeps its connection to stream its responses, in which case Stop does not wait for it
+func isStreamingOp(op string) bool {
+	return op == communication.Watch || op == communication.ChangeFeed
+}
+
+func makeShuttingDownResp() interface{} {
+	return makeFailResp(communication.Unavailable, "the server is shutting down")
+}
+
+// waitForSignal waits for SIGINT or SIGTERM, which stop the server gracefully
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+	infoLogger.Printf("received %v", sig)
+	return sig
+}
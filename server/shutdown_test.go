@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Lab2/communication"
+)
+
+func readSnapshot(t *testing.T, path string) snapshot {
+	t.Helper()
+	m, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved snapshot
+	if err := json.Unmarshal(m, &saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+func startServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	srv := New(config)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+func TestConcurrentStopsReturnOnceTheStateIsSaved(t *testing.T) {
+	config := Config{HostPort: freeHostPorts(t, 1)[0], DataFile: filepath.Join(t.TempDir(), "data")}
+	srv := startServer(t, config)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Stop()
+			if _, err := ioutil.ReadFile(config.DataFile); err != nil {
+				t.Errorf("Stop returned before the state was saved: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStopDoesNotWaitForWritesPendingOnTheirDependencies(t *testing.T) {
+	config := Config{
+		HostPort:        freeHostPorts(t, 1)[0],
+		DataFile:        filepath.Join(t.TempDir(), "data"),
+		ShutdownTimeout: 10 * time.Second,
+	}
+	srv := startServer(t, config)
+
+	req := communication.ServerReplicatedWriteRequest{
+		Op: communication.ReplicatedWrite,
+		Args: communication.ServerReplicatedWriteRequestArgs{
+			Key: "k", Value: "v", OriginalServer: "other:1", Clock: 2,
+			Dependencies: []communication.DependencyData{{Key: "never", LamportsClockTimestamp: 1}},
+		},
+	}
+	if !srv.beginRequest(nil, true) {
+		t.Fatal("replicated write rejected")
+	}
+	go func() {
+		defer srv.endRequest(nil)
+		srv.handleServerReplicatedWrite(req)
+	}()
+	eventually(t, "the write is pending", func() bool {
+		srv.storage.Lock()
+		defer srv.storage.Unlock()
+		return len(srv.storage.pending) == 1
+	})
+
+	start := time.Now()
+	srv.Stop()
+	if took := time.Since(start); took > config.ShutdownTimeout/2 {
+		t.Errorf("Stop took %v, waiting for the pending write", took)
+	}
+	if saved := readSnapshot(t, config.DataFile); len(saved.PendingWrites) != 1 || saved.PendingWrites[0].Args.Key != "k" {
+		t.Errorf("saved pending writes %+v, want the write of %q", saved.PendingWrites, "k")
+	}
+}
+
+func TestReplicatedWritesNotSentAreRetriedThenSaved(t *testing.T) {
+	hostPorts := freeHostPorts(t, 2)
+	config := Config{
+		HostPort: hostPorts[0],
+		// nothing listens to the other server
+		OtherServers:    hostPorts[1:],
+		DataFile:        filepath.Join(t.TempDir(), "data"),
+		ShutdownTimeout: 500 * time.Millisecond,
+	}
+	srv := startServer(t, config)
+	if err := connect(t, srv).Put(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * minSendRetryInterval)
+	if n := srv.outbound.len(); n != 1 {
+		t.Fatalf("%d replicated writes queued after a failed send, want 1", n)
+	}
+
+	srv.Stop()
+	saved := readSnapshot(t, config.DataFile)
+	if len(saved.OutboundWrites) != 1 || saved.OutboundWrites[0].HostPort != hostPorts[1] ||
+		saved.OutboundWrites[0].Request.Args.Key != "k" {
+		t.Errorf("saved outbound writes %+v, want the write of %q to %q", saved.OutboundWrites, "k", hostPorts[1])
+	}
+}
+
+func TestReplicatedWritesRejectedByTheOtherServerStayQueued(t *testing.T) {
+	hostPorts := freeHostPorts(t, 2)
+	// the other server rejects the writes, which are signed with another secret
+	other := startServer(t, Config{HostPort: hostPorts[1], OtherServers: hostPorts[:1], SharedSecret: "other"})
+	config := Config{
+		HostPort:        hostPorts[0],
+		OtherServers:    hostPorts[1:],
+		SharedSecret:    "secret",
+		DataFile:        filepath.Join(t.TempDir(), "data"),
+		ShutdownTimeout: 500 * time.Millisecond,
+	}
+	srv := startServer(t, config)
+	if err := connect(t, srv).Put(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * minSendRetryInterval)
+	if n := srv.outbound.len(); n != 1 {
+		t.Fatalf("%d replicated writes queued after the other server rejected the write, want 1", n)
+	}
+	if _, ok := currentValue(other, "k"); ok {
+		t.Fatalf("the other server committed a write it rejected")
+	}
+
+	srv.Stop()
+	if saved := readSnapshot(t, config.DataFile); len(saved.OutboundWrites) != 1 {
+		t.Errorf("saved outbound writes %+v, want the rejected write", saved.OutboundWrites)
+	}
+}
+
+func TestReplicatedWritesDueTogetherAreSentInOneBatch(t *testing.T) {
+	hostPorts := freeHostPorts(t, 2)
+	srv := startServer(t, Config{HostPort: hostPorts[0], OtherServers: hostPorts[1:], ShutdownTimeout: time.Second})
+	c := connect(t, srv)
+	// the other server is not started yet, so the writes pile up
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := c.Put(context.Background(), fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := startServer(t, Config{HostPort: hostPorts[1], OtherServers: hostPorts[:1], ShutdownTimeout: time.Second})
+	eventually(t, "every write is replicated", func() bool {
+		for i := 0; i < n; i++ {
+			if v, ok := currentValue(other, fmt.Sprintf("k%d", i)); !ok || v != "v" {
+				return false
+			}
+		}
+		return true
+	})
+	// the other server may commit the writes before the sending server handles its answer
+	eventually(t, "the sending server counts the writes sent", func() bool {
+		return srv.outbound.len() == 0
+	})
+
+	srv.outbound.Lock()
+	writes, messages := srv.outbound.sentWrites, srv.outbound.sentMessages
+	srv.outbound.Unlock()
+	if writes != n || messages >= n {
+		t.Errorf("sent %d writes in %d messages, want %d writes in fewer messages", writes, messages, n)
+	}
+	// each server counts the messages it compressed itself
+	if report := srv.compression.Report(); !strings.Contains(report, "received 0 compressed messages") {
+		t.Errorf("the sending server received compressed messages:\n%s", report)
+	}
+	if report := other.compression.Report(); !strings.HasPrefix(report, "sent 0 compressed messages") {
+		t.Errorf("the receiving server sent compressed messages:\n%s", report)
+	}
+}
+
+func TestRaftEntryAppliedAgainIsNotCommittedTwice(t *testing.T) {
+	srv := New(Config{})
+	entry := communication.RaftLogEntry{Term: 1, Key: "k", Value: "v", OriginalServer: "a:1", Clock: 1}
+	for i := 0; i < 2; i++ {
+		if result := srv.applyRaftEntry(1, entry); !result.applied {
+			t.Fatalf("entry not applied the %d time", i+1)
+		}
+	}
+	if versions := srv.storage.history["k"]; len(versions) != 1 {
+		t.Errorf("history of %d versions after applying an entry twice, want 1", len(versions))
+	}
+	if n := len(srv.changes.records); n != 1 {
+		t.Errorf("%d change feed records after applying an entry twice, want 1", n)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"Lab2/communication"
+)
+
+// hostResolver caches the addresses of hosts, resolving a host again when asked about an address it does not know
+// for it, in case the addresses of the host changed
+type hostResolver struct {
+	ipsByHost map[string][]net.IP
+	sync.Mutex
+}
+
+// hasAddress tells if ip is one of the addresses of host. The host is resolved without holding the lock,
+// so that a slow lookup does not hold the other checks
+func (r *hostResolver) hasAddress(host string, ip net.IP) bool {
+	if hostIP := net.ParseIP(host); hostIP != nil {
+		return hostIP.Equal(ip)
+	}
+	r.Lock()
+	cached := r.ipsByHost[host]
+	r.Unlock()
+	if containsIP(cached, ip) {
+		return true
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		errorLogger.Printf("failed to resolve %q: %v", host, err)
+		return false
+	}
+	r.Lock()
+	r.ipsByHost[host] = ips
+	r.Unlock()
+	return containsIP(ips, ip)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipOf returns the ip of a network address, nil if it has none
+func ipOf(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// setSharedSecret sets the secret shared by all servers, which must be set before they start
+func (srv *Server) setSharedSecret(secret string) (string, error) {
+	if srv.selfHostPort != "" {
+		return "", fmt.Errorf("the shared secret must be set before %q", startCmd)
+	}
+	srv.sharedSecret = []byte(secret)
+	return "messages between servers will be signed with the shared secret", nil
+}
+
+// signMessage signs a message to another server, returning an empty signature if there is no shared secret
+func (srv *Server) signMessage(op string, args interface{}) string {
+	if srv.sharedSecret == nil {
+		return ""
+	}
+	return communication.Sign(srv.sharedSecret, op, args)
+}
+
+// verifyServerMessage checks a message claiming to come from the sender is signed with the shared secret,
+// if there is one, and the sender is one of the other servers. Since the sender is what the message says,
+// the message must also come from an address of the host of the sender
+func (srv *Server) verifyServerMessage(op string, args interface{}, signature, sender string, from net.Addr) error {
+	if srv.sharedSecret != nil && !communication.VerifySignature(srv.sharedSecret, op, args, signature) {
+		return communication.Errorf(communication.Forbidden, "bad signature of %s from %q", op, sender)
+	}
+	for _, hp := range srv.otherServersHostPorts {
+		if hp != sender {
+			continue
+		}
+		host, _, err := net.SplitHostPort(hp)
+		if ip := ipOf(from); err != nil || ip == nil || !srv.resolver.hasAddress(host, ip) {
+			return communication.Errorf(communication.Forbidden, "%s claiming to come from %q, but coming from %q", op, sender, from)
+		}
+		return nil
+	}
+	return communication.Errorf(communication.Forbidden, "%s from %q, which is not one of the other servers", op, sender)
+}
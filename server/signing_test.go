@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"Lab2/communication"
+)
+
+func TestServerMessagesMustComeFromTheHostOfTheirSender(t *testing.T) {
+	srv := New(Config{SharedSecret: "secret"})
+	srv.otherServersHostPorts = []string{"127.0.0.1:8001", "localhost:8002"}
+	args := communication.ServerReplicatedWriteRequestArgs{Key: "k", Value: "v", OriginalServer: "127.0.0.1:8001", Clock: 1}
+	signature := srv.signMessage(communication.ReplicatedWrite, args)
+	from := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	}
+
+	cases := []struct {
+		name   string
+		sender string
+		from   net.Addr
+		ok     bool
+	}{
+		{"from the host of the sender", "127.0.0.1:8001", from("127.0.0.1"), true},
+		{"from a host name of the sender", "localhost:8002", from("127.0.0.1"), true},
+		{"from another host", "127.0.0.1:8001", from("10.1.2.3"), false},
+		{"from another host claiming a host name", "localhost:8002", from("10.1.2.3"), false},
+		{"from a server which is not one of the others", "10.1.2.3:8001", from("10.1.2.3"), false},
+	}
+	for _, c := range cases {
+		err := srv.verifyServerMessage(communication.ReplicatedWrite, args, signature, c.sender, c.from)
+		if c.ok && err != nil {
+			t.Errorf("%s: rejected: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, communication.ErrForbidden) {
+			t.Errorf("%s: got %v, want a forbidden error", c.name, err)
+		}
+	}
+
+	if err := srv.verifyServerMessage(communication.ReplicatedWrite, args, "bad", "127.0.0.1:8001", from("127.0.0.1")); !errors.Is(err, communication.ErrForbidden) {
+		t.Errorf("bad signature: got %v, want a forbidden error", err)
+	}
+}
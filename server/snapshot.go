@@ -0,0 +1,278 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"Lab2/communication"
+)
+
+// snapshot is the state a server saves to its data file when it stops, and restores when it starts again
+type snapshot struct {
+	Clock        uint64
+	Keys         map[string]snapshotKey
+	Dependencies map[string][]communication.DependencyData
+	// PendingWrites are the replicated writes received but still waiting for their dependencies
+	PendingWrites []communication.ServerReplicatedWriteRequest
+	// OutboundWrites are the replicated writes not sent to the other servers yet
+	OutboundWrites []outboundWrite
+	// DroppedWrites are the replicated writes the other servers rejected as too large
+	DroppedWrites []droppedWrite `json:",omitempty"`
+	// ChangeRecords are the records of the change feed, the first one at ChangeFirstOffset, and ConsumerOffsets
+	// the offsets its consumers committed
+	ChangeRecords     []communication.ChangeRecord `json:",omitempty"`
+	ChangeFirstOffset uint64                       `json:",omitempty"`
+	ConsumerOffsets   map[string]uint64            `json:",omitempty"`
+	// RaftApplied is the index of the last consensus log entry applied to the keys, which are not applied again
+	RaftApplied uint64 `json:",omitempty"`
+}
+
+type snapshotKey struct {
+	Current snapshotVersion
+	History []snapshotVersion
+}
+
+type snapshotVersion struct {
+	// Value is encoded as in the protocol, since it may hold any bytes
+	Value                  string
+	ValueEncoding          string `json:",omitempty"`
+	OriginalServer         string
+	LamportsClockTimestamp uint64
+	Crdt                   *communication.CrdtState `json:",omitempty"`
+	ExpiresAtUnixNano      int64                    `json:",omitempty"`
+	Evicted                bool                     `json:",omitempty"`
+	Deleted                bool                     `json:",omitempty"`
+}
+
+func makeSnapshotKey(v valueOfKey, history []valueOfKey) snapshotKey {
+	key := snapshotKey{Current: makeSnapshotVersion(v)}
+	for _, h := range history {
+		key.History = append(key.History, makeSnapshotVersion(h))
+	}
+	return key
+}
+
+// versions returns the current version and the history of a saved key
+func (k snapshotKey) versions() (valueOfKey, []valueOfKey, error) {
+	v, err := k.Current.valueOfKey()
+	if err != nil {
+		return valueOfKey{}, nil, err
+	}
+	var history []valueOfKey
+	for _, h := range k.History {
+		hv, err := h.valueOfKey()
+		if err != nil {
+			return valueOfKey{}, nil, err
+		}
+		history = append(history, hv)
+	}
+	return v, history, nil
+}
+
+func makeSnapshotVersion(v valueOfKey) snapshotVersion {
+	value, encoding := communication.EncodeValue(v.value)
+	return snapshotVersion{
+		Value:                  value,
+		ValueEncoding:          encoding,
+		OriginalServer:         v.originalServer,
+		LamportsClockTimestamp: v.lamportsClockTimestamp,
+		Crdt:                   v.crdt,
+		ExpiresAtUnixNano:      v.expiresAt,
+		Evicted:                v.evicted,
+		Deleted:                v.deleted,
+	}
+}
+
+func (v snapshotVersion) valueOfKey() (valueOfKey, error) {
+	value, err := communication.DecodeValue(v.Value, v.ValueEncoding)
+	if err != nil {
+		return valueOfKey{}, err
+	}
+	return valueOfKey{
+		value:                  value,
+		originalServer:         v.OriginalServer,
+		lamportsClockTimestamp: v.LamportsClockTimestamp,
+		crdt:                   v.Crdt,
+		expiresAt:              v.ExpiresAtUnixNano,
+		evicted:                v.Evicted,
+		deleted:                v.Deleted,
+	}, nil
+}
+
+// setDataFile sets the file the state of the server is saved to when it stops, and restored from when it starts
+func (srv *Server) setDataFile(path string) (string, error) {
+	if srv.selfHostPort != "" {
+		return "", fmt.Errorf("the data file must be set before %q", startCmd)
+	}
+	srv.config.DataFile = path
+	return fmt.Sprintf("the state of the server will be saved to %q when it stops", path), nil
+}
+
+// saveSnapshot saves the state of the server to its data file, if it has one
+func (srv *Server) saveSnapshot() error {
+	if srv.config.DataFile == "" {
+		return nil
+	}
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.clock.Lock()
+	saved := snapshot{
+		Clock:        srv.clock.clock,
+		Keys:         make(map[string]snapshotKey, len(srv.storage.storage)),
+		Dependencies: srv.maintainer.dependencyByClientId,
+		RaftApplied:  srv.storage.raftApplied,
+	}
+	for k, v := range srv.storage.storage {
+		history := srv.storage.history[k]
+		if v.spilled {
+			// the data file holds the values written to disk to fit in the memory budget as well
+			var err error
+			if v, history, err = srv.storage.readSpilled(k); err != nil {
+				errorLogger.Printf("failed to read the value of %q from disk, saving it as evicted: %v", k, err)
+				v = srv.storage.storage[k]
+				v.spilled, v.evicted = false, true
+			}
+		}
+		saved.Keys[k] = makeSnapshotKey(v, history)
+	}
+	for req := range srv.storage.pending {
+		saved.PendingWrites = append(saved.PendingWrites, *req)
+	}
+	srv.outbound.Lock()
+	for w := range srv.outbound.writes {
+		saved.OutboundWrites = append(saved.OutboundWrites, *w)
+	}
+	for hostPort, dropped := range srv.outbound.dropped {
+		for w, deps := range dropped {
+			saved.DroppedWrites = append(saved.DroppedWrites, droppedWrite{HostPort: hostPort, Write: w, Dependencies: deps})
+		}
+	}
+	srv.changes.Lock()
+	saved.ChangeRecords = srv.changes.records
+	saved.ChangeFirstOffset = srv.changes.firstOffset
+	saved.ConsumerOffsets = srv.changes.consumerOffsets
+	m, err := json.Marshal(saved)
+	srv.changes.Unlock()
+	srv.outbound.Unlock()
+	srv.clock.Unlock()
+	srv.maintainer.Unlock()
+	srv.storage.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(srv.config.DataFile, m); err != nil {
+		return err
+	}
+	infoLogger.Printf("saved %d keys, %d pending and %d outbound replicated writes to %q",
+		len(saved.Keys), len(saved.PendingWrites), len(saved.OutboundWrites), srv.config.DataFile)
+	return nil
+}
+
+// writeFileAtomically replaces a file with data at once, syncing it to disk, so that a crash while writing
+// leaves the previous content
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadSnapshot restores the state of the server from its data file, if it has one and the file exists.
+// It returns the snapshot restored, whose replicated writes are resumed once the server started
+func (srv *Server) loadSnapshot() (*snapshot, error) {
+	if srv.config.DataFile == "" {
+		return nil, nil
+	}
+	m, err := ioutil.ReadFile(srv.config.DataFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved snapshot
+	if err := json.Unmarshal(m, &saved); err != nil {
+		return nil, fmt.Errorf("bad data file %q: %w", srv.config.DataFile, err)
+	}
+
+	storage := make(map[string]valueOfKey, len(saved.Keys))
+	history := make(map[string][]valueOfKey, len(saved.Keys))
+	keys := make([]string, 0, len(saved.Keys))
+	for k, key := range saved.Keys {
+		v, versions, err := key.versions()
+		if err != nil {
+			return nil, fmt.Errorf("bad data file %q: key %q: %w", srv.config.DataFile, k, err)
+		}
+		storage[k] = v
+		if versions != nil {
+			history[k] = versions
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	srv.storage.Lock()
+	srv.maintainer.Lock()
+	srv.clock.Lock()
+	srv.storage.storage, srv.storage.history, srv.storage.keys = storage, history, keys
+	srv.storage.usedMemory = 0
+	srv.storage.raftApplied = saved.RaftApplied
+	for _, k := range keys {
+		srv.storage.usedMemory += srv.storage.footprint(k)
+		srv.indexes.update(k, storage[k].value)
+	}
+	if saved.Dependencies != nil {
+		srv.maintainer.dependencyByClientId = saved.Dependencies
+	}
+	srv.clock.clock = saved.Clock
+	srv.changes.Lock()
+	srv.changes.records, srv.changes.firstOffset = saved.ChangeRecords, saved.ChangeFirstOffset
+	if saved.ConsumerOffsets != nil {
+		srv.changes.consumerOffsets = saved.ConsumerOffsets
+	}
+	srv.changes.Unlock()
+	srv.clock.Unlock()
+	srv.maintainer.Unlock()
+	srv.storage.Unlock()
+
+	infoLogger.Printf("restored %d keys, %d pending and %d outbound replicated writes and %d change records from %q",
+		len(saved.Keys), len(saved.PendingWrites), len(saved.OutboundWrites), len(saved.ChangeRecords), srv.config.DataFile)
+	return &saved, nil
+}
+
+// resume handles the pending replicated writes and sends the outbound ones of a restored snapshot
+func (srv *Server) resume(saved *snapshot) {
+	for _, req := range saved.PendingWrites {
+		if !srv.beginRequest(nil, true) {
+			return
+		}
+		go func(req communication.ServerReplicatedWriteRequest) {
+			defer srv.endRequest(nil)
+			srv.handleServerReplicatedWrite(req)
+		}(req)
+	}
+	for _, d := range saved.DroppedWrites {
+		srv.outbound.drop(d)
+	}
+	for _, w := range saved.OutboundWrites {
+		srv.sendReplicatedWrite(srv.outbound.add(w.HostPort, w.Request), 0)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"Lab2/communication"
+)
+
+// serverOps are the ops only other servers send
+var serverOps = map[string]bool{
+	communication.ReplicatedWrite:      true,
+	communication.ReplicatedWriteBatch: true,
+	communication.RaftRequestVote:      true,
+	communication.RaftAppendEntries:    true,
+	communication.RaftPropose:          true,
+}
+
+// enableTLS loads the certificate of this server and the CA verifying the certificates of clients and other servers.
+// It must be done before the server starts
+func (srv *Server) enableTLS(certFile, keyFile, caFile string) (string, error) {
+	if srv.selfHostPort != "" {
+		return "", fmt.Errorf("TLS must be enabled before %q", startCmd)
+	}
+	config, err := communication.LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return "", err
+	}
+	srv.tlsConfig = config
+	return "TLS enabled", nil
+}
+
+// isOtherServer tells if the peer of a connection authenticated as one of the other servers, with a server certificate
+// valid for the host of one of them, which is always the case without TLS
+func (srv *Server) isOtherServer(conn net.Conn) bool {
+	if srv.tlsConfig == nil {
+		return true
+	}
+	if c, ok := conn.(deadlineConn); ok {
+		conn = c.Conn
+	}
+	hosts := make([]string, 0, len(srv.otherServersHostPorts))
+	for _, hp := range srv.otherServersHostPorts {
+		if host, _, err := net.SplitHostPort(hp); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	return communication.VerifiedServer(conn, hosts)
+}
+
+// authorizeOp returns the fail response to a server op from a peer which is not one of the other servers, nil if
+// the op is allowed
+func authorizeOp(op string, fromOtherServer bool) interface{} {
+	if serverOps[op] && !fromOtherServer {
+		return makeFailResp(communication.Forbidden, fmt.Sprintf("%s is only accepted from other servers", op))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"Lab2/communication"
+	"Lab2/util"
+)
+
+// watchEventBufferSize bounds the events queued for a watcher, a watcher falling further behind is disconnected
+// and is expected to reconnect and resume
+const watchEventBufferSize = 256
+
+type watcher struct {
+	key      string
+	isPrefix bool
+	events   chan communication.ClientWatchEvent
+}
+
+type watcherRegistry struct {
+	watchers map[*watcher]struct{}
+	sync.Mutex
+}
+
+func (w *watcher) matches(key string) bool {
+	if w.isPrefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// notify sends a committed change to the watchers of the key.
+// Since it is called with the lock of storage held, watchers receive changes in commit order,
+// which respects causality
+func (r *watcherRegistry) notify(key string, v valueOfKey) {
+	r.Lock()
+	defer r.Unlock()
+
+	for w := range r.watchers {
+		if !w.matches(key) {
+			continue
+		}
+		select {
+		case w.events <- makeWatchEvent(key, v):
+		default:
+			// the watcher is too slow, drop it
+			delete(r.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+func (r *watcherRegistry) remove(w *watcher) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.watchers[w]; ok {
+		delete(r.watchers, w)
+		close(w.events)
+	}
+}
+
+// handleClientWatch handles client watch of a key or a prefix, streaming committed changes until the client
+// disconnects
+func (srv *Server) handleClientWatch(conn net.Conn, req communication.ClientWatchRequest) {
+	infoLogger.Printf("handling:")
+	genericLogger.Printf("%s", util.StructToPrettyJsonString(req))
+
+	// watching a prefix needs the permission on all its keys
+	if err := srv.authorize(req.Args.SessionToken, readPermission, req.Args.Key); err != nil {
+		_ = json.NewEncoder(conn).Encode(communication.ClientWatchResponse{
+			Op:             req.Op,
+			Result:         communication.Fail,
+			DetailedResult: err.Error(),
+			ErrorCode:      communication.CodeOf(err),
+		})
+		return
+	}
+
+	w := &watcher{
+		key:      req.Args.Key,
+		isPrefix: req.Args.IsPrefix,
+		events:   make(chan communication.ClientWatchEvent, watchEventBufferSize),
+	}
+
+	// collecting the replayed versions and registering the watcher under the lock of storage
+	// ensures no change is missed in between
+	srv.storage.Lock()
+	var replay []communication.ClientWatchEvent
+	if req.Args.Resume {
+		for k := range srv.storage.storage {
+			if !w.matches(k) {
+				continue
+			}
+			versions, _ := srv.storage.versionsOf(k)
+			for _, v := range versions {
+				if v.lamportsClockTimestamp >= req.Args.FromLamportsClockTimestamp {
+					replay = append(replay, makeWatchEvent(k, v))
+				}
+			}
+		}
+	}
+	srv.watchers.Lock()
+	srv.watchers.watchers[w] = struct{}{}
+	srv.watchers.Unlock()
+	srv.storage.Unlock()
+	defer srv.watchers.remove(w)
+
+	// lamport's clock timestamps are consistent with causality
+	sort.Slice(replay, func(i, j int) bool {
+		if replay[i].LamportsClockTimestamp != replay[j].LamportsClockTimestamp {
+			return replay[i].LamportsClockTimestamp < replay[j].LamportsClockTimestamp
+		}
+		return replay[i].OriginalServer < replay[j].OriginalServer
+	})
+
+	e := json.NewEncoder(conn)
+	if err := e.Encode(communication.ClientWatchResponse{
+		Op:             req.Op,
+		Result:         communication.Success,
+		DetailedResult: "watch is successful",
+	}); err != nil {
+		return
+	}
+	for _, event := range replay {
+		if err := e.Encode(event); err != nil {
+			return
+		}
+	}
+
+	// the client is not expected to send anything more, so a read returns when it disconnects
+	disconnected := make(chan struct{})
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		close(disconnected)
+	}()
+
+	for {
+		select {
+		case event, ok := <-w.events:
+			if !ok {
+				return
+			}
+			if err := e.Encode(event); err != nil {
+				return
+			}
+		case <-disconnected:
+			return
+		}
+	}
+}
+
+func makeWatchEvent(key string, v valueOfKey) communication.ClientWatchEvent {
+	value, encoding := communication.EncodeValue(v.value)
+	return communication.ClientWatchEvent{
+		Key:                    key,
+		Value:                  value,
+		ValueEncoding:          encoding,
+		OriginalServer:         v.originalServer,
+		LamportsClockTimestamp: v.lamportsClockTimestamp,
+		Deleted:                v.deleted,
+	}
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// testCertificateValidity is how long the certificates of a test cluster are valid for
+const testCertificateValidity = 365 * 24 * time.Hour
+
+// ServerOrganizationalUnit is the organizational unit in the subject of the certificates of servers, which tells
+// them apart from the certificates of clients signed by the same CA
+const ServerOrganizationalUnit = "server"
+
+// GenerateTestCertificates writes to dir a self-signed CA, ca.pem and ca-key.pem, and two certificates signed by it:
+// server.pem and server-key.pem, valid for the hosts, which may be names or ip addresses, and client.pem and
+// client-key.pem. The server certificate can be used by all the servers of a test cluster, and has the identity
+// of a server, which the client certificate, used by clients, has not
+func GenerateTestCertificates(dir string, hosts []string) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: AppName + " test CA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(testCertificateValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	// servers also present their certificate to the servers they dial
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: AppName + " test server", OrganizationalUnit: []string{ServerOrganizationalUnit}},
+		NotBefore:    now,
+		NotAfter:     now.Add(testCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: AppName + " test client"},
+		NotBefore:    now,
+		NotAfter:     now.Add(testCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	caKeyDer, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return err
+	}
+	blocks := map[string]*pem.Block{
+		"ca.pem":     {Type: "CERTIFICATE", Bytes: caDer},
+		"ca-key.pem": {Type: "EC PRIVATE KEY", Bytes: caKeyDer},
+	}
+	for name, template := range map[string]*x509.Certificate{"server": serverTemplate, "client": clientTemplate} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		blocks[name+".pem"] = &pem.Block{Type: "CERTIFICATE", Bytes: der}
+		blocks[name+"-key.pem"] = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}
+	}
+
+	for name, block := range blocks {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -34,3 +34,40 @@ func ValidateHostPort(hostPort string) error {
 	}
 	return nil
 }
+
+// SplitCommandLine splits a command line into arguments separated by whitespace.
+// An argument in double quotes may contain whitespace and Go escape sequences, such as "a b\n\x00"
+func SplitCommandLine(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		switch {
+		case line[i] == ' ' || line[i] == '\t':
+			i++
+		case line[i] == '"':
+			// find the closing quote, skipping escaped characters
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted argument %s", line[i:])
+			}
+			arg, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted argument %s: %w", line[i:j+1], err)
+			}
+			args = append(args, arg)
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+				j++
+			}
+			args = append(args, line[i:j])
+			i = j
+		}
+	}
+	return args, nil
+}